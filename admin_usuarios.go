@@ -0,0 +1,290 @@
+package sesiones
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+const (
+	limiteUsuariosDefault = 50
+	limiteUsuariosMaximo  = 500
+)
+
+// columnasOrdenUsuarios son los criterios por los que se puede ordenar el
+// listado de usuarios.
+var columnasOrdenUsuarios = map[string]string{
+	"creacion": "created_at",
+	"nombre":   "nombre",
+	"apellido": "apellido",
+	"email":    "email",
+}
+
+// FiltroUsuarios son los parámetros del listado de usuarios.
+type FiltroUsuarios struct {
+	Estado string
+	// Desde y Hasta filtran por fecha de creación
+	Desde time.Time
+	Hasta time.Time
+	// Texto busca en nombre, apellido, mail y nombre de usuario
+	Texto string
+	// Organizacion deja sólo los miembros de la organización
+	Organizacion string
+	// Orden es "creacion" (por defecto), "nombre", "apellido" o "email"
+	Orden string
+	Desc  bool
+	// Cursor es el valor de Siguiente de la página anterior
+	Cursor string
+	Limite int
+}
+
+// PaginaUsuarios es una página del listado de usuarios.
+type PaginaUsuarios struct {
+	Usuarios []Usuario
+	// Siguiente es el cursor para pedir la página siguiente. Vacío si no hay
+	// más.
+	Siguiente string
+}
+
+// cursorUsuarios es la posición del último usuario de una página.
+type cursorUsuarios struct {
+	Valor  string
+	Tiempo time.Time
+	ID     string
+}
+
+// ListarUsuarios devuelve los usuarios que cumplen con el filtro, paginados.
+func (h *Handler) ListarUsuarios(f FiltroUsuarios) (pag PaginaUsuarios, err error) {
+
+	if f.Orden == "" {
+		f.Orden = "creacion"
+	}
+	col, ok := columnasOrdenUsuarios[f.Orden]
+	if !ok {
+		return pag, errors.Errorf("no se puede ordenar por %v", f.Orden)
+	}
+	if f.Limite <= 0 {
+		f.Limite = limiteUsuariosDefault
+	}
+	if f.Limite > limiteUsuariosMaximo {
+		f.Limite = limiteUsuariosMaximo
+	}
+
+	q := h.db.Model(&Usuario{})
+
+	// Filtros
+	if f.Estado != "" {
+		q = q.Where("estado = ?", f.Estado)
+	}
+	if !f.Desde.IsZero() {
+		q = q.Where("created_at >= ?", f.Desde)
+	}
+	if !f.Hasta.IsZero() {
+		q = q.Where("created_at < ?", f.Hasta)
+	}
+	if f.Organizacion != "" {
+		miembros := h.db.Model(&MiembroOrganizacion{}).Select("user_id").Where("organizacion_id = ?", f.Organizacion).QueryExpr()
+		q = q.Where("id IN (?)", miembros)
+	}
+	if f.Texto != "" {
+		t := "%" + escaparLike(strings.ToLower(strings.TrimSpace(f.Texto))) + "%"
+		q = q.Where(
+			"LOWER(nombre) LIKE ? ESCAPE '!' OR LOWER(apellido) LIKE ? ESCAPE '!' OR "+
+				"email LIKE ? ESCAPE '!' OR username LIKE ? ESCAPE '!'",
+			t, t, t, t,
+		)
+	}
+
+	// Página
+	comp, dir := ">", "ASC"
+	if f.Desc {
+		comp, dir = "<", "DESC"
+	}
+	if f.Cursor != "" {
+		c, err := leerCursor(f.Cursor)
+		if err != nil {
+			return pag, err
+		}
+		var v interface{} = c.Valor
+		if col == "created_at" {
+			v = c.Tiempo
+		}
+		q = q.Where(col+" "+comp+" ? OR ("+col+" = ? AND id "+comp+" ?)", v, v, c.ID)
+	}
+
+	// Pido uno más para saber si hay página siguiente
+	err = q.Order(col + " " + dir).Order("id " + dir).Limit(f.Limite + 1).Find(&pag.Usuarios).Error
+	if err != nil {
+		return pag, errors.Wrap(err, "buscando usuarios")
+	}
+
+	if len(pag.Usuarios) > f.Limite {
+		pag.Usuarios = pag.Usuarios[:f.Limite]
+		ultimo := pag.Usuarios[f.Limite-1]
+		c := cursorUsuarios{ID: ultimo.ID, Tiempo: ultimo.CreatedAt}
+		switch col {
+		case "nombre":
+			c.Valor = ultimo.Nombre
+		case "apellido":
+			c.Valor = ultimo.Apellido
+		case "email":
+			c.Valor = ultimo.Email
+		}
+		pag.Siguiente = escribirCursor(c)
+	}
+
+	return pag, nil
+}
+
+func escribirCursor(c cursorUsuarios) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func leerCursor(s string) (c cursorUsuarios, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errors.Wrap(err, "cursor inválido")
+	}
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return c, errors.Wrap(err, "cursor inválido")
+	}
+	return c, nil
+}
+
+// escaparLike escapa los comodines de LIKE usando '!' como caracter de
+// escape.
+func escaparLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+// DetalleUsuario es toda la información de un usuario que ve un
+// administrador. Las confirmaciones van sin el ID, que es el código de los
+// links enviados por mail.
+type DetalleUsuario struct {
+	Usuario
+	Roles          []string
+	Confirmaciones []ConfirmacionExportada
+	CambiosEstado  []UsuarioCambioEstado
+}
+
+// DetalleUsuario devuelve el usuario con sus roles y su historial.
+func (h *Handler) DetalleUsuario(userID string) (d DetalleUsuario, err error) {
+	u, existe, err := h.existeUsuario(userID)
+	if err != nil {
+		return d, errors.Wrap(err, "buscando usuario")
+	}
+	if !existe {
+		return d, gorm.ErrRecordNotFound
+	}
+	d.Usuario = u
+
+	d.Roles, err = h.Roles(userID)
+	if err != nil {
+		return d, err
+	}
+
+	confirmaciones := []UsuarioConfirmacion{}
+	err = h.db.Where("user_id = ?", userID).Order("created_at").Find(&confirmaciones).Error
+	if err != nil {
+		return d, errors.Wrap(err, "buscando confirmaciones")
+	}
+	d.Confirmaciones = exportarConfirmaciones(confirmaciones)
+
+	err = h.db.Where("user_id = ?", userID).Order("created_at").Find(&d.CambiosEstado).Error
+	if err != nil {
+		return d, errors.Wrap(err, "buscando cambios de estado")
+	}
+	return d, nil
+}
+
+// ListadoUsuarios es el listado de usuarios para administradores. Los filtros van
+// como parámetros del query string: estado, desde, hasta (fechas
+// AAAA-MM-DD), q, organizacion, orden, desc, cursor y limite.
+func (h *Handler) ListadoUsuarios() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		_, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		// Leo los filtros
+		qs := r.URL.Query()
+		f := FiltroUsuarios{}
+		f.Estado = qs.Get("estado")
+		f.Texto = qs.Get("q")
+		f.Organizacion = qs.Get("organizacion")
+		f.Orden = qs.Get("orden")
+		f.Desc = qs.Get("desc") == "true"
+		f.Cursor = qs.Get("cursor")
+
+		var err error
+		if v := qs.Get("desde"); v != "" {
+			f.Desde, err = time.Parse("2006-01-02", v)
+			if err != nil {
+				httpErr(w, errors.Wrap(err, "leyendo fecha desde"), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := qs.Get("hasta"); v != "" {
+			f.Hasta, err = time.Parse("2006-01-02", v)
+			if err != nil {
+				httpErr(w, errors.Wrap(err, "leyendo fecha hasta"), http.StatusBadRequest)
+				return
+			}
+			// Incluyo el día
+			f.Hasta = f.Hasta.AddDate(0, 0, 1)
+		}
+		if v := qs.Get("limite"); v != "" {
+			f.Limite, err = strconv.Atoi(v)
+			if err != nil {
+				httpErr(w, errors.Wrap(err, "leyendo límite"), http.StatusBadRequest)
+				return
+			}
+		}
+
+		pag, err := h.ListarUsuarios(f)
+		if err != nil {
+			httpErr(w, err, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pag)
+	}
+}
+
+// VerUsuario devuelve el detalle de un usuario para administradores. El ID va
+// en el parámetro "id" del query string.
+func (h *Handler) VerUsuario() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		_, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		d, err := h.DetalleUsuario(r.URL.Query().Get("id"))
+		if err == gorm.ErrRecordNotFound {
+			httpErr(w, errors.New("no existe el usuario"), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d)
+	}
+}
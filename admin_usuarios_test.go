@@ -0,0 +1,20 @@
+package sesiones
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorUsuarios(t *testing.T) {
+	c := cursorUsuarios{Valor: "Pérez", ID: "8b7a"}
+	leido, err := leerCursor(escribirCursor(c))
+	assert.Nil(t, err)
+	assert.Equal(t, c.Valor, leido.Valor)
+	assert.Equal(t, c.ID, leido.ID)
+
+	_, err = leerCursor("no es un cursor")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, "100!% !_x!!", escaparLike("100% _x!"))
+}
@@ -0,0 +1,130 @@
+package sesiones
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// estadoAlConfirmarMail es el estado en el que queda el usuario cuando
+// confirma su dirección de mail.
+func (h *Handler) estadoAlConfirmarMail() string {
+	if h.RequiereAprobacion {
+		return EstadoPendienteAprobacion
+	}
+	return EstadoConfirmado
+}
+
+// UsuariosPendientes devuelve los usuarios que confirmaron su mail y están
+// esperando la aprobación de un administrador.
+func (h *Handler) UsuariosPendientes() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		_, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		usuarios := []Usuario{}
+		err := h.db.
+			Where("estado = ?", EstadoPendienteAprobacion).
+			Order("created_at").
+			Find(&usuarios).
+			Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando usuarios pendientes"), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usuarios)
+	}
+}
+
+// AprobarUsuario deja confirmado un usuario pendiente de aprobación y se lo
+// avisa por mail.
+func (h *Handler) AprobarUsuario() http.HandlerFunc {
+	return h.resolverAprobacion(true)
+}
+
+// RechazarUsuario rechaza un usuario pendiente de aprobación y le avisa por
+// mail el motivo.
+func (h *Handler) RechazarUsuario() http.HandlerFunc {
+	return h.resolverAprobacion(false)
+}
+
+func (h *Handler) resolverAprobacion(aprobar bool) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			UserID string
+			Motivo string
+		}{}
+
+		admin, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		if !aprobar && request.Motivo == "" {
+			httpErr(w, errors.New("debe ingresar el motivo del rechazo"), http.StatusBadRequest)
+			return
+		}
+
+		usuario, existe, err := h.existeUsuario(request.UserID)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando usuario"), http.StatusInternalServerError)
+			return
+		}
+		if !existe {
+			httpErr(w, errors.Errorf("no existe el usuario %v", request.UserID), http.StatusNotFound)
+			return
+		}
+		if usuario.Estado != EstadoPendienteAprobacion {
+			httpErr(w, errors.Errorf("el usuario no está pendiente de aprobación, está %v", usuario.Estado), http.StatusBadRequest)
+			return
+		}
+
+		nuevo, tpl, asunto := EstadoConfirmado, h.MailAprobacion, "Tu cuenta fue aprobada"
+		if !aprobar {
+			nuevo, tpl, asunto = EstadoRechazado, h.MailRechazo, "Tu cuenta fue rechazada"
+		}
+
+		tx := h.db.Begin()
+		err = h.cambiarEstado(tx, usuario, nuevo, admin.ID, request.Motivo)
+		if err != nil {
+			tx.Rollback()
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		err = tx.Commit().Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "confirmando transaccion"), http.StatusInternalServerError)
+			return
+		}
+
+		// Le aviso al usuario
+		if tpl == nil {
+			return
+		}
+		body, err := tpl.bodyAviso(usuario.Nombre, "", datosAviso{Fecha: time.Now(), Motivo: request.Motivo})
+		if err != nil {
+			h.logf("generando mail de aprobación para %v: %v", usuario.ID, err)
+			return
+		}
+		err = h.MailSender.Send(usuario.Email, h.MailSender.SenderAlias(), asunto, body)
+		if err != nil {
+			h.logf("enviando mail de aprobación a %v: %v", usuario.ID, err)
+		}
+	}
+}
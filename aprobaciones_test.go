@@ -0,0 +1,43 @@
+package sesiones
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstadoAlConfirmarMail(t *testing.T) {
+	cases := []struct {
+		requiereAprobacion bool
+		estado             string
+	}{
+		{false, EstadoConfirmado},
+		{true, EstadoPendienteAprobacion},
+	}
+	for _, c := range cases {
+		h := &Handler{RequiereAprobacion: c.requiereAprobacion}
+		assert.Equal(t, c.estado, h.estadoAlConfirmarMail(), "RequiereAprobacion %v", c.requiereAprobacion)
+	}
+}
+
+func TestPendienteAprobacion(t *testing.T) {
+	// Mientras no lo apruebe un administrador no puede ingresar
+	err := controlarEstado(Usuario{Estado: EstadoPendienteAprobacion})
+	assert.Equal(t, ErrPendienteAprobacion{}, err)
+	assert.Equal(t, "pendiente_aprobacion", motivoLoginFallido(err))
+
+	assert.Equal(t, ErrAutenticacion{"la cuenta fue rechazada"}, controlarEstado(Usuario{Estado: EstadoRechazado}))
+}
+
+func TestAprobacionSinSesion(t *testing.T) {
+	h := &Handler{}
+	h.secretKey = []byte("secreto")
+
+	for _, f := range []http.HandlerFunc{h.UsuariosPendientes(), h.AprobarUsuario(), h.RechazarUsuario()} {
+		w := httptest.NewRecorder()
+		f(w, httptest.NewRequest("POST", "/", nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+}
@@ -0,0 +1,285 @@
+package sesiones
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// Autenticador corrobora usuario y contraseña contra un origen de cuentas,
+// por ejemplo la base de datos o un directorio LDAP.
+type Autenticador interface {
+	// Autenticar devuelve el usuario local que corresponde a las
+	// credenciales. Si no reconoce al usuario o la contraseña no coincide
+	// devuelve ErrAutenticacion, y si no puede consultar el origen
+	// ErrAutenticadorNoDisponible.
+	Autenticar(login, password string) (usuario Usuario, err error)
+}
+
+// autenticadorBase autentica con el hash guardado en la base de datos.
+type autenticadorBase struct {
+	h *Handler
+}
+
+func (a autenticadorBase) Autenticar(login, password string) (Usuario, error) {
+	return a.h.autenticarBase(login, password)
+}
+
+// AutenticadorBase devuelve el autenticador de la base de datos, para
+// combinarlo con otros en Autenticadores.
+func (h *Handler) AutenticadorBase() Autenticador {
+	return autenticadorBase{h}
+}
+
+// ConfigLDAP es la configuración de un directorio LDAP o Active Directory.
+type ConfigLDAP struct {
+	// URL del servidor, por ejemplo "ldaps://ad.empresa.local:636"
+	URL string
+	// StartTLS pasa a TLS una conexión ldap://. TLS es la configuración de
+	// ambos casos.
+	StartTLS bool
+	TLS      *tls.Config
+	// BindDN y BindPassword son la cuenta de servicio con la que se busca al
+	// usuario. Si están vacíos se busca en forma anónima.
+	BindDN       string
+	BindPassword string
+	// BaseDN es donde se busca al usuario
+	BaseDN string
+	// Filtro encuentra al usuario. {login} se reemplaza por lo que ingresó.
+	// Por defecto (|(uid={login})(mail={login})(sAMAccountName={login})).
+	Filtro string
+	// Atributos del directorio. Por defecto mail, givenName, sn y memberOf.
+	AtributoMail     string
+	AtributoNombre   string
+	AtributoApellido string
+	AtributoGrupos   string
+	// Roles asigna un rol local a los miembros de cada grupo (DN del grupo).
+	// En cada ingreso se asignan y quitan los roles de este mapa según los
+	// grupos del usuario; los demás roles no se tocan.
+	Roles map[string]string
+	// CrearUsuarios da de alta el usuario local en su primer ingreso. Si es
+	// false sólo pueden ingresar los usuarios que ya existen con el mismo
+	// mail.
+	CrearUsuarios bool
+	// Timeout de la conexión y de cada operación. Por defecto 10 segundos.
+	Timeout time.Duration
+}
+
+// conexionLDAP es lo que se usa de ldap.Conn.
+type conexionLDAP interface {
+	Bind(username, password string) error
+	Search(*ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// AutenticadorLDAP autentica buscando al usuario en el directorio y haciendo
+// un bind con su DN y la contraseña.
+type AutenticadorLDAP struct {
+	h        *Handler
+	config   ConfigLDAP
+	conectar func() (conexionLDAP, error)
+}
+
+// NuevoAutenticadorLDAP crea un autenticador para el directorio.
+func (h *Handler) NuevoAutenticadorLDAP(c ConfigLDAP) *AutenticadorLDAP {
+	if c.Filtro == "" {
+		c.Filtro = "(|(uid={login})(mail={login})(sAMAccountName={login}))"
+	}
+	if c.AtributoMail == "" {
+		c.AtributoMail = "mail"
+	}
+	if c.AtributoNombre == "" {
+		c.AtributoNombre = "givenName"
+	}
+	if c.AtributoApellido == "" {
+		c.AtributoApellido = "sn"
+	}
+	if c.AtributoGrupos == "" {
+		c.AtributoGrupos = "memberOf"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	a := &AutenticadorLDAP{h: h, config: c}
+	a.conectar = a.conectarServidor
+	return a
+}
+
+func (a *AutenticadorLDAP) conectarServidor() (conexionLDAP, error) {
+	conn, err := ldap.DialURL(a.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.config.Timeout}),
+		ldap.DialWithTLSConfig(a.config.TLS),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.config.Timeout)
+	if a.config.StartTLS {
+		err = conn.StartTLS(a.config.TLS)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "iniciando TLS")
+		}
+	}
+	return conn, nil
+}
+
+// entradaLDAP son los datos del usuario en el directorio.
+type entradaLDAP struct {
+	DN       string
+	Mail     string
+	Nombre   string
+	Apellido string
+	Grupos   []string
+}
+
+// buscarEnDirectorio busca al usuario y corrobora la contraseña con un bind.
+func (a *AutenticadorLDAP) buscarEnDirectorio(login, password string) (e entradaLDAP, err error) {
+	// Un bind con contraseña vacía es anónimo y el servidor lo acepta
+	if login == "" || password == "" {
+		return e, ErrAutenticacion{"usuario o contraseña incorrectos"}
+	}
+
+	conn, err := a.conectar()
+	if err != nil {
+		return e, ErrAutenticadorNoDisponible{err.Error()}
+	}
+	defer conn.Close()
+
+	if a.config.BindDN != "" {
+		err = conn.Bind(a.config.BindDN, a.config.BindPassword)
+		if err != nil {
+			return e, ErrAutenticadorNoDisponible{"bind de la cuenta de servicio: " + err.Error()}
+		}
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(a.config.Timeout.Seconds()), false,
+		strings.Replace(a.config.Filtro, "{login}", ldap.EscapeFilter(login), -1),
+		[]string{a.config.AtributoMail, a.config.AtributoNombre, a.config.AtributoApellido, a.config.AtributoGrupos},
+		nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return e, ErrAutenticadorNoDisponible{"buscando usuario: " + err.Error()}
+	}
+	if res == nil || len(res.Entries) != 1 {
+		return e, ErrAutenticacion{"el usuario no existe"}
+	}
+	entry := res.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return e, ErrAutenticacion{"usuario o contraseña incorrectos"}
+	}
+	if err != nil {
+		return e, ErrAutenticadorNoDisponible{"bind del usuario: " + err.Error()}
+	}
+
+	e.DN = entry.DN
+	e.Mail = normalizarLogin(entry.GetAttributeValue(a.config.AtributoMail))
+	e.Nombre = entry.GetAttributeValue(a.config.AtributoNombre)
+	e.Apellido = entry.GetAttributeValue(a.config.AtributoApellido)
+	e.Grupos = entry.GetAttributeValues(a.config.AtributoGrupos)
+	return e, nil
+}
+
+// roles devuelve, para cada rol del mapa, si corresponde según los grupos.
+func (a *AutenticadorLDAP) roles(grupos []string) map[string]bool {
+	roles := map[string]bool{}
+	for grupo, rol := range a.config.Roles {
+		miembro := false
+		for _, g := range grupos {
+			if strings.EqualFold(g, grupo) {
+				miembro = true
+			}
+		}
+		roles[rol] = roles[rol] || miembro
+	}
+	return roles
+}
+
+// Autenticar busca al usuario en el directorio, corrobora la contraseña y
+// devuelve el usuario local con el mismo mail, que crea si CrearUsuarios es
+// true. Los roles mapeados se actualizan según los grupos.
+func (a *AutenticadorLDAP) Autenticar(login, password string) (usuario Usuario, err error) {
+	e, err := a.buscarEnDirectorio(login, password)
+	if err != nil {
+		return usuario, err
+	}
+	if e.Mail == "" {
+		return usuario, ErrAutenticacion{"el usuario del directorio no tiene mail"}
+	}
+
+	usuario, existe, err := a.h.buscarUsuario(e.Mail)
+	if err != nil {
+		return usuario, errors.Wrap(err, "buscando usuario")
+	}
+	if !existe {
+		if !a.config.CrearUsuarios {
+			return usuario, ErrAutenticacion{"el usuario no está dado de alta"}
+		}
+		usuario, err = a.crearUsuario(e)
+		if err != nil {
+			return usuario, err
+		}
+	}
+
+	for rol, corresponde := range a.roles(e.Grupos) {
+		if corresponde {
+			err = a.h.AsignarRol(usuario.ID, rol)
+		} else {
+			err = a.h.QuitarRol(usuario.ID, rol)
+		}
+		if err != nil {
+			return usuario, err
+		}
+	}
+
+	return usuario, controlarEstado(usuario)
+}
+
+// crearUsuario da de alta el usuario local. El mail se considera confirmado
+// porque lo administra el directorio.
+func (a *AutenticadorLDAP) crearUsuario(e entradaLDAP) (usuario Usuario, err error) {
+	h := a.h
+	uid, _ := uuid.NewV4()
+	usuario.ID = uid.String()
+	usuario.Email = e.Mail
+	usuario.Nombre = e.Nombre
+	usuario.Apellido = e.Apellido
+	usuario.Estado = h.estadoAlConfirmarMail()
+	usuario.UltimaActualizacionContraseña = time.Now()
+
+	ev := nuevoEvento(EventoUsuarioCreado, usuario, nil)
+	ev.Datos = map[string]interface{}{"DN": e.DN}
+	err = h.validarEvento(ev)
+	if err != nil {
+		return usuario, err
+	}
+
+	tx := h.db.Begin()
+	err = tx.Create(&usuario).Error
+	if err != nil {
+		tx.Rollback()
+		return usuario, errors.Wrap(err, "creando usuario")
+	}
+	conf := UsuarioConfirmacion{UserID: usuario.ID, Motivo: MotivoCreacion, Confirmada: true, FechaConfirmacion: time.Now()}
+	conf.ID, _ = uuid.NewV4()
+	err = tx.Create(&conf).Error
+	if err != nil {
+		tx.Rollback()
+		return usuario, errors.Wrap(err, "creando confirmación")
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return usuario, errors.Wrap(err, "confirmando transaccion")
+	}
+	h.emitir(ev)
+	return usuario, nil
+}
@@ -0,0 +1,131 @@
+package sesiones
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+// directorioFalso reemplaza al servidor LDAP en los tests.
+type directorioFalso struct {
+	entradas  []*ldap.Entry
+	passwords map[string]string
+	caido     bool
+}
+
+func (d *directorioFalso) conectar() (conexionLDAP, error) {
+	if d.caido {
+		return nil, errors.New("connection refused")
+	}
+	return d, nil
+}
+
+func (d *directorioFalso) Bind(dn, password string) error {
+	if p, ok := d.passwords[dn]; ok && p == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+// Search devuelve las entradas cuyo uid aparece en el filtro.
+func (d *directorioFalso) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	res := &ldap.SearchResult{}
+	for _, e := range d.entradas {
+		if strings.Contains(req.Filter, "(uid="+e.GetAttributeValue("uid")+")") {
+			res.Entries = append(res.Entries, e)
+		}
+	}
+	return res, nil
+}
+
+func (d *directorioFalso) Close() {}
+
+func TestAutenticadorLDAP(t *testing.T) {
+	d := &directorioFalso{
+		entradas: []*ldap.Entry{ldap.NewEntry("uid=ornela,ou=personas,dc=sweet,dc=com", map[string][]string{
+			"uid":       {"ornela"},
+			"mail":      {"Ornela@Sweet.com.ar"},
+			"givenName": {"Ornela"},
+			"sn":        {"Sweet"},
+			"memberOf":  {"CN=Admins,OU=Grupos,DC=sweet,DC=com"},
+		})},
+		passwords: map[string]string{
+			"cn=servicio,dc=sweet,dc=com":            "servicio",
+			"uid=ornela,ou=personas,dc=sweet,dc=com": "secreta",
+		},
+	}
+	h := &Handler{}
+	a := h.NuevoAutenticadorLDAP(ConfigLDAP{
+		BindDN:       "cn=servicio,dc=sweet,dc=com",
+		BindPassword: "servicio",
+		Roles: map[string]string{
+			"cn=admins,ou=grupos,dc=sweet,dc=com":  RolAdmin,
+			"cn=ventas,ou=grupos,dc=sweet,dc=com":  "ventas",
+			"cn=soporte,ou=grupos,dc=sweet,dc=com": RolAdmin,
+		},
+	})
+	a.conectar = d.conectar
+
+	e, err := a.buscarEnDirectorio("ornela", "secreta")
+	assert.Nil(t, err)
+	assert.Equal(t, "ornela@sweet.com.ar", e.Mail)
+	assert.Equal(t, "Sweet", e.Apellido)
+	assert.Equal(t, map[string]bool{RolAdmin: true, "ventas": false}, a.roles(e.Grupos))
+
+	// Contraseña incorrecta, vacía o usuario inexistente
+	_, err = a.buscarEnDirectorio("ornela", "otra")
+	assert.IsType(t, ErrAutenticacion{}, err)
+	_, err = a.buscarEnDirectorio("ornela", "")
+	assert.IsType(t, ErrAutenticacion{}, err)
+	_, err = a.buscarEnDirectorio("nadie", "secreta")
+	assert.IsType(t, ErrAutenticacion{}, err)
+
+	// Los caracteres especiales del login no cambian el filtro
+	_, err = a.buscarEnDirectorio("*)(uid=ornela", "secreta")
+	assert.IsType(t, ErrAutenticacion{}, err)
+
+	// Servidor caído o cuenta de servicio mal configurada
+	a.config.BindPassword = "otra"
+	_, err = a.buscarEnDirectorio("ornela", "secreta")
+	assert.IsType(t, ErrAutenticadorNoDisponible{}, err)
+	d.caido = true
+	_, err = a.buscarEnDirectorio("ornela", "secreta")
+	assert.IsType(t, ErrAutenticadorNoDisponible{}, err)
+}
+
+// autenticadorFijo acepta un único login o devuelve siempre el mismo error.
+type autenticadorFijo struct {
+	login string
+	err   error
+}
+
+func (a autenticadorFijo) Autenticar(login, password string) (Usuario, error) {
+	if a.err != nil {
+		return Usuario{}, a.err
+	}
+	if login != a.login {
+		return Usuario{}, ErrAutenticacion{"el usuario no existe"}
+	}
+	return Usuario{ID: login}, nil
+}
+
+func TestCadenaAutenticadores(t *testing.T) {
+	h := &Handler{}
+	caido := autenticadorFijo{err: ErrAutenticadorNoDisponible{"connection refused"}}
+	h.Autenticadores = []Autenticador{caido, autenticadorFijo{login: "a"}, autenticadorFijo{login: "b"}}
+
+	u, err := h.checkPass("b", "x")
+	assert.Nil(t, err)
+	assert.Equal(t, "b", u.ID)
+
+	_, err = h.checkPass("c", "x")
+	assert.IsType(t, ErrAutenticacion{}, err)
+
+	// Un usuario suspendido no sigue probando con los demás
+	h.Autenticadores = []Autenticador{autenticadorFijo{err: ErrCuentaSuspendida{}}, autenticadorFijo{login: "a"}}
+	_, err = h.checkPass("a", "x")
+	assert.IsType(t, ErrCuentaSuspendida{}, err)
+}
@@ -0,0 +1,224 @@
+package sesiones
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// MotivoNoFuiYo es el motivo de las confirmaciones que se mandan en los
+// avisos de seguridad. Si el usuario hace clic en el link se cierran todas
+// sus sesiones y se lo obliga a blanquear la contraseña.
+const MotivoNoFuiYo = "No fui yo"
+
+// UsuarioDispositivo es cada combinación de IP y navegador desde la que un
+// usuario ingresó al sistema.
+type UsuarioDispositivo struct {
+	ID        uuid.UUID
+	UserID    string
+	IP        string
+	UserAgent string
+	CreatedAt time.Time
+	UltimoUso time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (u UsuarioDispositivo) TableName() string {
+	return "usuario_dispositivos"
+}
+
+// avisar le manda al usuario un aviso de seguridad con el link de "no fui
+// yo". Si el template es nil no hace nada.
+func (h *Handler) avisar(usuario Usuario, tpl *MailTemplate, asunto string, datos datosAviso) (err error) {
+	if tpl == nil {
+		return nil
+	}
+
+	// Creo el registro con el codigo de "no fui yo".
+	conf := UsuarioConfirmacion{}
+	conf.ID, _ = uuid.NewV4()
+	conf.UserID = usuario.ID
+	conf.Motivo = MotivoNoFuiYo
+	err = h.db.Create(&conf).Error
+	if err != nil {
+		return errors.Wrap(err, "creando confirmación de aviso")
+	}
+
+	if datos.Fecha.IsZero() {
+		datos.Fecha = time.Now()
+	}
+	body, err := tpl.bodyAviso(usuario.Nombre, conf.ID.String(), datos)
+	if err != nil {
+		return errors.Wrap(err, "generando el body del mail")
+	}
+
+	err = h.MailSender.Send(usuario.Email, h.MailSender.SenderAlias(), asunto, body)
+	if err != nil {
+		return errors.Wrap(err, "enviando aviso")
+	}
+	return nil
+}
+
+// avisarCambioContraseña se llama después de que se cambió o blanqueó la
+// contraseña. Un error en el aviso no deshace el cambio, sólo se loguea.
+func (h *Handler) avisarCambioContraseña(userID string) {
+	usuario, existe, err := h.existeUsuario(userID)
+	if err != nil || !existe {
+		h.logf("buscando usuario %v para aviso de cambio de contraseña: %v", userID, err)
+		return
+	}
+	err = h.avisar(usuario, h.MailAvisoCambioContraseña, "Se cambió tu contraseña", datosAviso{})
+	if err != nil {
+		h.logf("avisando cambio de contraseña a %v: %v", userID, err)
+	}
+}
+
+// avisarCambioMail se llama cuando se solicita cambiar la dirección de mail
+// del usuario. El aviso va a la dirección anterior.
+func (h *Handler) avisarCambioMail(usuario Usuario, mailNuevo string) {
+	err := h.avisar(usuario, h.MailAvisoCambioMail, "Cambio de dirección de correo electrónico", datosAviso{MailNuevo: mailNuevo})
+	if err != nil {
+		h.logf("avisando cambio de mail a %v: %v", usuario.ID, err)
+	}
+}
+
+// controlarDispositivo registra el dispositivo desde el que se hizo el login.
+// Si el usuario ya había ingresado antes desde otros dispositivos pero nunca
+// desde este, le manda un aviso.
+func (h *Handler) controlarDispositivo(usuario Usuario, r *http.Request) (err error) {
+	ip := ipRequest(r)
+	ua := r.UserAgent()
+
+	// ¿Lo conozco?
+	disp := []UsuarioDispositivo{}
+	err = h.db.Where("user_id = ?", usuario.ID).Find(&disp).Error
+	if err != nil {
+		return errors.Wrap(err, "buscando dispositivos del usuario")
+	}
+	for _, v := range disp {
+		if v.IP == ip && v.UserAgent == ua {
+			err = h.db.Model(&v).Update("ultimo_uso", time.Now()).Error
+			if err != nil {
+				return errors.Wrap(err, "actualizando dispositivo")
+			}
+			return nil
+		}
+	}
+
+	// Es nuevo, lo registro
+	nuevo := UsuarioDispositivo{}
+	nuevo.ID, _ = uuid.NewV4()
+	nuevo.UserID = usuario.ID
+	nuevo.IP = ip
+	nuevo.UserAgent = ua
+	nuevo.UltimoUso = time.Now()
+	err = h.db.Create(&nuevo).Error
+	if err != nil {
+		return errors.Wrap(err, "registrando dispositivo")
+	}
+
+	// En el primer ingreso no aviso
+	if len(disp) == 0 || h.MailAvisoNuevoDispositivo == nil {
+		return nil
+	}
+
+	// El aviso se manda aparte para no demorar el login
+	go func() {
+		err := h.avisar(usuario, h.MailAvisoNuevoDispositivo, "Nuevo ingreso a tu cuenta", datosAviso{IP: ip, UserAgent: ua})
+		if err != nil {
+			h.logf("avisando nuevo dispositivo a %v: %v", usuario.ID, err)
+		}
+	}()
+	return nil
+}
+
+// NoFuiYo se llama desde el link de los avisos de seguridad. Cierra todas
+// las sesiones del usuario y lo obliga a blanquear la contraseña en el
+// próximo ingreso.
+func (h *Handler) NoFuiYo() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			ID uuid.UUID
+		}{}
+
+		// Leo el ID de la confirmación
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "no se pudo leer el ID"), http.StatusBadRequest)
+			return
+		}
+
+		// Busco que esté disponible esa confirmación
+		c := UsuarioConfirmacion{}
+		err = h.db.First(&c, "id = ? AND motivo = ?", request.ID, MotivoNoFuiYo).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "no se pudo obtener el registro de confirmación"), http.StatusInternalServerError)
+			return
+		}
+
+		if c.Confirmada {
+			httpErr(w, errors.New("el link ya fue utilizado"), http.StatusInternalServerError)
+			return
+		}
+		if c.vencida(h.DuracionNoFuiYo) {
+			httpErr(w, errors.New("el link está vencido"), http.StatusBadRequest)
+			return
+		}
+
+		c.Confirmada = true
+		c.FechaConfirmacion = time.Now()
+
+		tx := h.db.Begin()
+
+		err = tx.Save(&c).Error
+		if err != nil {
+			tx.Rollback()
+			httpErr(w, errors.Wrap(err, "actualizando estado de solicitud"), http.StatusInternalServerError)
+			return
+		}
+
+		// Revoco sesiones y obligo a blanquear
+		err = tx.
+			Model(&Usuario{}).
+			Where("id = ?", c.UserID).
+			Update(revocacionNoFuiYo(time.Now())).
+			Error
+		if err != nil {
+			tx.Rollback()
+			httpErr(w, errors.Wrap(err, "persistiendo usuario"), http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit().Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "confirmando transaccion"), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// revocacionNoFuiYo son los cambios que NoFuiYo le hace al usuario: cierra
+// todas las sesiones abiertas hasta ahora y lo obliga a blanquear la
+// contraseña con el link que se manda por mail.
+func revocacionNoFuiYo(ahora time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"SesionesValidasDesde":    ahora,
+		"BlanquearProximoIngreso": true,
+		"MotivoBlanqueo":          motivoBlanqueoNoFuiYo,
+	}
+}
+
+// ipRequest devuelve la IP desde la que se hizo el request.
+func ipRequest(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
@@ -0,0 +1,59 @@
+package sesiones
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAvisosPorDefecto(t *testing.T) {
+	blanqueo, err := NewMailTemplate(defaultBlanqueoTemplate, "www.sweet.com.ar/#/auth/blanquear")
+	assert.Nil(t, err)
+	confirmacion, err := NewMailTemplate(defaultConfirmacionUsuarioTemplate, "www.sweet.com.ar/#/auth/confirmar_usuario")
+	assert.Nil(t, err)
+
+	h, err := New([]byte("secreto"), nil, blanqueo, confirmacion, nil)
+	assert.Nil(t, err)
+	for _, v := range []*MailTemplate{h.MailAvisoCambioContraseña, h.MailAvisoNuevoDispositivo, h.MailAvisoCambioMail} {
+		if assert.NotNil(t, v) {
+			assert.Equal(t, "www.sweet.com.ar/#/auth/no_fui_yo", v.frontEndPath)
+		}
+	}
+
+	body, err := h.MailAvisoNuevoDispositivo.bodyAviso("Marcos", "123", datosAviso{IP: "10.0.0.1"})
+	assert.Nil(t, err)
+	assert.Contains(t, body, "www.sweet.com.ar/#/auth/no_fui_yo/?id=123")
+	assert.Contains(t, body, "10.0.0.1")
+}
+
+func TestRevocacionNoFuiYo(t *testing.T) {
+	ahora := time.Now()
+	cambios := revocacionNoFuiYo(ahora)
+
+	u := Usuario{
+		SesionesValidasDesde:    cambios["SesionesValidasDesde"].(time.Time),
+		BlanquearProximoIngreso: cambios["BlanquearProximoIngreso"].(bool),
+		MotivoBlanqueo:          cambios["MotivoBlanqueo"].(string),
+	}
+
+	// Las sesiones abiertas quedan revocadas
+	assert.True(t, sesionRevocada(u, jwt.MapClaims{"iat": float64(ahora.Add(-time.Minute).Unix())}))
+
+	// Y tiene que blanquear con el link del mail
+	h := &Handler{}
+	assert.True(t, u.BlanquearProximoIngreso)
+	assert.False(t, blanqueoConContraseña(u))
+	assert.Equal(t, ErrCorrespondeBlanquear{"hay que pedir el link de blanqueo por mail"}, h.controlarBlanqueo(u))
+}
+
+func TestNoFuiYoSinID(t *testing.T) {
+	h := &Handler{}
+	w := httptest.NewRecorder()
+	h.NoFuiYo()(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"ID": "no es un id"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,254 @@
+package sesiones
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// caracteresPasswordTemporal son los caracteres con los que se generan las
+// contraseñas temporales. No incluye los que se confunden entre sí.
+const caracteresPasswordTemporal = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// Motivos por los que el usuario tiene que blanquear la contraseña en el
+// próximo ingreso.
+const (
+	motivoBlanqueoTemporal = "password_temporal"
+	motivoBlanqueoNoFuiYo  = "no_fui_yo"
+	motivoBlanqueoForzado  = "forzado"
+)
+
+// errBlanqueoPorMail es el error de los cambios de contraseña con la actual
+// cuando el blanqueo tiene que hacerse con el link que se envía por mail.
+var errBlanqueoPorMail = errors.New("la contraseña sólo se puede blanquear con el link que se envía por mail")
+
+// blanqueoConContraseña indica si el usuario puede reemplazar con la
+// contraseña actual la que tiene que blanquear: si venció o si es una
+// contraseña temporal. Después de "no fui yo" o de un blanqueo forzado la
+// contraseña puede estar en manos de otro, así que se exige el mail.
+func blanqueoConContraseña(u Usuario) bool {
+	return !u.BlanquearProximoIngreso || u.MotivoBlanqueo == motivoBlanqueoTemporal
+}
+
+// generarPasswordTemporal devuelve una contraseña aleatoria que cumple con
+// las directivas.
+func (h *Handler) generarPasswordTemporal() (pass string, err error) {
+	largo := 12
+	if h.PassMinLength > largo {
+		largo = h.PassMinLength
+	}
+	if h.PassMaxLength > 0 && largo > h.PassMaxLength {
+		largo = h.PassMaxLength
+	}
+
+	b := make([]byte, largo)
+	max := big.NewInt(int64(len(caracteresPasswordTemporal)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", errors.Wrap(err, "generando contraseña")
+		}
+		b[i] = caracteresPasswordTemporal[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// PasswordTemporal le pone al usuario una contraseña generada que tiene que
+// cambiar en el próximo ingreso. Sólo lo puede hacer un administrador.
+//
+// Si Enviar es true y está configurado MailPasswordTemporal, la contraseña se
+// le manda por mail al usuario; si no, se devuelve en la respuesta. En
+// ningún caso se puede volver a consultar.
+func (h *Handler) PasswordTemporal() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			UserID string
+			Enviar bool
+		}{}
+
+		_, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		if request.Enviar && h.MailPasswordTemporal == nil {
+			httpErr(w, errors.New("no se ingresó template de contraseña temporal"), http.StatusNotImplemented)
+			return
+		}
+
+		usuario, existe, err := h.existeUsuario(request.UserID)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando usuario"), http.StatusInternalServerError)
+			return
+		}
+		if !existe {
+			httpErr(w, errors.Errorf("no existe el usuario %v", request.UserID), http.StatusNotFound)
+			return
+		}
+
+		pass, err := h.generarPasswordTemporal()
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		err = h.blanquearPassword(usuario.ID, pass, true)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "blanqueando password"), codigoHTTP(err, http.StatusInternalServerError))
+			return
+		}
+
+		if request.Enviar {
+			body, err := h.MailPasswordTemporal.bodyAviso(usuario.Nombre, "", datosAviso{Fecha: time.Now(), Password: pass})
+			if err != nil {
+				httpErr(w, errors.Wrap(err, "generando el body del mail"), http.StatusInternalServerError)
+				return
+			}
+			err = h.MailSender.Send(usuario.Email, h.MailSender.SenderAlias(), "Contraseña temporal", body)
+			if err != nil {
+				httpErr(w, errors.Wrap(err, "enviando contraseña temporal"), http.StatusInternalServerError)
+				return
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct{ Password string }{pass})
+	}
+}
+
+// ForzarBlanqueo obliga a los usuarios indicados (o a todos) a cambiar la
+// contraseña en el próximo ingreso, por ejemplo después de una filtración.
+// Si CerrarSesiones es true además se cierran sus sesiones abiertas. Sólo lo
+// puede hacer un administrador.
+func (h *Handler) ForzarBlanqueo() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			UserIDs        []string
+			Todos          bool
+			CerrarSesiones bool
+		}{}
+
+		_, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		if !request.Todos && len(request.UserIDs) == 0 {
+			httpErr(w, errors.New("debe indicar los usuarios"), http.StatusBadRequest)
+			return
+		}
+
+		campos := map[string]interface{}{"BlanquearProximoIngreso": true, "MotivoBlanqueo": motivoBlanqueoForzado}
+		if request.CerrarSesiones {
+			campos["SesionesValidasDesde"] = time.Now()
+		}
+
+		q := h.db.Model(&Usuario{})
+		if !request.Todos {
+			q = q.Where("id IN (?)", request.UserIDs)
+		}
+		res := q.Update(campos)
+		if res.Error != nil {
+			httpErr(w, errors.Wrap(res.Error, "actualizando usuarios"), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct{ Usuarios int64 }{res.RowsAffected})
+	}
+}
+
+// BlanqueoObligatorio lo usa el usuario que recibió ErrCorrespondeBlanquear al
+// ingresar porque la contraseña venció o es temporal. Con la contraseña
+// actual pone una nueva, sin tener que esperar un mail, y queda con la sesión
+// iniciada. Después de "no fui yo" o de un blanqueo forzado no se puede: hay
+// que usar el link de ConfirmarBlanqueo.
+func (h *Handler) BlanqueoObligatorio() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			UserID string
+			Actual string
+			Pass   string
+			Pass2  string
+		}{}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		if request.Pass != request.Pass2 {
+			httpErr(w, errors.New("las contraseñas no coinciden"), http.StatusBadRequest)
+			return
+		}
+		if request.Pass == request.Actual {
+			httpErr(w, errors.New("la contraseña nueva tiene que ser distinta de la actual"), http.StatusBadRequest)
+			return
+		}
+		err = h.validarPassword(request.Pass)
+		if err != nil {
+			httpErr(w, err, http.StatusBadRequest)
+			return
+		}
+
+		// Tiene que ser una contraseña correcta que deba cambiarse
+		usuario, err := h.checkPass(request.UserID, request.Actual)
+		if _, ok := errors.Cause(err).(ErrCorrespondeBlanquear); !ok {
+			if err == nil {
+				err = errors.New("la contraseña no necesita cambiarse")
+			}
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+		if !blanqueoConContraseña(usuario) {
+			httpErr(w, errBlanqueoPorMail, http.StatusForbidden)
+			return
+		}
+
+		// Salvo la contraseña, tiene que estar en condiciones de ingresar
+		err = controlarEstado(usuario)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		err = h.blanquearPassword(usuario.ID, request.Pass, false)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "blanqueando password"), codigoHTTP(err, http.StatusInternalServerError))
+			return
+		}
+		h.avisarCambioContraseña(usuario.ID)
+
+		usuario.UltimaActualizacionContraseña = time.Now()
+		err = h.iniciarSesion(w, r, usuario)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "iniciando sesión"), codigoHTTP(err, http.StatusInternalServerError))
+			return
+		}
+	}
+}
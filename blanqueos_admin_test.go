@@ -0,0 +1,49 @@
+package sesiones
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlanqueoConContraseña(t *testing.T) {
+	casos := []struct {
+		blanquear bool
+		motivo    string
+		permite   bool
+	}{
+		{false, "", true},
+		{true, motivoBlanqueoTemporal, true},
+		{true, motivoBlanqueoNoFuiYo, false},
+		{true, motivoBlanqueoForzado, false},
+		{true, "", false},
+	}
+	for _, c := range casos {
+		u := Usuario{BlanquearProximoIngreso: c.blanquear, MotivoBlanqueo: c.motivo}
+		assert.Equal(t, c.permite, blanqueoConContraseña(u), c.motivo)
+	}
+
+	// El login avisa que hay que pedir el link
+	h := &Handler{}
+	err := h.controlarBlanqueo(Usuario{BlanquearProximoIngreso: true, MotivoBlanqueo: motivoBlanqueoNoFuiYo})
+	e, ok := errors.Cause(err).(ErrCorrespondeBlanquear)
+	assert.True(t, ok)
+	assert.NotEmpty(t, e.Msg)
+	err = h.controlarBlanqueo(Usuario{BlanquearProximoIngreso: true, MotivoBlanqueo: motivoBlanqueoTemporal})
+	assert.Equal(t, ErrCorrespondeBlanquear{}, err)
+}
+
+func TestPasswordTemporal(t *testing.T) {
+	h := Handler{}
+	h.PassMinLength = 6
+	h.PassMaxLength = 10
+
+	a, err := h.generarPasswordTemporal()
+	assert.Nil(t, err)
+	assert.Nil(t, h.validarPassword(a))
+
+	b, err := h.generarPasswordTemporal()
+	assert.Nil(t, err)
+	assert.NotEqual(t, a, b)
+}
@@ -0,0 +1,303 @@
+package sesiones
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// MotivoBajaSolicitada es el motivo que queda en el historial de estados
+// cuando el usuario pide borrar su cuenta.
+const MotivoBajaSolicitada = "Baja solicitada por el usuario"
+
+// mailAnonimo es la dirección que queda en los usuarios borrados. Tiene que
+// ser distinta para cada uno porque el mail es único.
+func mailAnonimo(userID string) string {
+	return "borrado-" + userID + "@borrado.invalid"
+}
+
+// BorrarCuenta da de baja la cuenta del usuario de la sesión. Pide la
+// contraseña nuevamente o, si no tiene, un ingreso reciente. La cuenta queda deshabilitada y se puede restaurar
+// con "restaurar_cuenta" durante PlazoBorrado; pasado ese plazo
+// BorrarCuentasVencidas anonimiza sus datos.
+func (h *Handler) BorrarCuenta() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			Pass string
+		}{}
+
+		usuario, err := h.usuarioSesionPropia(r)
+		if err != nil {
+			httpErr(w, err, codigoSesion(err))
+			return
+		}
+
+		err = json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		err = h.reautenticar(r, usuario, request.Pass)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		ahora := time.Now()
+		tx := h.db.Begin()
+		err = h.cambiarEstado(tx, usuario, EstadoDeshabilitado, "", MotivoBajaSolicitada)
+		if err != nil {
+			tx.Rollback()
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		err = tx.Model(&Usuario{}).Where("id = ?", usuario.ID).Update("BajaSolicitada", ahora).Error
+		if err != nil {
+			tx.Rollback()
+			httpErr(w, errors.Wrap(err, "registrando baja"), http.StatusInternalServerError)
+			return
+		}
+		err = tx.Commit().Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "confirmando transaccion"), http.StatusInternalServerError)
+			return
+		}
+
+		// Le aviso hasta cuándo puede arrepentirse
+		if h.MailBajaCuenta == nil {
+			return
+		}
+		datos := datosAviso{Fecha: ahora, Vencimiento: ahora.Add(h.PlazoBorrado)}
+		body, err := h.MailBajaCuenta.bodyAviso(usuario.Nombre, "", datos)
+		if err != nil {
+			h.logf("generando mail de baja para %v: %v", usuario.ID, err)
+			return
+		}
+		err = h.MailSender.Send(usuario.Email, h.MailSender.SenderAlias(), "Tu cuenta fue dada de baja", body)
+		if err != nil {
+			h.logf("enviando mail de baja a %v: %v", usuario.ID, err)
+		}
+	}
+}
+
+// RestaurarCuenta vuelve a habilitar una cuenta dada de baja por el usuario,
+// si todavía no pasó PlazoBorrado. Se identifica con su login y contraseña.
+func (h *Handler) RestaurarCuenta() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			UserID string
+			Pass   string
+		}{}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		usuario, existe, err := h.buscarUsuario(request.UserID)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando usuario"), http.StatusInternalServerError)
+			return
+		}
+		if !existe || !h.coincideBaja(usuario, request.UserID, request.Pass) {
+			httpErr(w, ErrAutenticacion{"usuario o contraseña incorrectos"}, http.StatusUnauthorized)
+			return
+		}
+
+		if usuario.Estado != EstadoDeshabilitado || usuario.BajaSolicitada.IsZero() {
+			httpErr(w, errors.New("la cuenta no fue dada de baja por el usuario"), http.StatusBadRequest)
+			return
+		}
+		if h.PlazoBorrado > 0 && time.Since(usuario.BajaSolicitada) > h.PlazoBorrado {
+			httpErr(w, errors.New("venció el plazo para restaurar la cuenta"), http.StatusBadRequest)
+			return
+		}
+
+		err = h.CambiarEstado(usuario.ID, EstadoConfirmado, "", "Cuenta restaurada por el usuario")
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// coincideBaja corrobora la contraseña del usuario que restaura su cuenta.
+// Si no tiene contraseña propia la controlan los Autenticadores, que
+// reconocen la contraseña aunque la cuenta esté deshabilitada.
+func (h *Handler) coincideBaja(usuario Usuario, login, password string) bool {
+	if usuario.Hash != "" {
+		return compararPaswords(password, usuario.Hash) == nil
+	}
+	u, err := h.checkPass(login, password)
+	if _, ok := errors.Cause(err).(ErrCuentaDeshabilitada); ok || err == nil {
+		return u.ID == usuario.ID
+	}
+	return false
+}
+
+// BorrarCuentasVencidas anonimiza los usuarios que dieron de baja su cuenta
+// hace más de PlazoBorrado. Está pensada para llamarse periódicamente (ver
+// IniciarBorradoCuentas). Si PlazoBorrado es cero las cuentas se pueden
+// restaurar siempre y no se borra ninguna.
+func (h *Handler) BorrarCuentasVencidas() (err error) {
+	if h.PlazoBorrado <= 0 {
+		return nil
+	}
+
+	usuarios := []Usuario{}
+	err = h.db.
+		Where("estado = ? AND baja_solicitada > ? AND baja_solicitada <= ?", EstadoDeshabilitado, time.Time{}, time.Now().Add(-h.PlazoBorrado)).
+		Find(&usuarios).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "buscando cuentas dadas de baja")
+	}
+
+	for _, u := range usuarios {
+		err = h.AnonimizarUsuario(u.ID, "", MotivoBajaSolicitada)
+		if err != nil {
+			return errors.Wrapf(err, "anonimizando usuario %v", u.ID)
+		}
+	}
+	return nil
+}
+
+// IniciarBorradoCuentas llama a BorrarCuentasVencidas cada intervalo hasta que
+// se llame a la función devuelta.
+func (h *Handler) IniciarBorradoCuentas(intervalo time.Duration) (detener func()) {
+	fin := make(chan struct{})
+	ticker := time.NewTicker(intervalo)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				err := h.BorrarCuentasVencidas()
+				if err != nil {
+					h.logf("borrando cuentas vencidas: %v", err)
+				}
+			case <-fin:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(fin) }
+}
+
+// AnonimizarUsuario borra los datos personales del usuario y lo deja en
+// EstadoBorrado. El registro del usuario y su historial se conservan para no
+// romper las referencias de otras tablas. Antes de confirmar llama a
+// AlBorrarUsuario para que la aplicación borre sus propios datos.
+func (h *Handler) AnonimizarUsuario(userID, por, motivo string) (err error) {
+	usuario, existe, err := h.existeUsuario(userID)
+	if err != nil {
+		return errors.Wrap(err, "buscando usuario")
+	}
+	if !existe {
+		return errors.Errorf("no existe el usuario %v", userID)
+	}
+
+	e := nuevoEvento(EventoUsuarioBorrado, usuario, nil)
+	e.Datos = map[string]interface{}{"Motivo": motivo}
+	err = h.validarEvento(e)
+	if err != nil {
+		return err
+	}
+
+	tx := h.db.Begin()
+	err = h.anonimizar(tx, usuario, por, motivo)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return errors.Wrap(err, "confirmando transaccion")
+	}
+	h.emitir(e)
+	return nil
+}
+
+func (h *Handler) anonimizar(tx *gorm.DB, usuario Usuario, por, motivo string) (err error) {
+	err = h.cambiarEstado(tx, usuario, EstadoBorrado, por, motivo)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Model(&Usuario{}).Where("id = ?", usuario.ID).Update(map[string]interface{}{
+		"Email":       mailAnonimo(usuario.ID),
+		"Username":    "",
+		"Nombre":      "",
+		"Apellido":    "",
+		"Idioma":      "",
+		"ZonaHoraria": "",
+		"Telefono":    "",
+		"Hash":        "",
+		"Metadatos":   Metadatos{},
+	}).Error
+	if err != nil {
+		return errors.Wrap(err, "anonimizando usuario")
+	}
+
+	// Los dispositivos tienen IP y navegador, y los roles, las cuentas
+	// externas, las claves de API, las organizaciones y las autorizaciones a
+	// clientes OIDC ya no sirven
+	for _, v := range []interface{}{
+		&UsuarioDispositivo{},
+		&UsuarioRol{},
+		&IdentidadExterna{},
+		&ClaveAPI{},
+		&MiembroOrganizacion{},
+		&ConsentimientoOIDC{},
+		&CodigoOIDC{},
+		&AutorizacionDispositivo{},
+	} {
+		err = tx.Where("user_id = ?", usuario.ID).Delete(v).Error
+		if err != nil {
+			return errors.Wrap(err, "borrando registros del usuario")
+		}
+	}
+
+	// En el historial quedan las fechas pero no los datos
+	err = tx.Model(&UsuarioConfirmacion{}).Where("user_id = ?", usuario.ID).Update("mail_nuevo", "").Error
+	if err != nil {
+		return errors.Wrap(err, "anonimizando confirmaciones")
+	}
+	err = tx.Model(&UsuarioCambioPerfil{}).
+		Where("user_id = ?", usuario.ID).
+		Update(map[string]interface{}{"anterior": "", "nuevo": ""}).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "anonimizando cambios de perfil")
+	}
+	err = tx.Model(&Invitacion{}).Where("user_id = ?", usuario.ID).Update("email", mailAnonimo(usuario.ID)).Error
+	if err != nil {
+		return errors.Wrap(err, "anonimizando invitaciones")
+	}
+
+	// Los eventos ya mandados a los webhooks pueden tener la IP y lo que
+	// ingresó en el login
+	err = borrarEntregasUsuario(tx, usuario.ID)
+	if err != nil {
+		return err
+	}
+
+	if h.AlBorrarUsuario != nil {
+		err = h.AlBorrarUsuario(tx, usuario.ID)
+		if err != nil {
+			return errors.Wrap(err, "borrando datos de la aplicación")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package sesiones
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBorrarCuentasSinPlazo(t *testing.T) {
+	// Sin plazo las cuentas se pueden restaurar siempre, así que no se
+	// anonimiza nada (ni se consulta la base).
+	h := &Handler{}
+	assert.Nil(t, h.BorrarCuentasVencidas())
+}
@@ -0,0 +1,190 @@
+package sesiones
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// CambiarMail inicia el cambio de la dirección de mail del usuario de la
+// sesión. Pide nuevamente la contraseña o, si no tiene, un ingreso reciente.
+// Le manda a la dirección nueva un
+// link para confirmar el cambio y a la dirección anterior un aviso.
+//
+// El cambio no se hace efectivo hasta que se llame a ConfirmarCambioMail.
+func (h *Handler) CambiarMail() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			Pass      string
+			MailNuevo string
+		}{}
+
+		if h.MailCambioMail == nil {
+			httpErr(w, errors.New("no se ingresó template de cambio de mail"), http.StatusNotImplemented)
+			return
+		}
+
+		// Tiene que estar logueado
+		usuario, err := h.usuarioSesionPropia(r)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "obteniendo usuario de la sesión"), codigoSesion(err))
+			return
+		}
+
+		// Leo request
+		err = json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		request.MailNuevo = normalizarLogin(request.MailNuevo)
+		if request.MailNuevo == "" {
+			httpErr(w, errors.New("debe ingresar un mail"), http.StatusBadRequest)
+			return
+		}
+
+		// Vuelvo a pedir la contraseña
+		err = h.reautenticar(r, usuario, request.Pass)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		// Que el mail nuevo no esté usado
+		_, existe, err := h.buscarUsuario(request.MailNuevo)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "corroborando existencia del usuario"), http.StatusInternalServerError)
+			return
+		}
+		if existe {
+			httpErr(w, errors.Errorf("ya existe un usuario con mail %v", request.MailNuevo), http.StatusBadRequest)
+			return
+		}
+
+		// Creo el registro con el codigo de confirmación.
+		conf := UsuarioConfirmacion{}
+		conf.ID, _ = uuid.NewV4()
+		conf.UserID = usuario.ID
+		conf.Motivo = MotivoCambioMail
+		conf.MailNuevo = request.MailNuevo
+		err = h.db.Create(&conf).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "creando confirmación de cambio de mail"), http.StatusInternalServerError)
+			return
+		}
+
+		// Mando el link a la dirección nueva
+		body, err := h.MailCambioMail.body(usuario.Nombre, conf.ID.String())
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "generando el body del mail"), http.StatusInternalServerError)
+			return
+		}
+		err = h.MailSender.Send(request.MailNuevo, h.MailSender.SenderAlias(), "Confirmación de cambio de mail", body)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "enviando el mail de confirmación"), http.StatusInternalServerError)
+			return
+		}
+
+		// Aviso a la dirección anterior
+		h.avisarCambioMail(usuario, request.MailNuevo)
+	}
+}
+
+// ConfirmarCambioMail se llama desde el link que le llega a la dirección
+// nueva. Cambia la dirección de mail del usuario, el ID no cambia.
+func (h *Handler) ConfirmarCambioMail() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			ID uuid.UUID
+		}{}
+
+		// Leo el ID de la confirmación
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "no se pudo leer el ID"), http.StatusBadRequest)
+			return
+		}
+
+		// Busco que esté disponible esa confirmación
+		c := UsuarioConfirmacion{}
+		err = h.db.First(&c, "id = ? AND motivo = ?", request.ID, MotivoCambioMail).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "no se pudo obtener el registro de confirmación"), http.StatusInternalServerError)
+			return
+		}
+
+		if c.Confirmada {
+			httpErr(w, errors.New("el cambio de mail ya se había realizado"), http.StatusInternalServerError)
+			return
+		}
+		if c.vencida(h.DuracionCambioMail) {
+			httpErr(w, errors.New("el link está vencido"), http.StatusBadRequest)
+			return
+		}
+
+		// Una cuenta suspendida, deshabilitada o borrada no puede cambiar el
+		// mail
+		usuario, existe, err := h.existeUsuario(c.UserID)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando usuario"), http.StatusInternalServerError)
+			return
+		}
+		if !existe {
+			httpErr(w, ErrAutenticacion{"el usuario no existe"}, http.StatusUnauthorized)
+			return
+		}
+		err = controlarEstado(usuario)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		// Puede haberse registrado alguien con ese mail mientras tanto
+		_, existe, err = h.buscarUsuario(c.MailNuevo)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "corroborando existencia del usuario"), http.StatusInternalServerError)
+			return
+		}
+		if existe {
+			httpErr(w, errors.Errorf("ya existe un usuario con mail %v", c.MailNuevo), http.StatusBadRequest)
+			return
+		}
+
+		tx := h.db.Begin()
+
+		// Se usa una sola vez, aunque lleguen dos pedidos juntos
+		ok, err := usarConfirmacion(tx, c.ID)
+		if err != nil {
+			tx.Rollback()
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			tx.Rollback()
+			httpErr(w, errors.New("el cambio de mail ya se había realizado"), http.StatusInternalServerError)
+			return
+		}
+
+		// Cambio el mail del usuario, que queda en el historial del perfil
+		campos := []campoPerfil{{"Email", &usuario.Email, &c.MailNuevo}}
+		err = guardarCambiosPerfil(tx, usuario.ID, campos, usuario.ID)
+		if err != nil {
+			tx.Rollback()
+			httpErr(w, errors.Wrap(err, "persistiendo usuario"), http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit().Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "confirmando transaccion"), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package sesiones
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfirmacionVencida(t *testing.T) {
+	c := UsuarioConfirmacion{CreatedAt: time.Now().Add(-2 * time.Hour)}
+	assert.True(t, c.vencida(time.Hour))
+	assert.False(t, c.vencida(3*time.Hour))
+
+	// Sin duración no vence
+	assert.False(t, c.vencida(0))
+}
+
+func TestAvisoCambioMailPorDefecto(t *testing.T) {
+	blanqueo, err := NewMailTemplate(defaultBlanqueoTemplate, "www.sweet.com.ar/#/auth/blanquear")
+	assert.Nil(t, err)
+	confirmacion, err := NewMailTemplate(defaultConfirmacionUsuarioTemplate, "www.sweet.com.ar/#/auth/confirmar_usuario")
+	assert.Nil(t, err)
+
+	h, err := New([]byte("secreto"), nil, blanqueo, confirmacion, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, h.MailAvisoCambioMail)
+	assert.Equal(t, "www.sweet.com.ar/#/auth/no_fui_yo", h.MailAvisoCambioMail.frontEndPath)
+	assert.Equal(t, 24*time.Hour, h.DuracionCambioMail)
+}
+
+func TestCambiarMailSinSesion(t *testing.T) {
+	h := &Handler{}
+	h.secretKey = []byte("secreto")
+
+	// Deshabilitado sin template
+	w := httptest.NewRecorder()
+	h.CambiarMail()(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"MailNuevo": "nuevo@sweet.com.ar"}`)))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+
+	h.MailCambioMail = &MailTemplate{}
+	w = httptest.NewRecorder()
+	h.CambiarMail()(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"MailNuevo": "nuevo@sweet.com.ar"}`)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// El link tiene que ser un ID
+	w = httptest.NewRecorder()
+	h.ConfirmarCambioMail()(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"ID": "no es un id"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,334 @@
+package sesiones
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// prefijoClaveAPI identifica las claves de API, para que se reconozcan si se
+// filtran en un repositorio o un log.
+const prefijoClaveAPI = "pat_"
+
+// revocadaCambioContraseña es el RevocadaPor de las claves que se revocaron
+// porque se cambió la contraseña del usuario.
+const revocadaCambioContraseña = "cambio_contraseña"
+
+// ScopeSesion es el scope de las claves de API que aceptan ChequearSesion,
+// UsuarioID y MiddlewareSesion, que no indican un scope. Se puede dar
+// siempre, aunque no esté en ScopesAPI.
+const ScopeSesion = "sesion"
+
+// ClaveAPI es una clave de acceso personal, para integraciones y scripts.
+// Se manda en el header "Authorization: Bearer pat_...".
+type ClaveAPI struct {
+	// ID es la parte pública de la clave
+	ID     string `gorm:"primary_key"`
+	UserID string
+	Nombre string
+	// Scopes son los permisos de la clave, separados por espacio
+	Scopes string
+	// Hash es el hash de la clave completa. La clave no se guarda.
+	Hash        string `json:"-"`
+	Vencimiento time.Time
+	// CreadaPor es el administrador que la creó para una cuenta de servicio,
+	// o el mismo usuario.
+	CreadaPor       string
+	UltimoUso       time.Time
+	UltimaIP        string
+	FechaRevocacion time.Time
+	RevocadaPor     string
+	CreatedAt       time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (c ClaveAPI) TableName() string {
+	return "usuario_claves_api"
+}
+
+// extraerClaveAPI devuelve la clave de API del request, si la tiene.
+func extraerClaveAPI(r *http.Request) (clave string, ok bool) {
+	clave = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return clave, strings.HasPrefix(clave, prefijoClaveAPI)
+}
+
+// controlarClaveAPI devuelve la clave y su usuario si la clave es válida y el
+// usuario está activo. Registra el uso.
+func (h *Handler) controlarClaveAPI(clave string, r *http.Request) (c ClaveAPI, usuario Usuario, err error) {
+	partes := strings.Split(strings.TrimPrefix(clave, prefijoClaveAPI), "_")
+	if len(partes) != 2 {
+		return c, usuario, ErrAutenticacion{"clave de API inválida"}
+	}
+
+	err = h.db.First(&c, "id = ?", partes[0]).Error
+	if err == gorm.ErrRecordNotFound {
+		return c, usuario, ErrAutenticacion{"clave de API inválida"}
+	}
+	if err != nil {
+		return c, usuario, errors.Wrap(err, "buscando clave de API")
+	}
+	if subtle.ConstantTimeCompare([]byte(calcularHash(clave)), []byte(c.Hash)) != 1 {
+		return c, usuario, ErrAutenticacion{"clave de API inválida"}
+	}
+	if !c.FechaRevocacion.IsZero() {
+		return c, usuario, ErrAutenticacion{"la clave de API fue revocada"}
+	}
+	if time.Now().After(c.Vencimiento) {
+		return c, usuario, ErrAutenticacion{"la clave de API venció"}
+	}
+
+	usuario, existe, err := h.existeUsuario(c.UserID)
+	if err != nil {
+		return c, usuario, errors.Wrap(err, "buscando usuario")
+	}
+	if !existe {
+		return c, usuario, errors.New("el usuario de la clave de API no existe")
+	}
+	err = controlarEstado(usuario)
+	if err != nil {
+		return c, usuario, err
+	}
+
+	// Si se cerraron todas las sesiones del usuario (por ejemplo con "no fui
+	// yo") las claves creadas antes tampoco sirven
+	if !usuario.SesionesValidasDesde.IsZero() && !c.CreatedAt.After(usuario.SesionesValidasDesde) {
+		return c, usuario, ErrAutenticacion{"la clave de API fue revocada"}
+	}
+
+	// El uso se registra a lo sumo una vez por minuto
+	if time.Since(c.UltimoUso) > time.Minute {
+		c.UltimoUso = time.Now()
+		c.UltimaIP = ipRequest(r)
+		err = h.db.Model(&c).Updates(map[string]interface{}{"ultimo_uso": c.UltimoUso, "ultima_ip": c.UltimaIP}).Error
+		if err != nil {
+			h.logf("registrando uso de la clave %v: %v", c.ID, err)
+		}
+	}
+	return c, usuario, nil
+}
+
+// ExigirScope corrobora que el request pueda hacer la operación. Las
+// sesiones iniciadas con usuario y contraseña pueden todo; las claves de API
+// sólo lo que indican sus scopes. Es para que la aplicación controle sus
+// propios endpoints.
+func (h *Handler) ExigirScope(r *http.Request, scope string) error {
+	_, err := h.UsuarioIDScope(r, scope)
+	return err
+}
+
+// UsuarioIDScope es como UsuarioID pero acepta también claves de API que
+// tengan el scope.
+func (h *Handler) UsuarioIDScope(r *http.Request, scope string) (id string, err error) {
+	clave, ok := extraerClaveAPI(r)
+	if !ok {
+		usuario, err := h.usuarioSesion(r)
+		if err != nil {
+			return id, err
+		}
+		return usuario.ID, nil
+	}
+
+	c, usuario, err := h.controlarClaveAPI(clave, r)
+	if err != nil {
+		return id, errors.Wrap(err, "controlando clave de API")
+	}
+	if !contiene(strings.Fields(c.Scopes), scope) {
+		return id, ErrOperacionRechazada{"la clave de API no tiene el scope " + scope}
+	}
+	return usuario.ID, nil
+}
+
+// revocarClavesAPI revoca las claves vigentes del usuario.
+func revocarClavesAPI(tx *gorm.DB, userID, por string) (err error) {
+	err = tx.Model(&ClaveAPI{}).
+		Where("user_id = ? AND fecha_revocacion <= ?", userID, time.Time{}).
+		Updates(map[string]interface{}{"fecha_revocacion": time.Now(), "revocada_por": por}).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "revocando claves de API")
+	}
+	return nil
+}
+
+// ClavesAPI devuelve las claves del usuario de la sesión. Un administrador
+// puede ver las de otro usuario pasando su ID en el parámetro "id".
+func (h *Handler) ClavesAPI() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var usuario Usuario
+		var err error
+		if id := r.URL.Query().Get("id"); id != "" {
+			_, ok := h.exigirRol(w, r, RolAdmin)
+			if !ok {
+				return
+			}
+			usuario.ID = id
+		} else {
+			usuario, err = h.usuarioSesion(r)
+			if err != nil {
+				httpErr(w, err, http.StatusUnauthorized)
+				return
+			}
+		}
+
+		claves := []ClaveAPI{}
+		err = h.db.Where("user_id = ?", usuario.ID).Order("created_at").Find(&claves).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando claves de API"), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(claves)
+	}
+}
+
+// NuevaClaveAPI crea una clave para el usuario de la sesión. Un
+// administrador puede crearla para otro usuario, por ejemplo una cuenta de
+// servicio, indicando UserID. La respuesta incluye la clave, que no se
+// vuelve a mostrar.
+func (h *Handler) NuevaClaveAPI() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			UserID      string
+			Nombre      string
+			Scopes      []string
+			Vencimiento time.Time
+		}{}
+
+		usuario, err := h.usuarioSesionPropia(r)
+		if err != nil {
+			httpErr(w, err, codigoSesion(err))
+			return
+		}
+
+		err = json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		c := ClaveAPI{UserID: usuario.ID, CreadaPor: usuario.ID}
+		if request.UserID != "" && request.UserID != usuario.ID {
+			_, ok := h.exigirRol(w, r, RolAdmin)
+			if !ok {
+				return
+			}
+			_, existe, err := h.existeUsuario(request.UserID)
+			if err != nil {
+				httpErr(w, errors.Wrap(err, "buscando usuario"), http.StatusInternalServerError)
+				return
+			}
+			if !existe {
+				httpErr(w, errors.Errorf("no existe el usuario %v", request.UserID), http.StatusBadRequest)
+				return
+			}
+			c.UserID = request.UserID
+		}
+
+		if request.Nombre == "" {
+			httpErr(w, errors.New("debe ingresar un nombre"), http.StatusBadRequest)
+			return
+		}
+		for _, v := range request.Scopes {
+			if v != ScopeSesion && !contiene(h.ScopesAPI, v) {
+				httpErr(w, errors.Errorf("scope inválido: %v", v), http.StatusBadRequest)
+				return
+			}
+		}
+		c.Vencimiento = request.Vencimiento
+		if c.Vencimiento.IsZero() {
+			c.Vencimiento = time.Now().Add(h.DuracionClavesAPI)
+		}
+		if c.Vencimiento.Before(time.Now()) || c.Vencimiento.After(time.Now().Add(h.DuracionClavesAPI)) {
+			httpErr(w, errors.Errorf("el vencimiento tiene que ser dentro de los próximos %v días", int(h.DuracionClavesAPI.Hours()/24)), http.StatusBadRequest)
+			return
+		}
+		c.Nombre = request.Nombre
+		c.Scopes = strings.Join(request.Scopes, " ")
+
+		c.ID, err = textoAleatorio(8)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		secreto, err := textoAleatorio(32)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		clave := prefijoClaveAPI + c.ID + "_" + secreto
+		c.Hash = calcularHash(clave)
+
+		err = h.db.Create(&c).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "creando clave de API"), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			ClaveAPI
+			Clave string
+		}{c, clave})
+	}
+}
+
+// RevocarClaveAPI revoca una clave. Puede hacerlo su dueño o un
+// administrador.
+func (h *Handler) RevocarClaveAPI() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			ID string
+		}{}
+
+		usuario, err := h.usuarioSesion(r)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		err = json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		c := ClaveAPI{}
+		err = h.db.First(&c, "id = ?", request.ID).Error
+		if err == gorm.ErrRecordNotFound {
+			httpErr(w, errors.Errorf("no existe la clave %v", request.ID), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando clave de API"), http.StatusInternalServerError)
+			return
+		}
+		if c.UserID != usuario.ID {
+			_, ok := h.exigirRol(w, r, RolAdmin)
+			if !ok {
+				return
+			}
+		}
+		if !c.FechaRevocacion.IsZero() {
+			return
+		}
+
+		err = h.db.Model(&c).Updates(map[string]interface{}{"fecha_revocacion": time.Now(), "revocada_por": usuario.ID}).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "revocando clave de API"), http.StatusInternalServerError)
+			return
+		}
+	}
+}
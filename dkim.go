@@ -0,0 +1,185 @@
+package sesiones
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// headersFirmadosDKIM son los encabezados que se incluyen en la firma, en
+// este orden. Los que no estén presentes en el mensaje se omiten.
+var headersFirmadosDKIM = []string{"From", "To", "Subject", "Date", "MIME-Version", "Content-Type"}
+
+// DKIMSigner firma los mails salientes con DKIM (RFC 6376) usando
+// rsa-sha256 y canonicalización relaxed/relaxed.
+type DKIMSigner struct {
+	// Dominio es el valor del tag d=, por ejemplo "sweet.com.ar"
+	Dominio string
+	// Selector es el valor del tag s=. La clave pública tiene que estar
+	// publicada en <Selector>._domainkey.<Dominio>
+	Selector string
+
+	clave *rsa.PrivateKey
+}
+
+// NewDKIMSigner crea un firmador DKIM a partir de una clave privada RSA en
+// formato PEM (PKCS#1 o PKCS#8).
+func NewDKIMSigner(dominio, selector string, clavePEM []byte) (s *DKIMSigner, err error) {
+	if dominio == "" {
+		return nil, errors.New("no se ingresó dominio DKIM")
+	}
+	if selector == "" {
+		return nil, errors.New("no se ingresó selector DKIM")
+	}
+
+	bloque, _ := pem.Decode(clavePEM)
+	if bloque == nil {
+		return nil, errors.New("no se pudo decodificar la clave PEM")
+	}
+
+	clave, err := x509.ParsePKCS1PrivateKey(bloque.Bytes)
+	if err != nil {
+		k, err8 := x509.ParsePKCS8PrivateKey(bloque.Bytes)
+		if err8 != nil {
+			return nil, errors.Wrap(err, "parseando clave privada")
+		}
+		var ok bool
+		clave, ok = k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("la clave privada no es RSA")
+		}
+	}
+
+	s = &DKIMSigner{}
+	s.Dominio = dominio
+	s.Selector = selector
+	s.clave = clave
+	return
+}
+
+// firmar devuelve el mensaje con el encabezado DKIM-Signature agregado al
+// principio. El mensaje tiene que tener los finales de línea en CRLF.
+func (s *DKIMSigner) firmar(mensaje []byte) (firmado []byte, err error) {
+
+	// Separo encabezados y cuerpo
+	headers, body := separarMensaje(mensaje)
+
+	// Hash del cuerpo
+	bh := sha256.Sum256(canonicalizarBodyRelaxed(body))
+
+	// Me quedo con los encabezados que voy a firmar
+	presentes := map[string]string{}
+	for _, v := range headers {
+		i := strings.Index(v, ":")
+		if i == -1 {
+			continue
+		}
+		presentes[strings.ToLower(strings.TrimSpace(v[:i]))] = v
+	}
+	firmados := []string{}
+	for _, v := range headersFirmadosDKIM {
+		if _, ok := presentes[strings.ToLower(v)]; ok {
+			firmados = append(firmados, strings.ToLower(v))
+		}
+	}
+
+	dkim := fmt.Sprintf(
+		"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=%v; s=%v; t=%v; h=%v; bh=%v; b=",
+		s.Dominio, s.Selector, time.Now().Unix(), strings.Join(firmados, ":"),
+		base64.StdEncoding.EncodeToString(bh[:]),
+	)
+
+	// Hash de los encabezados
+	hasher := sha256.New()
+	for _, v := range firmados {
+		hasher.Write([]byte(canonicalizarHeaderRelaxed(presentes[v]) + "\r\n"))
+	}
+	hasher.Write([]byte(canonicalizarHeaderRelaxed(dkim)))
+
+	firma, err := rsa.SignPKCS1v15(rand.Reader, s.clave, crypto.SHA256, hasher.Sum(nil))
+	if err != nil {
+		return nil, errors.Wrap(err, "firmando encabezados")
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteString(dkim)
+	out.WriteString(base64.StdEncoding.EncodeToString(firma))
+	out.WriteString("\r\n")
+	out.Write(mensaje)
+	return out.Bytes(), nil
+}
+
+// separarMensaje devuelve los encabezados (ya desplegados en una línea cada
+// uno) y el cuerpo del mensaje.
+func separarMensaje(mensaje []byte) (headers []string, body []byte) {
+	texto := string(mensaje)
+	fin := strings.Index(texto, "\r\n\r\n")
+	if fin == -1 {
+		fin = len(texto)
+		body = nil
+	} else {
+		body = mensaje[fin+4:]
+	}
+
+	for _, linea := range strings.Split(texto[:fin], "\r\n") {
+		if linea == "" {
+			continue
+		}
+		// Las líneas que empiezan con espacio son continuación de la anterior
+		if (linea[0] == ' ' || linea[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += "\r\n" + linea
+			continue
+		}
+		headers = append(headers, linea)
+	}
+	return
+}
+
+// canonicalizarHeaderRelaxed aplica la canonicalización relaxed de la
+// sección 3.4.2 de RFC 6376.
+func canonicalizarHeaderRelaxed(h string) string {
+	i := strings.Index(h, ":")
+	nombre := strings.ToLower(strings.TrimSpace(h[:i]))
+	valor := strings.Replace(h[i+1:], "\r\n", "", -1)
+	valor = strings.Join(strings.FieldsFunc(valor, esWSP), " ")
+	return nombre + ":" + valor
+}
+
+// canonicalizarBodyRelaxed aplica la canonicalización relaxed de la
+// sección 3.4.4 de RFC 6376.
+func canonicalizarBodyRelaxed(body []byte) []byte {
+	lineas := strings.Split(string(body), "\r\n")
+	for i, l := range lineas {
+		l = strings.TrimRightFunc(l, esWSP)
+		campos := strings.FieldsFunc(l, esWSP)
+		if len(l) > 0 && esWSP(rune(l[0])) {
+			l = " " + strings.Join(campos, " ")
+		} else {
+			l = strings.Join(campos, " ")
+		}
+		lineas[i] = l
+	}
+
+	// Saco las líneas vacías del final
+	for len(lineas) > 0 && lineas[len(lineas)-1] == "" {
+		lineas = lineas[:len(lineas)-1]
+	}
+	if len(lineas) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lineas, "\r\n") + "\r\n")
+}
+
+func esWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
@@ -14,4 +14,73 @@
 // ConfirmarBlanqueo()
 // BorrarUsuario()
 //
+// NoFuiYo()
+//
+// CambiarMail()
+// ConfirmarCambioMail()
+//
+// SolicitarEnlaceIngreso()
+// IngresarConEnlace()
+//
+// InvitarUsuario()
+// AceptarInvitacion()
+//
+// UsuariosPendientes()
+// AprobarUsuario()
+// RechazarUsuario()
+//
+// SuspenderUsuario()
+// ReactivarUsuario()
+//
+// ListadoUsuarios()
+// VerUsuario()
+//
+// PasswordTemporal()
+// ForzarBlanqueo()
+// BlanqueoObligatorio()
+//
+// MiUsuario()
+// EditarPerfil()
+// EditarMetadatos()
+//
+// BorrarCuenta()
+// RestaurarCuenta()
+// ExportarDatos()
+//
+// Webhooks()
+// NuevoWebhook()
+// BorrarWebhook()
+// EntregasWebhook()
+// ReenviarWebhook()
+//
+// Autorizar()
+// TokenOIDC()
+// UserInfoOIDC()
+// JWKS()
+// DescubrimientoOIDC()
+// ConsentirOIDC()
+// NuevoClienteOIDC()
+// AutorizarDispositivo()
+// VerificarDispositivo()
+//
+// IngresoExterno()
+// CallbackExterno()
+// DesvincularExterno()
+//
+// ClavesAPI()
+// NuevaClaveAPI()
+// RevocarClaveAPI()
+//
+// EndpointsSCIM()
+//
+// Organizaciones()
+// NuevaOrganizacion()
+// MiembrosOrganizacion()
+// EditarMiembroOrganizacion()
+// QuitarMiembroOrganizacion()
+// CambiarOrganizacion()
+//
+// Suplantar()
+// FinalizarSuplantacion()
+// Suplantaciones()
 package sesiones
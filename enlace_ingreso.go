@@ -0,0 +1,191 @@
+package sesiones
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// MotivoEnlaceIngreso es el motivo de las confirmaciones que se usan para
+// ingresar sin contraseña.
+const MotivoEnlaceIngreso = "Enlace de ingreso"
+
+// SolicitarEnlaceIngreso le manda al usuario un mail con un link para
+// ingresar sin contraseña. El link sirve una sola vez y vence luego de
+// DuracionEnlaceIngreso.
+//
+// Sólo está habilitado si se configuró MailEnlaceIngreso.
+func (h *Handler) SolicitarEnlaceIngreso() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			UserID string
+		}{}
+
+		if h.MailEnlaceIngreso == nil {
+			httpErr(w, errors.New("el ingreso con enlace no está habilitado"), http.StatusNotImplemented)
+			return
+		}
+
+		// Leo el usuario
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		usuario, existe, err := h.buscarUsuario(request.UserID)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "corroborando existencia del usuario"), http.StatusInternalServerError)
+			return
+		}
+		if !existe {
+			httpErr(w, errors.Errorf("no existe ningún usuario con el mail %v", request.UserID), http.StatusInternalServerError)
+			return
+		}
+
+		// Creo el registro con el código de ingreso
+		conf := UsuarioConfirmacion{}
+		conf.ID, _ = uuid.NewV4()
+		conf.UserID = usuario.ID
+		conf.Motivo = MotivoEnlaceIngreso
+		err = h.db.Create(&conf).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "creando enlace de ingreso"), http.StatusInternalServerError)
+			return
+		}
+
+		body, err := h.MailEnlaceIngreso.body(usuario.Nombre, conf.ID.String())
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "generando el body del mail"), http.StatusInternalServerError)
+			return
+		}
+		err = h.MailSender.Send(usuario.Email, h.MailSender.SenderAlias(), "Ingreso", body)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "enviando el mail de ingreso"), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// IngresarConEnlace se llama desde el link que le llegó al usuario por mail.
+// Si el enlace es válido le pega la cookie de sesión igual que Login.
+//
+// Como el enlace demuestra que el usuario tiene acceso a su mail, si estaba
+// pendiente de confirmación queda confirmado.
+func (h *Handler) IngresarConEnlace() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			ID uuid.UUID
+		}{}
+
+		if h.MailEnlaceIngreso == nil {
+			httpErr(w, errors.New("el ingreso con enlace no está habilitado"), http.StatusNotImplemented)
+			return
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "no se pudo leer el ID"), http.StatusBadRequest)
+			return
+		}
+
+		// Busco el enlace
+		c := UsuarioConfirmacion{}
+		err = h.db.First(&c, "id = ? AND motivo = ?", request.ID, MotivoEnlaceIngreso).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "no se pudo obtener el enlace de ingreso"), http.StatusUnauthorized)
+			return
+		}
+		if c.Confirmada {
+			httpErr(w, errors.New("el enlace ya fue utilizado"), http.StatusUnauthorized)
+			return
+		}
+		if time.Since(c.CreatedAt) > h.DuracionEnlaceIngreso {
+			httpErr(w, errors.New("el enlace está vencido"), http.StatusUnauthorized)
+			return
+		}
+
+		usuario, existe, err := h.existeUsuario(c.UserID)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando usuario"), http.StatusInternalServerError)
+			return
+		}
+		if !existe {
+			httpErr(w, ErrAutenticacion{"el usuario no existe"}, http.StatusUnauthorized)
+			return
+		}
+
+		tx := h.db.Begin()
+
+		// Se usa una sola vez, aunque lleguen dos pedidos juntos
+		ok, err := usarConfirmacion(tx, c.ID)
+		if err != nil {
+			tx.Rollback()
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			tx.Rollback()
+			httpErr(w, errors.New("el enlace ya fue utilizado"), http.StatusUnauthorized)
+			return
+		}
+
+		confirmado := false
+		if usuario.Estado == EstadoPendienteConfirmación {
+			err = h.validarEvento(nuevoEvento(EventoUsuarioConfirmado, usuario, r))
+			if err != nil {
+				tx.Rollback()
+				httpErr(w, err, http.StatusForbidden)
+				return
+			}
+			err = h.cambiarEstado(tx, usuario, h.estadoAlConfirmarMail(), "", MotivoEnlaceIngreso)
+			if err != nil {
+				tx.Rollback()
+				httpErr(w, errors.Wrap(err, "confirmando usuario"), http.StatusInternalServerError)
+				return
+			}
+			confirmado = true
+		}
+
+		err = tx.Commit().Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "confirmando transaccion"), http.StatusInternalServerError)
+			return
+		}
+		if confirmado {
+			usuario.Estado = h.estadoAlConfirmarMail()
+			h.emitir(nuevoEvento(EventoUsuarioConfirmado, usuario, r))
+		}
+
+		// Por ejemplo, si todavía tiene que aprobarlo un administrador
+		err = controlarEstado(usuario)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		// El enlace no saltea el blanqueo obligatorio
+		err = h.controlarBlanqueo(usuario)
+		if err != nil {
+			codigo := http.StatusInternalServerError
+			if _, ok := errors.Cause(err).(ErrCorrespondeBlanquear); ok {
+				codigo = http.StatusUnauthorized
+			}
+			httpErr(w, err, codigo)
+			return
+		}
+
+		err = h.iniciarSesion(w, r, usuario)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "iniciando sesión"), codigoHTTP(err, http.StatusInternalServerError))
+			return
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package sesiones
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnlaceIngreso(t *testing.T) {
+	h := &Handler{}
+
+	// Deshabilitado sin template
+	w := httptest.NewRecorder()
+	h.SolicitarEnlaceIngreso()(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"UserID": "marcos@sweet.com.ar"}`)))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+
+	w = httptest.NewRecorder()
+	h.IngresarConEnlace()(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"ID": "no es un id"}`)))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+
+	// El enlace tiene que ser un ID
+	h.MailEnlaceIngreso = &MailTemplate{}
+	w = httptest.NewRecorder()
+	h.IngresarConEnlace()(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"ID": "no es un id"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	h.SolicitarEnlaceIngreso()(w, httptest.NewRequest("POST", "/", strings.NewReader(`no es JSON`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
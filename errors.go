@@ -29,3 +29,67 @@ type ErrCorrespondeConfirmarMail struct {}
 func (e ErrCorrespondeConfirmarMail) Error() string {
 	return "Debe confirmar su dirección de correo electrónico"
 } 	
+
+// ErrPendienteAprobacion se da cuando un usuario se loggea, pero todavía no
+// fue aprobado por un administrador.
+type ErrPendienteAprobacion struct{}
+
+func (e ErrPendienteAprobacion) Error() string {
+	return "Su cuenta está pendiente de aprobación"
+}
+
+// ErrCuentaSuspendida se da cuando un usuario suspendido por un administrador
+// intenta ingresar.
+type ErrCuentaSuspendida struct{}
+
+func (e ErrCuentaSuspendida) Error() string {
+	return "Su cuenta está suspendida"
+}
+
+// ErrCuentaDeshabilitada se da cuando un usuario dado de baja intenta
+// ingresar.
+type ErrCuentaDeshabilitada struct{}
+
+func (e ErrCuentaDeshabilitada) Error() string {
+	return "Su cuenta está deshabilitada"
+}
+
+// ErrCuentaBloqueada se da cuando un usuario bloqueado por motivos de
+// seguridad intenta ingresar.
+type ErrCuentaBloqueada struct{}
+
+func (e ErrCuentaBloqueada) Error() string {
+	return "Su cuenta está bloqueada"
+}
+
+// ErrTransicionEstado se da cuando se intenta pasar un usuario a un estado al
+// que no puede pasar desde el actual.
+type ErrTransicionEstado struct {
+	Desde string
+	Hasta string
+}
+
+func (e ErrTransicionEstado) Error() string {
+	return fmt.Sprintf("no se puede pasar un usuario de %v a %v", e.Desde, e.Hasta)
+}
+
+// ErrOperacionRechazada se da cuando un hook registrado con Handler.Antes
+// rechaza la operación.
+type ErrOperacionRechazada struct {
+	Msg string
+}
+
+func (e ErrOperacionRechazada) Error() string {
+	return fmt.Sprintf("operación rechazada: %v", e.Msg)
+}
+
+// ErrAutenticadorNoDisponible se da cuando no se puede consultar un
+// Autenticador, por ejemplo porque no responde el servidor LDAP. Se prueba
+// con el siguiente.
+type ErrAutenticadorNoDisponible struct {
+	Msg string
+}
+
+func (e ErrAutenticadorNoDisponible) Error() string {
+	return fmt.Sprintf("autenticador no disponible: %v", e.Msg)
+}
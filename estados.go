@@ -0,0 +1,187 @@
+package sesiones
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// transiciones son los cambios de estado permitidos. La clave es el estado
+// actual y el valor los estados a los que puede pasar.
+var transiciones = map[string][]string{
+	EstadoPendienteConfirmación: {EstadoPendienteAprobacion, EstadoConfirmado, EstadoBorrado},
+	EstadoPendienteAprobacion:   {EstadoConfirmado, EstadoRechazado, EstadoBorrado},
+	EstadoConfirmado:            {EstadoSuspendido, EstadoDeshabilitado, EstadoBloqueado, EstadoBorrado},
+	EstadoSuspendido:            {EstadoConfirmado, EstadoDeshabilitado, EstadoBorrado},
+	EstadoDeshabilitado:         {EstadoConfirmado, EstadoBorrado},
+	EstadoBloqueado:             {EstadoConfirmado, EstadoSuspendido, EstadoDeshabilitado, EstadoBorrado},
+	EstadoRechazado:             {EstadoBorrado},
+	EstadoBorrado:               {},
+}
+
+// transicionPermitida devuelve true si un usuario puede pasar de un estado a
+// otro.
+func transicionPermitida(desde, hasta string) bool {
+	for _, v := range transiciones[desde] {
+		if v == hasta {
+			return true
+		}
+	}
+	return false
+}
+
+// estadoActivo devuelve true si el usuario puede usar el sistema.
+func estadoActivo(estado string) bool {
+	return estado == EstadoConfirmado
+}
+
+// UsuarioCambioEstado es el historial de cambios de estado de los usuarios.
+type UsuarioCambioEstado struct {
+	ID             uuid.UUID
+	UserID         string
+	EstadoAnterior string
+	EstadoNuevo    string
+	// Por es el ID del usuario que hizo el cambio. Vacío si lo hizo el propio
+	// usuario o el sistema.
+	Por       string
+	Motivo    string
+	CreatedAt time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (u UsuarioCambioEstado) TableName() string {
+	return "usuario_cambios_estado"
+}
+
+// cambiarEstado es el único lugar donde se cambia el estado de un usuario.
+// Corrobora que la transición esté permitida y la registra en el historial.
+// Si el usuario deja de estar activo se cierran sus sesiones.
+func (h *Handler) cambiarEstado(tx *gorm.DB, usuario Usuario, nuevo, por, motivo string) (err error) {
+	if !transicionPermitida(usuario.Estado, nuevo) {
+		return ErrTransicionEstado{usuario.Estado, nuevo}
+	}
+
+	campos := map[string]interface{}{"Estado": nuevo}
+	if !estadoActivo(nuevo) {
+		campos["SesionesValidasDesde"] = time.Now()
+	} else {
+		// Si había pedido la baja, queda sin efecto
+		campos["BajaSolicitada"] = time.Time{}
+	}
+	err = tx.
+		Model(&Usuario{}).
+		Where("id = ?", usuario.ID).
+		Update(campos).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "actualizando estado del usuario")
+	}
+
+	c := UsuarioCambioEstado{}
+	c.ID, _ = uuid.NewV4()
+	c.UserID = usuario.ID
+	c.EstadoAnterior = usuario.Estado
+	c.EstadoNuevo = nuevo
+	c.Por = por
+	c.Motivo = motivo
+	err = tx.Create(&c).Error
+	if err != nil {
+		return errors.Wrap(err, "registrando cambio de estado")
+	}
+	return nil
+}
+
+// CambiarEstado cambia el estado del usuario. por es el ID del usuario que
+// hace el cambio y motivo queda registrado en el historial.
+func (h *Handler) CambiarEstado(userID, nuevo, por, motivo string) (err error) {
+	usuario, existe, err := h.existeUsuario(userID)
+	if err != nil {
+		return errors.Wrap(err, "buscando usuario")
+	}
+	if !existe {
+		return errors.Errorf("no existe el usuario %v", userID)
+	}
+
+	tx := h.db.Begin()
+	err = h.cambiarEstado(tx, usuario, nuevo, por, motivo)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// controlarEstado devuelve error si el usuario no está en condiciones de
+// ingresar por su estado.
+func controlarEstado(usuario Usuario) error {
+	switch usuario.Estado {
+	case EstadoPendienteConfirmación:
+		return ErrCorrespondeConfirmarMail{}
+	case EstadoPendienteAprobacion:
+		return ErrPendienteAprobacion{}
+	case EstadoSuspendido:
+		return ErrCuentaSuspendida{}
+	case EstadoDeshabilitado:
+		return ErrCuentaDeshabilitada{}
+	case EstadoBloqueado:
+		return ErrCuentaBloqueada{}
+	case EstadoRechazado:
+		return ErrAutenticacion{"la cuenta fue rechazada"}
+	case EstadoBorrado:
+		return ErrAutenticacion{"el usuario no existe"}
+	}
+	return nil
+}
+
+// SuspenderUsuario suspende al usuario indicado. Sólo lo puede hacer un
+// administrador.
+func (h *Handler) SuspenderUsuario() http.HandlerFunc {
+	return h.cambiarEstadoAdmin(EstadoSuspendido)
+}
+
+// ReactivarUsuario vuelve a dejar activo a un usuario suspendido,
+// deshabilitado o bloqueado. Sólo lo puede hacer un administrador.
+func (h *Handler) ReactivarUsuario() http.HandlerFunc {
+	return h.cambiarEstadoAdmin(EstadoConfirmado)
+}
+
+func (h *Handler) cambiarEstadoAdmin(nuevo string) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			UserID string
+			Motivo string
+		}{}
+
+		admin, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		if request.UserID == admin.ID {
+			httpErr(w, errors.New("no puede cambiar el estado de su propio usuario"), http.StatusBadRequest)
+			return
+		}
+
+		err = h.CambiarEstado(request.UserID, nuevo, admin.ID, request.Motivo)
+		if _, ok := errors.Cause(err).(ErrTransicionEstado); ok {
+			httpErr(w, err, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+}
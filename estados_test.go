@@ -0,0 +1,17 @@
+package sesiones
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransicionesEstado(t *testing.T) {
+	assert.True(t, transicionPermitida(EstadoConfirmado, EstadoSuspendido))
+	assert.True(t, transicionPermitida(EstadoSuspendido, EstadoConfirmado))
+	assert.False(t, transicionPermitida(EstadoPendienteConfirmación, EstadoSuspendido))
+	assert.False(t, transicionPermitida(EstadoBorrado, EstadoConfirmado))
+
+	assert.Nil(t, controlarEstado(Usuario{Estado: EstadoConfirmado}))
+	assert.IsType(t, ErrCuentaSuspendida{}, controlarEstado(Usuario{Estado: EstadoSuspendido}))
+}
@@ -0,0 +1,165 @@
+package sesiones
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TipoEvento identifica cada cosa que le puede pasar a una cuenta.
+type TipoEvento string
+
+// Eventos que emite el Handler.
+const (
+	EventoUsuarioCreado     TipoEvento = "UsuarioCreado"
+	EventoUsuarioConfirmado TipoEvento = "UsuarioConfirmado"
+	EventoSesionIniciada    TipoEvento = "SesionIniciada"
+	// EventoLoginFallido no se puede vetar, sólo tiene hooks posteriores.
+	EventoLoginFallido     TipoEvento = "LoginFallido"
+	EventoPasswordCambiada TipoEvento = "PasswordCambiada"
+	// EventoUsuarioBorrado se emite al anonimizar o borrar definitivamente
+	// un usuario, no cuando pide la baja.
+	EventoUsuarioBorrado TipoEvento = "UsuarioBorrado"
+	// EventoSuplantacionIniciada y EventoSuplantacionFinalizada tienen el
+	// usuario suplantado y en Datos "Admin" y "Motivo".
+	EventoSuplantacionIniciada   TipoEvento = "SuplantacionIniciada"
+	EventoSuplantacionFinalizada TipoEvento = "SuplantacionFinalizada"
+)
+
+// Evento es lo que reciben los hooks.
+type Evento struct {
+	Tipo  TipoEvento
+	Fecha time.Time
+	// Usuario es el usuario tal como está en el momento del evento. En
+	// EventoLoginFallido puede estar vacío si el login no existe.
+	Usuario Usuario
+	// IP es la del request que originó el evento, si lo hubo
+	IP string
+	// Datos son los datos propios de cada evento, por ejemplo "Motivo" en
+	// EventoLoginFallido: "credenciales", "blanqueo", "mail_sin_confirmar",
+	// "pendiente_aprobacion", "suspendida", "deshabilitada", "bloqueada",
+	// "autenticador_no_disponible" o "error_interno".
+	Datos map[string]interface{} `json:",omitempty"`
+}
+
+// HookAntes se llama antes de que ocurra el evento. Si devuelve error la
+// operación se cancela y el usuario recibe ErrOperacionRechazada.
+type HookAntes func(e Evento) error
+
+// HookDespues se llama en otra goroutine después de que ocurrió el evento.
+type HookDespues func(e Evento)
+
+// eventos son los hooks registrados en el Handler.
+type eventos struct {
+	mu      sync.RWMutex
+	antes   map[TipoEvento][]HookAntes
+	despues map[TipoEvento][]HookDespues
+	// pendientes son los hooks posteriores que se están ejecutando
+	pendientes sync.WaitGroup
+	// webhooks es true desde que se llamó a IniciarWebhooks
+	webhooks bool
+}
+
+// Antes registra un hook que se llama antes del evento y lo puede vetar. Los
+// hooks se llaman en el orden en que se registraron; el primero que devuelve
+// error corta la operación.
+func (h *Handler) Antes(tipo TipoEvento, f HookAntes) {
+	h.eventos.mu.Lock()
+	defer h.eventos.mu.Unlock()
+	if h.eventos.antes == nil {
+		h.eventos.antes = map[TipoEvento][]HookAntes{}
+	}
+	h.eventos.antes[tipo] = append(h.eventos.antes[tipo], f)
+}
+
+// Despues registra un hook que se llama, sin bloquear el request, después
+// del evento.
+func (h *Handler) Despues(tipo TipoEvento, f HookDespues) {
+	h.eventos.mu.Lock()
+	defer h.eventos.mu.Unlock()
+	if h.eventos.despues == nil {
+		h.eventos.despues = map[TipoEvento][]HookDespues{}
+	}
+	h.eventos.despues[tipo] = append(h.eventos.despues[tipo], f)
+}
+
+// EsperarEventos bloquea hasta que terminen los hooks posteriores en curso.
+// Sirve para apagar la aplicación ordenadamente y en los tests.
+func (h *Handler) EsperarEventos() {
+	h.eventos.pendientes.Wait()
+}
+
+// nuevoEvento arma el evento con los datos del request.
+func nuevoEvento(tipo TipoEvento, usuario Usuario, r *http.Request) Evento {
+	e := Evento{Tipo: tipo, Fecha: time.Now(), Usuario: usuario}
+	if r != nil {
+		e.IP = ipRequest(r)
+	}
+	return e
+}
+
+// validarEvento llama a los hooks previos. Si alguno devuelve error
+// devuelve ErrOperacionRechazada.
+func (h *Handler) validarEvento(e Evento) error {
+	h.eventos.mu.RLock()
+	hooks := h.eventos.antes[e.Tipo]
+	h.eventos.mu.RUnlock()
+
+	for _, f := range hooks {
+		err := f(e)
+		if err != nil {
+			return ErrOperacionRechazada{err.Error()}
+		}
+	}
+	return nil
+}
+
+// emitir guarda las entregas a los webhooks y llama a los hooks posteriores
+// en otra goroutine. Si alguno entra en pánico se registra en ErrorLog y se
+// siguen llamando los demás.
+func (h *Handler) emitir(e Evento) {
+	h.eventos.mu.RLock()
+	hooks := h.eventos.despues[e.Tipo]
+	webhooks := h.eventos.webhooks
+	h.eventos.mu.RUnlock()
+
+	// Las entregas a los webhooks se guardan antes de seguir
+	if webhooks {
+		err := h.encolarWebhooks(e)
+		if err != nil {
+			h.logf("encolando webhooks de %v: %v", e.Tipo, err)
+		}
+	}
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	h.eventos.pendientes.Add(1)
+	go func() {
+		defer h.eventos.pendientes.Done()
+		for _, f := range hooks {
+			h.llamarHook(f, e)
+		}
+	}()
+}
+
+func (h *Handler) llamarHook(f HookDespues, e Evento) {
+	defer func() {
+		if p := recover(); p != nil {
+			h.logf("hook de %v: %v", e.Tipo, p)
+		}
+	}()
+	f(e)
+}
+
+// codigoHTTP devuelve el código de respuesta para el error: 403 si lo vetó un
+// hook y si no el indicado.
+func codigoHTTP(err error, codigo int) int {
+	if _, ok := errors.Cause(err).(ErrOperacionRechazada); ok {
+		return http.StatusForbidden
+	}
+	return codigo
+}
@@ -0,0 +1,48 @@
+package sesiones
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventos(t *testing.T) {
+	h := Handler{}
+
+	// Los hooks previos pueden vetar
+	h.Antes(EventoUsuarioCreado, func(e Evento) error {
+		if e.Usuario.Email == "spam@spam.com" {
+			return errors.New("dominio no permitido")
+		}
+		return nil
+	})
+	err := h.validarEvento(Evento{Tipo: EventoUsuarioCreado, Usuario: Usuario{Email: "spam@spam.com"}})
+	assert.IsType(t, ErrOperacionRechazada{}, err)
+	assert.Equal(t, 403, codigoHTTP(err, 500))
+	assert.Nil(t, h.validarEvento(Evento{Tipo: EventoUsuarioCreado, Usuario: Usuario{Email: "ok@ok.com"}}))
+	assert.Nil(t, h.validarEvento(Evento{Tipo: EventoSesionIniciada}))
+
+	// Los posteriores se llaman aunque otro entre en pánico
+	mu := sync.Mutex{}
+	recibidos := []TipoEvento{}
+	h.Despues(EventoLoginFallido, func(e Evento) { panic("hook roto") })
+	h.Despues(EventoLoginFallido, func(e Evento) {
+		mu.Lock()
+		defer mu.Unlock()
+		recibidos = append(recibidos, e.Tipo)
+	})
+	h.emitir(Evento{Tipo: EventoLoginFallido})
+	h.emitir(Evento{Tipo: EventoUsuarioBorrado})
+	h.EsperarEventos()
+	assert.Equal(t, []TipoEvento{EventoLoginFallido}, recibidos)
+}
+
+func TestMotivoLoginFallido(t *testing.T) {
+	assert.Equal(t, "credenciales", motivoLoginFallido(ErrAutenticacion{"usuario o contraseña incorrectos"}))
+	assert.Equal(t, "bloqueada", motivoLoginFallido(ErrCuentaBloqueada{}))
+
+	// El texto de los errores internos no sale del package
+	assert.Equal(t, "error_interno", motivoLoginFallido(errors.New("pq: password authentication failed")))
+}
@@ -0,0 +1,211 @@
+package sesiones
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ExportacionUsuario son todos los datos que el package tiene de un usuario,
+// para responder los pedidos de acceso a datos personales.
+type ExportacionUsuario struct {
+	Fecha          time.Time
+	Usuario        Usuario
+	Roles          []string
+	Confirmaciones []ConfirmacionExportada
+	Dispositivos   []UsuarioDispositivo
+	CambiosEstado  []UsuarioCambioEstado
+	CambiosPerfil  []UsuarioCambioPerfil
+	Identidades    []IdentidadExterna
+	ClavesAPI      []ClaveAPI
+	Organizaciones []MiembroOrganizacion
+	Suplantaciones []Suplantacion
+	// ConsentimientosOIDC son los clientes a los que autorizó a acceder a
+	// sus datos
+	ConsentimientosOIDC []ConsentimientoOIDC
+	Invitacion          *InvitacionExportada `json:",omitempty"`
+	// Aplicacion son las secciones que agrega AlExportarUsuario
+	Aplicacion map[string]interface{} `json:",omitempty"`
+}
+
+// ConfirmacionExportada es una UsuarioConfirmacion sin el ID, que es el código
+// secreto de los links enviados por mail.
+type ConfirmacionExportada struct {
+	Motivo            string
+	CreatedAt         time.Time
+	Confirmada        bool
+	FechaConfirmacion time.Time
+	MailNuevo         string `json:",omitempty"`
+}
+
+// exportarConfirmaciones les saca el ID a las confirmaciones.
+func exportarConfirmaciones(confirmaciones []UsuarioConfirmacion) []ConfirmacionExportada {
+	out := []ConfirmacionExportada{}
+	for _, v := range confirmaciones {
+		out = append(out, ConfirmacionExportada{
+			Motivo:            v.Motivo,
+			CreatedAt:         v.CreatedAt,
+			Confirmada:        v.Confirmada,
+			FechaConfirmacion: v.FechaConfirmacion,
+			MailNuevo:         v.MailNuevo,
+		})
+	}
+	return out
+}
+
+// InvitacionExportada es la invitación con la que se creó el usuario, sin el
+// código.
+type InvitacionExportada struct {
+	Email           string
+	Roles           string
+	InvitadoPor     string
+	CreatedAt       time.Time
+	FechaAceptacion time.Time
+}
+
+// ExportarUsuario junta todos los datos del usuario, incluidos los que aporta
+// la aplicación con AlExportarUsuario.
+func (h *Handler) ExportarUsuario(userID string) (e ExportacionUsuario, err error) {
+	usuario, existe, err := h.existeUsuario(userID)
+	if err != nil {
+		return e, errors.Wrap(err, "buscando usuario")
+	}
+	if !existe {
+		return e, errors.Errorf("no existe el usuario %v", userID)
+	}
+	e.Fecha = time.Now()
+	e.Usuario = usuario
+
+	e.Roles, err = h.Roles(userID)
+	if err != nil {
+		return e, err
+	}
+
+	confirmaciones := []UsuarioConfirmacion{}
+	err = h.db.Where("user_id = ?", userID).Order("created_at").Find(&confirmaciones).Error
+	if err != nil {
+		return e, errors.Wrap(err, "buscando confirmaciones")
+	}
+	e.Confirmaciones = exportarConfirmaciones(confirmaciones)
+
+	err = h.db.Where("user_id = ?", userID).Order("created_at").Find(&e.Dispositivos).Error
+	if err != nil {
+		return e, errors.Wrap(err, "buscando dispositivos")
+	}
+	err = h.db.Where("user_id = ?", userID).Order("created_at").Find(&e.CambiosEstado).Error
+	if err != nil {
+		return e, errors.Wrap(err, "buscando cambios de estado")
+	}
+	err = h.db.Where("user_id = ?", userID).Order("created_at").Find(&e.CambiosPerfil).Error
+	if err != nil {
+		return e, errors.Wrap(err, "buscando cambios de perfil")
+	}
+	err = h.db.Where("user_id = ?", userID).Order("created_at").Find(&e.Identidades).Error
+	if err != nil {
+		return e, errors.Wrap(err, "buscando cuentas externas")
+	}
+	err = h.db.Where("user_id = ?", userID).Order("created_at").Find(&e.ClavesAPI).Error
+	if err != nil {
+		return e, errors.Wrap(err, "buscando claves de API")
+	}
+	err = h.db.Where("user_id = ?", userID).Order("created_at").Find(&e.Organizaciones).Error
+	if err != nil {
+		return e, errors.Wrap(err, "buscando organizaciones")
+	}
+	err = h.db.Where("user_id = ?", userID).Order("created_at").Find(&e.Suplantaciones).Error
+	if err != nil {
+		return e, errors.Wrap(err, "buscando suplantaciones")
+	}
+	err = h.db.Where("user_id = ?", userID).Order("created_at").Find(&e.ConsentimientosOIDC).Error
+	if err != nil {
+		return e, errors.Wrap(err, "buscando consentimientos OIDC")
+	}
+
+	invitaciones := []Invitacion{}
+	err = h.db.Where("user_id = ?", userID).Find(&invitaciones).Error
+	if err != nil {
+		return e, errors.Wrap(err, "buscando invitación")
+	}
+	if len(invitaciones) > 0 {
+		v := invitaciones[0]
+		e.Invitacion = &InvitacionExportada{v.Email, v.Roles, v.InvitadoPor, v.CreatedAt, v.FechaAceptacion}
+	}
+
+	if h.AlExportarUsuario != nil {
+		e.Aplicacion, err = h.AlExportarUsuario(userID)
+		if err != nil {
+			return e, errors.Wrap(err, "exportando datos de la aplicación")
+		}
+	}
+	return e, nil
+}
+
+// ExportarDatos descarga los datos personales del usuario de la sesión en
+// JSON. Con el parámetro formato=zip se devuelven comprimidos. Un
+// administrador puede exportar los de otro usuario pasando su ID en el
+// parámetro "id".
+func (h *Handler) ExportarDatos() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		qs := r.URL.Query()
+
+		var usuario Usuario
+		var err error
+		if qs.Get("id") != "" {
+			_, ok := h.exigirRol(w, r, RolAdmin)
+			if !ok {
+				return
+			}
+			usuario.ID = qs.Get("id")
+		} else {
+			usuario, err = h.usuarioSesion(r)
+			if err != nil {
+				httpErr(w, err, http.StatusUnauthorized)
+				return
+			}
+		}
+
+		e, err := h.ExportarUsuario(usuario.ID)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+
+		if qs.Get("formato") != "zip" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", `attachment; filename="datos.json"`)
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="datos.zip"`)
+		err = escribirZipExportacion(w, e)
+		if err != nil {
+			h.logf("exportando datos de %v: %v", usuario.ID, err)
+		}
+	}
+}
+
+// escribirZipExportacion escribe un zip con los datos en datos.json.
+func escribirZipExportacion(w io.Writer, e ExportacionUsuario) (err error) {
+	z := zip.NewWriter(w)
+	f, err := z.CreateHeader(&zip.FileHeader{Name: "datos.json", Method: zip.Deflate, Modified: e.Fecha})
+	if err != nil {
+		return errors.Wrap(err, "creando archivo en zip")
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(e)
+	if err != nil {
+		return errors.Wrap(err, "escribiendo datos")
+	}
+	return z.Close()
+}
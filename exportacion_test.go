@@ -0,0 +1,34 @@
+package sesiones
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZipExportacion(t *testing.T) {
+	e := ExportacionUsuario{Fecha: time.Now()}
+	e.Usuario.ID = "marcos"
+	e.Usuario.Hash = "secreto"
+	e.Aplicacion = map[string]interface{}{"pedidos": []int{1, 2}}
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, escribirZipExportacion(buf, e))
+
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+	assert.Len(t, z.File, 1)
+	assert.Equal(t, "datos.json", z.File[0].Name)
+
+	f, err := z.File[0].Open()
+	assert.Nil(t, err)
+	leido := map[string]interface{}{}
+	assert.Nil(t, json.NewDecoder(f).Decode(&leido))
+	assert.Equal(t, "marcos", leido["Usuario"].(map[string]interface{})["ID"])
+	assert.NotContains(t, leido["Usuario"], "Hash")
+	assert.Contains(t, leido["Aplicacion"], "pedidos")
+}
@@ -3,6 +3,7 @@ package sesiones
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"path"
 	"strings"
@@ -34,6 +35,115 @@ type Handler struct {
 	MailBlanqueo            *MailTemplate
 	MailConfirmacionUsuario *MailTemplate
 	MailSender              MailSender
+
+	// MailCambioMail es el mail que se manda a la dirección nueva para
+	// confirmar el cambio de mail. Si es nil no se puede cambiar el mail.
+	// DuracionCambioMail es el tiempo durante el cual se puede usar el link.
+	MailCambioMail     *MailTemplate
+	DuracionCambioMail time.Duration
+
+	// MailEnlaceIngreso es el mail con el link para ingresar sin
+	// contraseña. Si es nil el ingreso con enlace está deshabilitado.
+	MailEnlaceIngreso     *MailTemplate
+	DuracionEnlaceIngreso time.Duration
+
+	// MailInvitacion es el mail que reciben los usuarios invitados por un
+	// administrador. Si es nil no se pueden hacer invitaciones.
+	MailInvitacion     *MailTemplate
+	DuracionInvitacion time.Duration
+
+	// SoloInvitacion deshabilita el alta de usuarios con NuevoUsuario. Los
+	// usuarios sólo se pueden crear aceptando una invitación.
+	SoloInvitacion bool
+
+	// RequiereAprobacion hace que los usuarios nuevos, luego de confirmar
+	// su mail, queden pendientes de aprobación por un administrador.
+	// MailAprobacion y MailRechazo son los avisos del resultado, opcionales.
+	RequiereAprobacion bool
+	MailAprobacion     *MailTemplate
+	MailRechazo        *MailTemplate
+
+	// MailPasswordTemporal es el mail con la contraseña temporal que genera
+	// un administrador. Si es nil la contraseña sólo se puede devolver en la
+	// respuesta.
+	MailPasswordTemporal *MailTemplate
+
+	// PlazoBorrado es el tiempo durante el cual un usuario que borró su
+	// cuenta la puede restaurar (sin límite si es cero). MailBajaCuenta es el aviso opcional con la
+	// fecha límite.
+	PlazoBorrado   time.Duration
+	MailBajaCuenta *MailTemplate
+
+	// AlBorrarUsuario se llama dentro de la transacción que borra o
+	// anonimiza un usuario, para que la aplicación borre sus propios datos.
+	AlBorrarUsuario func(tx *gorm.DB, userID string) error
+
+	// AlExportarUsuario devuelve los datos que tiene la aplicación del
+	// usuario, para agregarlos a la exportación de datos personales. Cada
+	// clave es una sección.
+	AlExportarUsuario func(userID string) (secciones map[string]interface{}, err error)
+
+	// WebhookMaxIntentos es la cantidad de veces que se intenta una entrega
+	// antes de darla por fallida (8 si es cero). ClienteWebhooks es el
+	// cliente HTTP con el que se mandan (uno con timeout de 10 segundos si es
+	// nil).
+	WebhookMaxIntentos int
+	ClienteWebhooks    *http.Client
+
+	// OIDC habilita el modo proveedor de OpenID Connect. Si es nil los
+	// endpoints de OIDC responden 501.
+	OIDC *ConfigOIDC
+
+	// Autenticadores son los que corroboran usuario y contraseña en el
+	// login. Se prueban en orden: si uno no reconoce al usuario o no está
+	// disponible se pasa al siguiente. Si está vacío se usa sólo la base de
+	// datos.
+	Autenticadores []Autenticador
+
+	// ScopesAPI son los scopes que pueden tener las claves de API. La
+	// aplicación los controla con ExigirScope. DuracionClavesAPI es el
+	// vencimiento máximo de una clave.
+	ScopesAPI         []string
+	DuracionClavesAPI time.Duration
+
+	// ProveedoresExternos son los proveedores de OpenID Connect con los que
+	// se puede ingresar además de usuario y contraseña.
+	ProveedoresExternos []*ProveedorExterno
+
+	// SCIM habilita los endpoints de SCIM 2.0 en .../scim/v2. Si es nil
+	// responden 501.
+	SCIM *ConfigSCIM
+
+	// DuracionSuplantacion es lo máximo que dura la sesión de un
+	// administrador que ingresa como otro usuario.
+	DuracionSuplantacion time.Duration
+
+	// Atributos son los metadatos que acepta cada usuario, propios de la
+	// aplicación.
+	Atributos []AtributoUsuario
+
+	// Avisos de seguridad. New los crea con los templates por defecto y el
+	// link en el mismo front end que el blanqueo; si el template es nil el
+	// aviso no se envía. El frontEndPath de estos templates tiene que llevar
+	// a la página que llama a "no_fui_yo". DuracionNoFuiYo es el tiempo
+	// durante el cual se puede usar ese link.
+	MailAvisoCambioContraseña *MailTemplate
+	MailAvisoNuevoDispositivo *MailTemplate
+	MailAvisoCambioMail       *MailTemplate
+	DuracionNoFuiYo           time.Duration
+
+	// AvisoVencimiento es la anticipación con la que se le avisa al usuario
+	// que su contraseña está por vencer. Si es cero no se avisa.
+	AvisoVencimiento     time.Duration
+	MailAvisoVencimiento *MailTemplate
+
+	// eventos son los hooks registrados con Antes y Despues
+	eventos eventos
+
+	// ErrorLog es donde se registran los errores que no se le pueden
+	// devolver al usuario (por ejemplo, al enviar un aviso). Si es nil se
+	// usa el logger estándar.
+	ErrorLog *log.Logger
 }
 
 // New instancia un nuevo handler de sesiones.
@@ -66,20 +176,96 @@ func New(
 	h.PassMaxLength = 40
 	h.PassMinLength = 6
 	h.PassValidez = 30 * time.Hour * 24
+	h.AvisoVencimiento = 5 * time.Hour * 24
 
 	// Datos por defecto SESION
 	h.DuracionSesion = time.Minute * 30
+	h.DuracionEnlaceIngreso = time.Minute * 15
+	h.DuracionInvitacion = 7 * time.Hour * 24
+	h.PlazoBorrado = 30 * time.Hour * 24
+	h.DuracionClavesAPI = 90 * time.Hour * 24
+	h.DuracionSuplantacion = time.Minute * 30
+	h.DuracionNoFuiYo = 7 * time.Hour * 24
+	h.DuracionCambioMail = time.Hour * 24
+
+	// Los avisos de seguridad, con el link de "no fui yo" en el mismo front
+	// end que el blanqueo
+	h.MailAvisoCambioContraseña, err = templateHermano(blanqueoTpl, defaultAvisoCambioContraseñaTemplate, pathNoFuiYo)
+	if err != nil {
+		return nil, errors.Wrap(err, "creando template de aviso de cambio de contraseña")
+	}
+	h.MailAvisoNuevoDispositivo, err = templateHermano(blanqueoTpl, defaultAvisoNuevoDispositivoTemplate, pathNoFuiYo)
+	if err != nil {
+		return nil, errors.Wrap(err, "creando template de aviso de nuevo dispositivo")
+	}
+	h.MailAvisoCambioMail, err = templateHermano(blanqueoTpl, defaultAvisoCambioMailTemplate, pathNoFuiYo)
+	if err != nil {
+		return nil, errors.Wrap(err, "creando template de aviso de cambio de mail")
+	}
 
 	return
 }
 
 const (
-	pathNuevoUsuario      = "nuevo_usuario"
-	pathCambiarContraseña = "cambiar_contraseña"
-	pathConfirmarUsuario  = "confirmar_usuario"
-	pathSolicitarBlanqueo = "solicitar_blanqueo"
-	pathConfirmarBlanqueo = "confirmar_blanqueo"
-	pathCerrarSesion      = "cerrar_sesion"
+	pathNuevoUsuario           = "nuevo_usuario"
+	pathCambiarContraseña      = "cambiar_contraseña"
+	pathConfirmarUsuario       = "confirmar_usuario"
+	pathSolicitarBlanqueo      = "solicitar_blanqueo"
+	pathConfirmarBlanqueo      = "confirmar_blanqueo"
+	pathCerrarSesion           = "cerrar_sesion"
+	pathNoFuiYo                = "no_fui_yo"
+	pathCambiarMail            = "cambiar_mail"
+	pathConfirmarCambioMail    = "confirmar_cambio_mail"
+	pathSolicitarEnlaceIngreso = "solicitar_enlace_ingreso"
+	pathIngresarConEnlace      = "ingresar_con_enlace"
+	pathInvitarUsuario         = "invitar_usuario"
+	pathAceptarInvitacion      = "aceptar_invitacion"
+	pathUsuariosPendientes     = "usuarios_pendientes"
+	pathAprobarUsuario         = "aprobar_usuario"
+	pathRechazarUsuario        = "rechazar_usuario"
+	pathSuspenderUsuario       = "suspender_usuario"
+	pathReactivarUsuario       = "reactivar_usuario"
+	pathUsuarios               = "usuarios"
+	pathUsuario                = "usuario"
+	pathPasswordTemporal       = "password_temporal"
+	pathForzarBlanqueo         = "forzar_blanqueo"
+	pathBlanqueoObligatorio    = "blanqueo_obligatorio"
+	pathMiUsuario              = "mi_usuario"
+	pathEditarPerfil           = "editar_perfil"
+	pathEditarMetadatos        = "editar_metadatos"
+	pathBorrarCuenta           = "borrar_cuenta"
+	pathRestaurarCuenta        = "restaurar_cuenta"
+	pathExportarDatos          = "exportar_datos"
+	pathWebhooks               = "webhooks"
+	pathNuevoWebhook           = "nuevo_webhook"
+	pathBorrarWebhook          = "borrar_webhook"
+	pathEntregasWebhook        = "entregas_webhook"
+	pathReenviarWebhook        = "reenviar_webhook"
+	pathAutorizar              = "authorize"
+	pathTokenOIDC              = "token"
+	pathUserInfoOIDC           = "userinfo"
+	pathJWKS                   = "jwks"
+	pathDescubrimientoOIDC     = "openid-configuration"
+	pathConsentirOIDC          = "consentimiento_oidc"
+	pathNuevoClienteOIDC       = "nuevo_cliente_oidc"
+	pathIngresoExterno         = "ingreso_externo"
+	pathCallbackExterno        = "callback_externo"
+	pathDesvincularExterno     = "desvincular_externo"
+	pathAutorizarDispositivo   = "device_authorization"
+	pathVerificarDispositivo   = "verificar_dispositivo"
+	pathClavesAPI              = "claves_api"
+	pathNuevaClaveAPI          = "nueva_clave_api"
+	pathRevocarClaveAPI        = "revocar_clave_api"
+	pathSCIM                   = "scim"
+	pathOrganizaciones         = "organizaciones"
+	pathNuevaOrganizacion      = "nueva_organizacion"
+	pathMiembrosOrganizacion   = "miembros_organizacion"
+	pathEditarMiembro          = "editar_miembro_organizacion"
+	pathQuitarMiembro          = "quitar_miembro_organizacion"
+	pathCambiarOrganizacion    = "cambiar_organizacion"
+	pathSuplantar              = "suplantar_usuario"
+	pathFinalizarSuplantacion  = "finalizar_suplantacion"
+	pathSuplantaciones         = "suplantaciones"
 )
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -92,6 +278,12 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Separo el path por "/"
 	paths := strings.Split(r.URL.Path, "/")
 
+	// SCIM tiene sus propias rutas: .../scim/v2/Users/{id}
+	if _, _, ok := rutaSCIM(r.URL.Path); ok {
+		h.EndpointsSCIM()(w, r)
+		return
+	}
+
 	switch len(paths) {
 	case 0:
 		http.Error(w, "", http.StatusNotFound)
@@ -115,6 +307,110 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.ConfirmarBlanqueo()(w, r)
 	case pathCerrarSesion:
 		h.CerrarSesion()(w, r)
+	case pathNoFuiYo:
+		h.NoFuiYo()(w, r)
+	case pathCambiarMail:
+		h.CambiarMail()(w, r)
+	case pathConfirmarCambioMail:
+		h.ConfirmarCambioMail()(w, r)
+	case pathSolicitarEnlaceIngreso:
+		h.SolicitarEnlaceIngreso()(w, r)
+	case pathIngresarConEnlace:
+		h.IngresarConEnlace()(w, r)
+	case pathInvitarUsuario:
+		h.InvitarUsuario()(w, r)
+	case pathAceptarInvitacion:
+		h.AceptarInvitacion()(w, r)
+	case pathUsuariosPendientes:
+		h.UsuariosPendientes()(w, r)
+	case pathAprobarUsuario:
+		h.AprobarUsuario()(w, r)
+	case pathRechazarUsuario:
+		h.RechazarUsuario()(w, r)
+	case pathSuspenderUsuario:
+		h.SuspenderUsuario()(w, r)
+	case pathReactivarUsuario:
+		h.ReactivarUsuario()(w, r)
+	case pathUsuarios:
+		h.ListadoUsuarios()(w, r)
+	case pathUsuario:
+		h.VerUsuario()(w, r)
+	case pathPasswordTemporal:
+		h.PasswordTemporal()(w, r)
+	case pathForzarBlanqueo:
+		h.ForzarBlanqueo()(w, r)
+	case pathBlanqueoObligatorio:
+		h.BlanqueoObligatorio()(w, r)
+	case pathMiUsuario:
+		h.MiUsuario()(w, r)
+	case pathEditarPerfil:
+		h.EditarPerfil()(w, r)
+	case pathEditarMetadatos:
+		h.EditarMetadatos()(w, r)
+	case pathBorrarCuenta:
+		h.BorrarCuenta()(w, r)
+	case pathRestaurarCuenta:
+		h.RestaurarCuenta()(w, r)
+	case pathExportarDatos:
+		h.ExportarDatos()(w, r)
+	case pathWebhooks:
+		h.Webhooks()(w, r)
+	case pathNuevoWebhook:
+		h.NuevoWebhook()(w, r)
+	case pathBorrarWebhook:
+		h.BorrarWebhook()(w, r)
+	case pathEntregasWebhook:
+		h.EntregasWebhook()(w, r)
+	case pathReenviarWebhook:
+		h.ReenviarWebhook()(w, r)
+	case pathAutorizar:
+		h.Autorizar()(w, r)
+	case pathTokenOIDC:
+		h.TokenOIDC()(w, r)
+	case pathUserInfoOIDC:
+		h.UserInfoOIDC()(w, r)
+	case pathJWKS:
+		h.JWKS()(w, r)
+	case pathDescubrimientoOIDC:
+		h.DescubrimientoOIDC()(w, r)
+	case pathConsentirOIDC:
+		h.ConsentirOIDC()(w, r)
+	case pathNuevoClienteOIDC:
+		h.NuevoClienteOIDC()(w, r)
+	case pathIngresoExterno:
+		h.IngresoExterno()(w, r)
+	case pathCallbackExterno:
+		h.CallbackExterno()(w, r)
+	case pathDesvincularExterno:
+		h.DesvincularExterno()(w, r)
+	case pathAutorizarDispositivo:
+		h.AutorizarDispositivo()(w, r)
+	case pathVerificarDispositivo:
+		h.VerificarDispositivo()(w, r)
+	case pathClavesAPI:
+		h.ClavesAPI()(w, r)
+	case pathNuevaClaveAPI:
+		h.NuevaClaveAPI()(w, r)
+	case pathRevocarClaveAPI:
+		h.RevocarClaveAPI()(w, r)
+	case pathOrganizaciones:
+		h.Organizaciones()(w, r)
+	case pathNuevaOrganizacion:
+		h.NuevaOrganizacion()(w, r)
+	case pathMiembrosOrganizacion:
+		h.MiembrosOrganizacion()(w, r)
+	case pathEditarMiembro:
+		h.EditarMiembroOrganizacion()(w, r)
+	case pathQuitarMiembro:
+		h.QuitarMiembroOrganizacion()(w, r)
+	case pathCambiarOrganizacion:
+		h.CambiarOrganizacion()(w, r)
+	case pathSuplantar:
+		h.Suplantar()(w, r)
+	case pathFinalizarSuplantacion:
+		h.FinalizarSuplantacion()(w, r)
+	case pathSuplantaciones:
+		h.Suplantaciones()(w, r)
 	default:
 		http.Error(w, "", http.StatusNotFound)
 	}
@@ -124,8 +420,16 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // ChequearSesion revisa que el request tenga un token y que sea válido.
 // Si está todo ok le actualiza el tiempo de expiración.ChequearToken
 // Sino devuelve un error Unauthorized.
+//
+// También acepta claves de API con el scope ScopeSesion, que no se
+// renuevan. Para controlar otros scopes está ExigirScope.
 func (h *Handler) ChequearSesion(w http.ResponseWriter, r *http.Request) error {
 
+	if _, ok := extraerClaveAPI(r); ok {
+		_, err := h.UsuarioIDScope(r, ScopeSesion)
+		return err
+	}
+
 	// Extraigo token
 	token, err := extraerToken(r)
 	if err != nil {
@@ -139,38 +443,44 @@ func (h *Handler) ChequearSesion(w http.ResponseWriter, r *http.Request) error {
 		return errors.Wrap(err, "chequeando token")
 	}
 
-	// Estaba ok, pego el nuevo
+	// ¿Sigue activo el usuario? ¿Se cerraron todas sus sesiones después del
+	// login?
+	usuario, err := h.controlarSesion(t2.Claims.(jwt.MapClaims))
+	if err != nil {
+		return errors.Wrap(err, "controlando sesión")
+	}
+
+	// Estaba ok, pego el nuevo con los atributos actuales
+	h.agregarMetadatosToken(t2, usuario)
 	h.setToken(w, t2)
 	return nil
 
 }
 
-// UsuarioID devuelve el campo Nombre para el usuario de la sesión. Esta función la van
+// UsuarioID devuelve el ID del usuario de la sesión. Esta función la van
 // a usar los otros packages.
+//
+// El ID es un UUID que no cambia aunque el usuario cambie su mail, así que
+// se puede usar como clave foránea. Acepta las claves de API con el scope
+// ScopeSesion; para otros scopes está UsuarioIDScope.
 func (h *Handler) UsuarioID(r *http.Request) (id string, err error) {
-	tokenString, err := extraerToken(r)
-	if err != nil {
-		return id, errors.Wrap(err, "extrayendo token de request")
+	if _, ok := extraerClaveAPI(r); ok {
+		return h.UsuarioIDScope(r, ScopeSesion)
 	}
 
-	token, err := h.parseToken(tokenString)
+	// Controlo también que la sesión no haya sido revocada
+	usuario, err := h.usuarioSesion(r)
 	if err != nil {
-		return id, errors.Wrap(err, "parseando token")
+		return id, err
 	}
-
-	// Infiero tipo
-	claims := token.Claims.(jwt.MapClaims)
-	id = claims["userID"].(string)
-
-	return id, err
-
+	return usuario.ID, nil
 }
 
 // Login devuelve una HandlerFunc que corrobora usuario y contraseña y si pasa
 // le pega una cookie.
 func (h *Handler) Login(w http.ResponseWriter, r *http.Request) error {
 
-	// Request
+	// Request. UserID puede ser el mail o el nombre de usuario.
 	params := struct {
 		UserID string
 		Pass   string
@@ -182,22 +492,78 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	// Verifico usuario y contraseña
-	err = h.checkPass(params.UserID, params.Pass)
+	usuario, err := h.checkPass(params.UserID, params.Pass)
 	if err != nil {
+		// Ni lo ingresado, que puede ser una contraseña, ni el texto del
+		// error, que puede ser de la base de datos
+		e := nuevoEvento(EventoLoginFallido, usuario, r)
+		e.Datos = map[string]interface{}{"Motivo": motivoLoginFallido(err)}
+		h.emitir(e)
 		return err
 	}
 
+	return h.iniciarSesion(w, r, usuario)
+}
+
+// motivoLoginFallido devuelve el código del motivo de EventoLoginFallido.
+func motivoLoginFallido(err error) string {
+	switch errors.Cause(err).(type) {
+	case ErrAutenticacion:
+		return "credenciales"
+	case ErrCorrespondeBlanquear:
+		return "blanqueo"
+	case ErrCorrespondeConfirmarMail:
+		return "mail_sin_confirmar"
+	case ErrPendienteAprobacion:
+		return "pendiente_aprobacion"
+	case ErrCuentaSuspendida:
+		return "suspendida"
+	case ErrCuentaDeshabilitada:
+		return "deshabilitada"
+	case ErrCuentaBloqueada:
+		return "bloqueada"
+	case ErrAutenticadorNoDisponible:
+		return "autenticador_no_disponible"
+	}
+	return "error_interno"
+}
+
+// iniciarSesion le pega la cookie con el token al usuario que ya se
+// autenticó.
+func (h *Handler) iniciarSesion(w http.ResponseWriter, r *http.Request, usuario Usuario) (err error) {
+
+	e := nuevoEvento(EventoSesionIniciada, usuario, r)
+	err = h.validarEvento(e)
+	if err != nil {
+		return err
+	}
+
+	// Si ingresa desde un dispositivo nuevo le aviso
+	err = h.controlarDispositivo(usuario, r)
+	if err != nil {
+		h.logf("controlando dispositivo de %v: %v", usuario.ID, err)
+	}
+
+	// Si la contraseña está por vencer se lo indico al front end
+	h.informarVencimiento(w, usuario)
+
 	// Creo un token
-	token, err := h.newToken(params.UserID)
+	token, err := h.newToken(usuario.ID)
 	if err != nil {
 		return errors.Wrap(err, "creando token")
 	}
+	h.agregarMetadatosToken(token, usuario)
+	err = h.agregarOrganizacionToken(token, usuario)
+	if err != nil {
+		h.logf("buscando organización de %v: %v", usuario.ID, err)
+	}
 
 	// Pego el token al response
 	err = h.setToken(w, token)
 	if err != nil {
 		return errors.Wrap(err, "pegando token")
 	}
+	h.emitir(e)
 
 	return nil
 
@@ -235,14 +601,21 @@ func (h *Handler) CerrarSesion() http.HandlerFunc {
 func (h *Handler) NuevoUsuario() http.HandlerFunc {
 
 	request := struct {
-		Nombre   string
-		Apellido string
-		Mail     string
-		Pass     string
+		Nombre    string
+		Apellido  string
+		Mail      string
+		Username  string
+		Pass      string
+		Metadatos Metadatos
 	}{}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
+		if h.SoloInvitacion {
+			httpErr(w, errors.New("el registro de usuarios es sólo por invitación"), http.StatusForbidden)
+			return
+		}
+
 		// Leo el request
 		err := json.NewDecoder(r.Body).Decode(&request)
 		if err != nil {
@@ -251,16 +624,25 @@ func (h *Handler) NuevoUsuario() http.HandlerFunc {
 
 		// Creo el struct Usuario
 		u := Usuario{}
-		u.ID = request.Mail
+		id, _ := uuid.NewV4()
+		u.ID = id.String()
+		u.Email = normalizarLogin(request.Mail)
+		u.Username = normalizarLogin(request.Username)
 		u.Nombre = request.Nombre
 		u.Apellido = request.Apellido
 
-		//Que tenga id
-		if u.ID == "" {
+		//Que tenga mail
+		if u.Email == "" {
 			httpErr(w, errors.New("debe ingresar un mail"), http.StatusBadRequest)
 			return
 		}
 
+		// El nombre de usuario no puede confundirse con un mail
+		if strings.Contains(u.Username, "@") {
+			httpErr(w, errors.New("el nombre de usuario no puede contener '@'"), http.StatusBadRequest)
+			return
+		}
+
 		//Que no exista en la base
 
 		// Que tenga nombre
@@ -269,29 +651,59 @@ func (h *Handler) NuevoUsuario() http.HandlerFunc {
 			return
 		}
 
-		// Que el id ingresado no exista.
-		_, existe, err := h.existeUsuario(u.ID)
+		// Que los atributos respeten el esquema
+		err = h.validarMetadatos(request.Metadatos, false, true)
+		if err != nil {
+			httpErr(w, err, http.StatusBadRequest)
+			return
+		}
+		u.Metadatos = aplicarMetadatos(nil, request.Metadatos)
+
+		// Que el mail ingresado no exista.
+		_, existe, err := h.buscarUsuario(u.Email)
 		if err != nil {
 			httpErr(w, errors.Wrap(err, "corroborando existencia del usuario"), http.StatusInternalServerError)
 			return
 		}
 		if existe == true {
-			httpErr(w, errors.Errorf("ya existe un usuario con mail %v", u.ID), http.StatusInternalServerError)
+			httpErr(w, errors.Errorf("ya existe un usuario con mail %v", u.Email), http.StatusInternalServerError)
 			return
 		}
 
+		// Ni el nombre de usuario
+		if u.Username != "" {
+			_, existe, err = h.buscarUsuario(u.Username)
+			if err != nil {
+				httpErr(w, errors.Wrap(err, "corroborando existencia del usuario"), http.StatusInternalServerError)
+				return
+			}
+			if existe {
+				httpErr(w, errors.Errorf("ya existe el usuario %v", u.Username), http.StatusInternalServerError)
+				return
+			}
+		}
+
 		// Le pego el hash de la password.
 		u.Hash = calcularHash(request.Pass)
 		u.UltimaActualizacionContraseña = time.Now()
 		u.BlanquearProximoIngreso = false
 		u.Estado = EstadoPendienteConfirmación
 
+		// La aplicación puede rechazar el alta
+		e := nuevoEvento(EventoUsuarioCreado, u, r)
+		err = h.validarEvento(e)
+		if err != nil {
+			httpErr(w, err, http.StatusForbidden)
+			return
+		}
+
 		// Persisto
 		err = h.db.Create(&u).Error
 		if err != nil {
 			httpErr(w, errors.Wrap(err, "persistiendo usuario en base de datos"), http.StatusInternalServerError)
 			return
 		}
+		h.emitir(e)
 
 		// Creo el registro con el codigo de confirmación.
 		conf := UsuarioConfirmacion{}
@@ -312,7 +724,7 @@ func (h *Handler) NuevoUsuario() http.HandlerFunc {
 			return
 		}
 
-		h.MailSender.Send(u.ID, h.MailSender.SenderAlias(), "Confirmación de usuario", body)
+		h.MailSender.Send(u.Email, h.MailSender.SenderAlias(), "Confirmación de usuario", body)
 		if err != nil {
 			httpErr(w, errors.Wrap(err, "confirmando la transacción"), http.StatusInternalServerError)
 			return
@@ -337,13 +749,12 @@ func (h *Handler) ReenviarMailConfirmacion() http.HandlerFunc {
 		}
 
 		// Busco el nombre de este usuario
-		u := []Usuario{}
-		err = h.db.Find(&u).Error
+		u, existe, err := h.buscarUsuario(request.UserID)
 		if err != nil {
 			httpErr(w, errors.Wrap(err, "buscando el usuario"), http.StatusInternalServerError)
 			return
 		}
-		if len(u) == 0 {
+		if !existe {
 			httpErr(w, errors.New("no se pudo encontrar el usuario"), http.StatusInternalServerError)
 			return
 		}
@@ -351,7 +762,7 @@ func (h *Handler) ReenviarMailConfirmacion() http.HandlerFunc {
 		// Creo el registro con el codigo de confirmación.
 		conf := UsuarioConfirmacion{}
 		conf.ID, _ = uuid.NewV4()
-		conf.UserID = request.UserID
+		conf.UserID = u.ID
 		conf.Motivo = MotivoCreacion
 
 		err = h.db.Create(&conf).Error
@@ -361,13 +772,13 @@ func (h *Handler) ReenviarMailConfirmacion() http.HandlerFunc {
 		}
 
 		// Envío el mail con el link para confirmar usuario
-		body, err := h.MailConfirmacionUsuario.body(u[0].Nombre, conf.ID.String())
+		body, err := h.MailConfirmacionUsuario.body(u.Nombre, conf.ID.String())
 		if err != nil {
 			httpErr(w, errors.Wrap(err, "creando body de mail usuario"), http.StatusInternalServerError)
 			return
 		}
 
-		h.MailSender.Send(u[0].ID, h.MailSender.SenderAlias(), "Confirmación de usuario", body)
+		h.MailSender.Send(u.Email, h.MailSender.SenderAlias(), "Confirmación de usuario", body)
 		if err != nil {
 			httpErr(w, errors.Wrap(err, "confirmando la transacción"), http.StatusInternalServerError)
 			return
@@ -418,11 +829,20 @@ func (h *Handler) ConfirmarUsuario() http.HandlerFunc {
 		}
 
 		// Cambio el estado en Usuario
-		err = tx.
-			Model(&Usuario{}).
-			Where("id = ?", c.UserID).
-			Update(map[string]interface{}{"Estado": EstadoConfirmado}).
-			Error
+		usuario, _, err := h.existeUsuario(c.UserID)
+		if err != nil {
+			tx.Rollback()
+			httpErr(w, errors.Wrap(err, "buscando usuario"), http.StatusInternalServerError)
+			return
+		}
+		e := nuevoEvento(EventoUsuarioConfirmado, usuario, r)
+		err = h.validarEvento(e)
+		if err != nil {
+			tx.Rollback()
+			httpErr(w, err, http.StatusForbidden)
+			return
+		}
+		err = h.cambiarEstado(tx, usuario, h.estadoAlConfirmarMail(), "", MotivoCreacion)
 		if err != nil {
 			tx.Rollback()
 			httpErr(w, errors.Wrap(err, "persistiendo usuario"), http.StatusInternalServerError)
@@ -435,6 +855,8 @@ func (h *Handler) ConfirmarUsuario() http.HandlerFunc {
 			httpErr(w, errors.Wrap(err, "confirmando transaccion"), http.StatusInternalServerError)
 			return
 		}
+		e.Usuario.Estado = h.estadoAlConfirmarMail()
+		h.emitir(e)
 
 	}
 }
@@ -456,8 +878,8 @@ func (h *Handler) SolicitarBlanqueo() http.HandlerFunc {
 			return
 		}
 
-		// Que el id ingresado  exista.
-		usuario, existe, err := h.existeUsuario(request.UserID)
+		// Que el usuario ingresado exista.
+		usuario, existe, err := h.buscarUsuario(request.UserID)
 		if err != nil {
 			httpErr(w, errors.Wrap(err, "corroborando existencia del usuario"), http.StatusInternalServerError)
 			return
@@ -470,7 +892,7 @@ func (h *Handler) SolicitarBlanqueo() http.HandlerFunc {
 		// Creo el registro con el codigo de confirmación.
 		conf := UsuarioConfirmacion{}
 		conf.ID, _ = uuid.NewV4()
-		conf.UserID = request.UserID
+		conf.UserID = usuario.ID
 		conf.Motivo = MotivoBlanqueo
 		err = h.db.Create(&conf).Error
 		if err != nil {
@@ -484,7 +906,7 @@ func (h *Handler) SolicitarBlanqueo() http.HandlerFunc {
 			httpErr(w, errors.Wrap(err, "generando el body del mail"), http.StatusInternalServerError)
 			return
 		}
-		err = h.MailSender.Send(conf.UserID, h.MailSender.SenderAlias(), "Confirmacion de blanqueo de contraseña", body)
+		err = h.MailSender.Send(usuario.Email, h.MailSender.SenderAlias(), "Confirmacion de blanqueo de contraseña", body)
 		if err != nil {
 			httpErr(w, errors.Wrap(err, "enviando el mail de confirmación"), http.StatusInternalServerError)
 			return
@@ -536,10 +958,12 @@ func (h *Handler) ConfirmarBlanqueo() http.HandlerFunc {
 		// Cambio el hash de la constraseña
 		err = h.blanquearPassword(c.UserID, request.Pass, false)
 		if err != nil {
-			httpErr(w, errors.New("blanqueando password"), http.StatusInternalServerError)
+			httpErr(w, errors.Wrap(err, "blanqueando password"), codigoHTTP(err, http.StatusInternalServerError))
 			return
 		}
 
+		h.avisarCambioContraseña(c.UserID)
+
 	}
 }
 
@@ -555,6 +979,11 @@ func (h *Handler) CambiarContraseña() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
+		if _, ok := h.suplantacionRequest(r); ok {
+			httpErr(w, errSuplantando, http.StatusForbidden)
+			return
+		}
+
 		// Leo request
 		err := json.NewDecoder(r.Body).Decode(&request)
 		if err != nil {
@@ -568,21 +997,47 @@ func (h *Handler) CambiarContraseña() http.HandlerFunc {
 			return
 		}
 
+		// UserID puede ser el mail o el nombre de usuario
+		usuario, existe, err := h.buscarUsuario(request.UserID)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando usuario"), http.StatusInternalServerError)
+			return
+		}
+		if !existe {
+			httpErr(w, ErrAutenticacion{"el usuario no existe"}, http.StatusInternalServerError)
+			return
+		}
+
 		// Está ok la contraseña actual?
-		err = h.coincideUserYPass(request.UserID, request.Actual)
+		err = h.coincideUserYPass(usuario.ID, request.Actual)
 		if err != nil {
 			httpErr(w, err, http.StatusInternalServerError)
 			return
 		}
+		if !blanqueoConContraseña(usuario) {
+			httpErr(w, errBlanqueoPorMail, http.StatusForbidden)
+			return
+		}
 
 		// Estamos ok, procedemos con el blanqueo
-		err = h.blanquearPassword(request.UserID, request.Pass, false)
+		err = h.blanquearPassword(usuario.ID, request.Pass, false)
 		if err != nil {
-			httpErr(w, errors.New("blanqueando password"), http.StatusInternalServerError)
+			httpErr(w, errors.Wrap(err, "blanqueando password"), codigoHTTP(err, http.StatusInternalServerError))
 			return
 		}
 
+		h.avisarCambioContraseña(usuario.ID)
+
+	}
+}
+
+// logf registra un error en ErrorLog.
+func (h *Handler) logf(format string, args ...interface{}) {
+	if h.ErrorLog != nil {
+		h.ErrorLog.Printf(format, args...)
+		return
 	}
+	log.Printf(format, args...)
 }
 
 func httpErr(w http.ResponseWriter, err error, errCode int, msg ...string) {
@@ -0,0 +1,586 @@
+package sesiones
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	cookieIngresoExterno   = "ingreso_externo"
+	duracionIngresoExterno = 10 * time.Minute
+)
+
+// ProveedorExterno es un proveedor de identidad OpenID Connect con el que
+// pueden ingresar los usuarios, por ejemplo Google o Microsoft.
+type ProveedorExterno struct {
+	// Nombre identifica al proveedor en la URL ("proveedor=google")
+	Nombre string
+	// Emisor es el issuer del proveedor. Sus endpoints se leen de
+	// Emisor + "/.well-known/openid-configuration".
+	Emisor         string
+	ClienteID      string
+	ClienteSecreto string
+	// RedirectURI es la URL pública de "callback_externo" de este Handler,
+	// tal como está registrada en el proveedor.
+	RedirectURI string
+	// Scopes son los que se piden. Por defecto openid, email y profile.
+	Scopes []string
+	// CrearUsuarios da de alta el usuario la primera vez que ingresa. Si el
+	// proveedor informa que el mail está verificado no hace falta
+	// confirmarlo.
+	CrearUsuarios bool
+	// Cliente es el cliente HTTP con el que se llama al proveedor. Si es nil
+	// se usa uno con timeout de 10 segundos.
+	Cliente *http.Client
+
+	mu          sync.Mutex
+	descubierto *descubrimientoExterno
+	claves      map[string]*rsa.PublicKey
+}
+
+// descubrimientoExterno son los datos del proveedor que se usan.
+type descubrimientoExterno struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// IdentidadExterna vincula una cuenta de un proveedor externo con un usuario.
+type IdentidadExterna struct {
+	Proveedor string `gorm:"primary_key"`
+	// Sujeto es el claim "sub" del proveedor, que no cambia aunque cambie
+	// el mail.
+	Sujeto    string `gorm:"primary_key"`
+	UserID    string
+	Email     string
+	CreatedAt time.Time
+	UltimoUso time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (i IdentidadExterna) TableName() string {
+	return "usuario_identidades_externas"
+}
+
+// estadoIngresoExterno es lo que se guarda en una cookie firmada entre la
+// ida al proveedor y la vuelta.
+type estadoIngresoExterno struct {
+	Proveedor string
+	State     string
+	Nonce     string
+	Verifier  string
+	Volver    string
+	// Vincular es el usuario de la sesión cuando se está vinculando una
+	// identidad a una cuenta existente.
+	Vincular string
+	jwt.StandardClaims
+}
+
+// claveIngresoExterno firma la cookie del ingreso externo. Es distinta de la
+// de las sesiones para que una no pueda usarse como la otra.
+func (h *Handler) claveIngresoExterno() []byte {
+	s := sha256.Sum256(append([]byte(cookieIngresoExterno+":"), h.secretKey...))
+	return s[:]
+}
+
+func (h *Handler) proveedorExterno(nombre string) (*ProveedorExterno, bool) {
+	for _, p := range h.ProveedoresExternos {
+		if p.Nombre == nombre {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+func (p *ProveedorExterno) cliente() *http.Client {
+	if p.Cliente != nil {
+		return p.Cliente
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func (p *ProveedorExterno) scopes() []string {
+	if len(p.Scopes) > 0 {
+		return p.Scopes
+	}
+	return []string{ScopeOpenID, ScopeEmail, ScopeProfile}
+}
+
+// descubrir lee la configuración del proveedor. Queda guardada.
+func (p *ProveedorExterno) descubrir() (d descubrimientoExterno, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.descubierto != nil {
+		return *p.descubierto, nil
+	}
+
+	err = p.leerJSON(strings.TrimSuffix(p.Emisor, "/")+"/.well-known/openid-configuration", &d)
+	if err != nil {
+		return d, errors.Wrap(err, "leyendo configuración del proveedor")
+	}
+	if d.Issuer != p.Emisor {
+		return d, errors.Errorf("el issuer %v no coincide con %v", d.Issuer, p.Emisor)
+	}
+	p.descubierto = &d
+	return d, nil
+}
+
+func (p *ProveedorExterno) leerJSON(u string, v interface{}) error {
+	res, err := p.cliente().Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("%v respondió %v", u, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// clave devuelve la clave pública con la que el proveedor firma los ID
+// tokens. Si no la conoce vuelve a leer el JWKS, porque el proveedor puede
+// haber rotado las claves.
+func (p *ProveedorExterno) clave(d descubrimientoExterno, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.claves[kid]; ok {
+		return k, nil
+	}
+
+	jwks := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	err := p.leerJSON(d.JWKSURI, &jwks)
+	if err != nil {
+		return nil, errors.Wrap(err, "leyendo claves del proveedor")
+	}
+
+	p.claves = map[string]*rsa.PublicKey{}
+	for _, v := range jwks.Keys {
+		if v.Kty != "RSA" {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(v.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(v.E)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		p.claves[v.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if k, ok := p.claves[kid]; ok {
+		return k, nil
+	}
+	return nil, errors.Errorf("el proveedor no tiene la clave %v", kid)
+}
+
+// canjearCodigo obtiene el ID token con el código de autorización y lo
+// valida. Devuelve sus claims.
+func (p *ProveedorExterno) canjearCodigo(codigo, verifier, nonce string) (claims jwt.MapClaims, err error) {
+	d, err := p.descubrir()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {codigo},
+		"redirect_uri":  {p.RedirectURI},
+		"client_id":     {p.ClienteID},
+		"client_secret": {p.ClienteSecreto},
+		"code_verifier": {verifier},
+	}
+	res, err := p.cliente().PostForm(d.TokenEndpoint, form)
+	if err != nil {
+		return nil, errors.Wrap(err, "canjeando código")
+	}
+	defer res.Body.Close()
+	tokens := struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&tokens)
+	if err != nil {
+		return nil, errors.Wrap(err, "leyendo respuesta del proveedor")
+	}
+	if res.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, errors.Errorf("el proveedor rechazó el código: %v %v", res.Status, tokens.Error)
+	}
+
+	return p.validarIDToken(d, tokens.IDToken, nonce)
+}
+
+// validarIDToken controla la firma, el emisor, la audiencia, el vencimiento y
+// el nonce.
+func (p *ProveedorExterno) validarIDToken(d descubrimientoExterno, idToken, nonce string) (claims jwt.MapClaims, err error) {
+	t, err := jwt.Parse(idToken, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, errors.Errorf("método de firma inesperado: %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return p.clave(d, kid)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "ID token inválido")
+	}
+	claims = t.Claims.(jwt.MapClaims)
+
+	if !claims.VerifyIssuer(p.Emisor, true) {
+		return nil, errors.New("el ID token es de otro emisor")
+	}
+	if !audienciaContiene(claims["aud"], p.ClienteID) {
+		return nil, errors.New("el ID token es para otro cliente")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("el ID token no tiene vencimiento")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("el nonce no coincide")
+	}
+	if s, _ := claims["sub"].(string); s == "" {
+		return nil, errors.New("el ID token no tiene sub")
+	}
+	return claims, nil
+}
+
+// audienciaContiene corrobora el claim "aud", que puede ser un string o una
+// lista.
+func audienciaContiene(aud interface{}, clienteID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clienteID
+	case []interface{}:
+		for _, a := range v {
+			if a == clienteID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// volverSeguro devuelve la ruta a la que se vuelve después del ingreso. Sólo
+// se aceptan rutas del mismo sitio.
+func volverSeguro(v string) string {
+	if !strings.HasPrefix(v, "/") || strings.HasPrefix(v, "//") || strings.HasPrefix(v, "/\\") {
+		return "/"
+	}
+	return v
+}
+
+// IngresoExterno manda al usuario a ingresar con el proveedor indicado en el
+// parámetro "proveedor". Con vincular=true, si hay una sesión, la identidad
+// externa se vincula al usuario de la sesión, salvo que sea un administrador
+// suplantándolo. Al terminar se vuelve a la ruta del parámetro "volver".
+func (h *Handler) IngresoExterno() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		qs := r.URL.Query()
+		p, ok := h.proveedorExterno(qs.Get("proveedor"))
+		if !ok {
+			httpErr(w, errors.Errorf("no existe el proveedor %v", qs.Get("proveedor")), http.StatusNotFound)
+			return
+		}
+
+		e := estadoIngresoExterno{Proveedor: p.Nombre, Volver: volverSeguro(qs.Get("volver"))}
+		if qs.Get("vincular") == "true" {
+			usuario, err := h.usuarioSesionPropia(r)
+			if err != nil {
+				httpErr(w, err, codigoSesion(err))
+				return
+			}
+			e.Vincular = usuario.ID
+		}
+
+		d, err := p.descubrir()
+		if err != nil {
+			httpErr(w, err, http.StatusBadGateway)
+			return
+		}
+		for _, v := range []*string{&e.State, &e.Nonce, &e.Verifier} {
+			*v, err = textoAleatorio(32)
+			if err != nil {
+				httpErr(w, err, http.StatusInternalServerError)
+				return
+			}
+		}
+		e.ExpiresAt = time.Now().Add(duracionIngresoExterno).Unix()
+
+		firmado, err := jwt.NewWithClaims(jwt.SigningMethodHS256, e).SignedString(h.claveIngresoExterno())
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "firmando estado"), http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieIngresoExterno,
+			Value:    firmado,
+			Path:     "/",
+			MaxAge:   int(duracionIngresoExterno.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		s := sha256.Sum256([]byte(e.Verifier))
+		q := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {p.ClienteID},
+			"redirect_uri":          {p.RedirectURI},
+			"scope":                 {strings.Join(p.scopes(), " ")},
+			"state":                 {e.State},
+			"nonce":                 {e.Nonce},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(s[:])},
+			"code_challenge_method": {"S256"},
+		}
+		sep := "?"
+		if strings.Contains(d.AuthorizationEndpoint, "?") {
+			sep = "&"
+		}
+		http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+	}
+}
+
+// CallbackExterno es donde vuelve el usuario desde el proveedor. Valida la
+// respuesta, busca el usuario vinculado (o lo vincula o lo crea), inicia la
+// sesión y redirige a la ruta "volver".
+func (h *Handler) CallbackExterno() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// Leo el estado que guardé al salir
+		c, err := r.Cookie(cookieIngresoExterno)
+		if err != nil {
+			httpErr(w, errors.New("no se inició el ingreso externo o venció"), http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: cookieIngresoExterno, Path: "/", MaxAge: -1})
+
+		e := estadoIngresoExterno{}
+		_, err = jwt.ParseWithClaims(c.Value, &e, func(t *jwt.Token) (interface{}, error) {
+			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, errors.Errorf("método de firma inesperado: %v", t.Header["alg"])
+			}
+			return h.claveIngresoExterno(), nil
+		})
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "leyendo estado del ingreso externo"), http.StatusBadRequest)
+			return
+		}
+
+		qs := r.URL.Query()
+		if qs.Get("state") != e.State {
+			httpErr(w, errors.New("el state no coincide"), http.StatusBadRequest)
+			return
+		}
+		if qs.Get("error") != "" {
+			httpErr(w, errors.Errorf("el proveedor respondió %v: %v", qs.Get("error"), qs.Get("error_description")), http.StatusUnauthorized)
+			return
+		}
+
+		p, ok := h.proveedorExterno(e.Proveedor)
+		if !ok {
+			httpErr(w, errors.Errorf("no existe el proveedor %v", e.Proveedor), http.StatusBadRequest)
+			return
+		}
+
+		claims, err := p.canjearCodigo(qs.Get("code"), e.Verifier, e.Nonce)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		usuario, err := h.usuarioExterno(p, claims, e.Vincular, r)
+		if err != nil {
+			httpErr(w, err, codigoHTTP(err, http.StatusUnauthorized))
+			return
+		}
+
+		err = controlarEstado(usuario)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		err = h.iniciarSesion(w, r, usuario)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "iniciando sesión"), codigoHTTP(err, http.StatusInternalServerError))
+			return
+		}
+		http.Redirect(w, r, e.Volver, http.StatusFound)
+	}
+}
+
+// usuarioExterno devuelve el usuario vinculado a la identidad externa. Si no
+// hay ninguno la vincula al usuario vincular, o crea el usuario si el
+// proveedor lo permite.
+func (h *Handler) usuarioExterno(p *ProveedorExterno, claims jwt.MapClaims, vincular string, r *http.Request) (usuario Usuario, err error) {
+	sub, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	email = normalizarLogin(email)
+	verificado, _ := claims["email_verified"].(bool)
+
+	// ¿Ya está vinculada?
+	id := IdentidadExterna{}
+	err = h.db.First(&id, "proveedor = ? AND sujeto = ?", p.Nombre, sub).Error
+	if err == nil {
+		if vincular != "" && vincular != id.UserID {
+			return usuario, errors.New("la cuenta externa ya está vinculada a otro usuario")
+		}
+		usuario, existe, err := h.existeUsuario(id.UserID)
+		if err != nil {
+			return usuario, errors.Wrap(err, "buscando usuario")
+		}
+		if !existe {
+			return usuario, errors.New("el usuario vinculado no existe")
+		}
+		h.db.Model(&id).Update("ultimo_uso", time.Now())
+		return usuario, nil
+	}
+
+	id = IdentidadExterna{Proveedor: p.Nombre, Sujeto: sub, Email: email, UltimoUso: time.Now()}
+
+	// La vinculo al usuario de la sesión
+	if vincular != "" {
+		usuario, existe, err := h.existeUsuario(vincular)
+		if err != nil || !existe {
+			return usuario, errors.New("no se encontró el usuario a vincular")
+		}
+		id.UserID = usuario.ID
+		err = h.db.Create(&id).Error
+		if err != nil {
+			return usuario, errors.Wrap(err, "vinculando cuenta externa")
+		}
+		return usuario, nil
+	}
+
+	// Si existe una cuenta con el mismo mail no la tomo: tiene que ingresar
+	// y vincularla, si no cualquiera con ese mail en el proveedor podría
+	// entrar.
+	if email == "" {
+		return usuario, errors.New("el proveedor no informó el mail")
+	}
+	_, existe, err := h.buscarUsuario(email)
+	if err != nil {
+		return usuario, errors.Wrap(err, "buscando usuario")
+	}
+	if existe {
+		return usuario, ErrAutenticacion{"ya existe una cuenta con ese mail, ingrese y vincule la cuenta externa"}
+	}
+	if !p.CrearUsuarios || h.SoloInvitacion {
+		return usuario, ErrAutenticacion{"la cuenta externa no está vinculada a ningún usuario"}
+	}
+
+	// Alta del usuario
+	uid, _ := uuid.NewV4()
+	usuario.ID = uid.String()
+	usuario.Email = email
+	usuario.Nombre, _ = claims["given_name"].(string)
+	usuario.Apellido, _ = claims["family_name"].(string)
+	if usuario.Nombre == "" {
+		usuario.Nombre, _ = claims["name"].(string)
+	}
+	usuario.UltimaActualizacionContraseña = time.Now()
+	usuario.Estado = EstadoPendienteConfirmación
+	if verificado {
+		usuario.Estado = h.estadoAlConfirmarMail()
+	}
+
+	e := nuevoEvento(EventoUsuarioCreado, usuario, r)
+	e.Datos = map[string]interface{}{"Proveedor": p.Nombre}
+	err = h.validarEvento(e)
+	if err != nil {
+		return usuario, err
+	}
+
+	tx := h.db.Begin()
+	err = tx.Create(&usuario).Error
+	if err != nil {
+		tx.Rollback()
+		return usuario, errors.Wrap(err, "creando usuario")
+	}
+	id.UserID = usuario.ID
+	err = tx.Create(&id).Error
+	if err != nil {
+		tx.Rollback()
+		return usuario, errors.Wrap(err, "vinculando cuenta externa")
+	}
+	conf := UsuarioConfirmacion{UserID: usuario.ID, Motivo: MotivoCreacion}
+	conf.ID, _ = uuid.NewV4()
+	if verificado {
+		conf.Confirmada = true
+		conf.FechaConfirmacion = time.Now()
+	}
+	err = tx.Create(&conf).Error
+	if err != nil {
+		tx.Rollback()
+		return usuario, errors.Wrap(err, "creando confirmación")
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return usuario, errors.Wrap(err, "confirmando transaccion")
+	}
+	h.emitir(e)
+
+	// Si el proveedor no verificó el mail lo tiene que confirmar
+	if !verificado {
+		body, err := h.MailConfirmacionUsuario.body(usuario.Nombre, conf.ID.String())
+		if err != nil {
+			return usuario, errors.Wrap(err, "creando body de mail usuario")
+		}
+		err = h.MailSender.Send(usuario.Email, h.MailSender.SenderAlias(), "Confirmación de usuario", body)
+		if err != nil {
+			h.logf("enviando confirmación a %v: %v", usuario.ID, err)
+		}
+	}
+	return usuario, nil
+}
+
+// DesvincularExterno borra el vínculo del usuario de la sesión con una cuenta
+// externa.
+func (h *Handler) DesvincularExterno() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			Proveedor string
+		}{}
+
+		usuario, err := h.usuarioSesionPropia(r)
+		if err != nil {
+			httpErr(w, err, codigoSesion(err))
+			return
+		}
+
+		err = json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		err = h.db.
+			Where("user_id = ? AND proveedor = ?", usuario.ID, request.Proveedor).
+			Delete(&IdentidadExterna{}).
+			Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "desvinculando cuenta externa"), http.StatusInternalServerError)
+			return
+		}
+	}
+}
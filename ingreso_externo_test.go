@@ -0,0 +1,111 @@
+package sesiones
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngresoExterno(t *testing.T) {
+	clave, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	// El proveedor falso firma los ID tokens como el modo proveedor
+	prov := Handler{}
+	u := Usuario{ID: "sub-1", Email: "ornela@sweet.com.ar", Nombre: "Ornela", Estado: EstadoConfirmado}
+	nonce := "n-0S6"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(descubrimientoExterno{
+			Issuer:                prov.OIDC.Emisor,
+			AuthorizationEndpoint: prov.OIDC.Emisor + "/authorize",
+			TokenEndpoint:         prov.OIDC.Emisor + "/token",
+			JWKSURI:               prov.OIDC.Emisor + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", prov.JWKS())
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "abc" || r.FormValue("code_verifier") != "verifier" || r.FormValue("client_secret") != "secreto" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		id, _ := prov.firmarOIDC(prov.claimsIDToken(u, "cliente", nonce, []string{ScopeOpenID, ScopeEmail}), "JWT")
+		json.NewEncoder(w).Encode(map[string]string{"id_token": id})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	prov.OIDC = &ConfigOIDC{Emisor: srv.URL, Clave: clave}
+
+	p := &ProveedorExterno{Nombre: "falso", Emisor: srv.URL, ClienteID: "cliente", ClienteSecreto: "secreto"}
+	claims, err := p.canjearCodigo("abc", "verifier", nonce)
+	assert.Nil(t, err)
+	assert.Equal(t, "sub-1", claims["sub"])
+	assert.Equal(t, "ornela@sweet.com.ar", claims["email"])
+	assert.Equal(t, true, claims["email_verified"])
+
+	// Código o verifier incorrectos
+	_, err = p.canjearCodigo("abc", "otro", nonce)
+	assert.NotNil(t, err)
+
+	// Nonce de otro ingreso
+	_, err = p.canjearCodigo("abc", "verifier", "otro")
+	assert.NotNil(t, err)
+
+	// Token para otro cliente
+	p2 := &ProveedorExterno{Nombre: "falso", Emisor: srv.URL, ClienteID: "otro", ClienteSecreto: "secreto"}
+	_, err = p2.canjearCodigo("abc", "verifier", nonce)
+	assert.NotNil(t, err)
+
+	// Token firmado con otra clave
+	otra, _ := rsa.GenerateKey(rand.Reader, 2048)
+	falsificador := Handler{OIDC: &ConfigOIDC{Emisor: srv.URL, Clave: otra}}
+	id, _ := falsificador.firmarOIDC(falsificador.claimsIDToken(u, "cliente", nonce, nil), "JWT")
+	d, err := p.descubrir()
+	assert.Nil(t, err)
+	_, err = p.validarIDToken(d, id, nonce)
+	assert.NotNil(t, err)
+}
+
+func TestVolverSeguro(t *testing.T) {
+	assert.Equal(t, "/cuenta?x=1", volverSeguro("/cuenta?x=1"))
+	assert.Equal(t, "/", volverSeguro("https://malo.com"))
+	assert.Equal(t, "/", volverSeguro("//malo.com"))
+	assert.Equal(t, "/", volverSeguro("/\\malo.com"))
+	assert.Equal(t, "/", volverSeguro(""))
+}
+
+func TestReautenticar(t *testing.T) {
+	h := &Handler{}
+	h.secretKey = []byte("secreto")
+	h.DuracionSesion = time.Hour
+
+	sesion := func(ingreso time.Time) *http.Request {
+		token, err := h.newToken("sub-1")
+		assert.Nil(t, err)
+		token.Claims.(jwt.MapClaims)["iat"] = ingreso.Unix()
+		tokenString, err := token.SignedString(h.secretKey)
+		assert.Nil(t, err)
+		r := httptest.NewRequest("POST", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "token", Value: tokenString})
+		return r
+	}
+
+	// Con contraseña propia se controla el hash
+	u := Usuario{ID: "sub-1", Hash: calcularHash("secreta")}
+	assert.Nil(t, h.reautenticar(sesion(time.Now()), u, "secreta"))
+	assert.NotNil(t, h.reautenticar(sesion(time.Now()), u, "otra"))
+
+	// Los que ingresan con un proveedor externo no tienen contraseña: vale
+	// un ingreso reciente
+	u.Hash = ""
+	assert.Nil(t, h.reautenticar(sesion(time.Now()), u, ""))
+	assert.NotNil(t, h.reautenticar(sesion(time.Now().Add(-time.Hour)), u, ""))
+}
@@ -0,0 +1,332 @@
+package sesiones
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// Invitacion es la invitación que le hace un administrador a una persona para
+// que cree su usuario, o para que se una a una organización.
+type Invitacion struct {
+	ID    uuid.UUID
+	Email string
+	// OrganizacionID es la organización a la que se invita. Si está vacío la
+	// invitación es para crear el usuario.
+	OrganizacionID string
+	// Roles son los roles que va a tener el usuario, separados por coma. Si
+	// la invitación es a una organización, son los roles en ella.
+	Roles           string
+	InvitadoPor     string
+	CreatedAt       time.Time
+	Aceptada        bool
+	FechaAceptacion time.Time
+	// UserID es el usuario que se creó al aceptar la invitación.
+	UserID string
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (i Invitacion) TableName() string {
+	return "invitaciones"
+}
+
+// validarPassword corrobora que la contraseña cumpla con las directivas.
+func (h *Handler) validarPassword(pass string) error {
+	if len(pass) < h.PassMinLength {
+		return errors.Wrapf(ErrDirectivaPassword, "la contraseña debe tener al menos %v caracteres", h.PassMinLength)
+	}
+	if h.PassMaxLength > 0 && len(pass) > h.PassMaxLength {
+		return errors.Wrapf(ErrDirectivaPassword, "la contraseña puede tener hasta %v caracteres", h.PassMaxLength)
+	}
+	return nil
+}
+
+// InvitarUsuario le manda una invitación a la dirección de mail ingresada.
+// Sólo lo puede hacer un administrador. Con OrganizacionID la invitación es
+// a esa organización, con Roles en ella; la puede hacer un administrador de
+// la organización y el invitado puede ser un usuario existente.
+func (h *Handler) InvitarUsuario() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			Mail           string
+			Roles          []string
+			OrganizacionID string
+		}{}
+
+		if h.MailInvitacion == nil {
+			httpErr(w, errors.New("no se ingresó template de invitación"), http.StatusNotImplemented)
+			return
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		var admin Usuario
+		var ok bool
+		if request.OrganizacionID == "" {
+			admin, ok = h.exigirRol(w, r, RolAdmin)
+		} else {
+			admin, ok = h.exigirRolOrganizacion(w, r, request.OrganizacionID, RolAdmin)
+		}
+		if !ok {
+			return
+		}
+
+		mail := normalizarLogin(request.Mail)
+		if mail == "" {
+			httpErr(w, errors.New("debe ingresar un mail"), http.StatusBadRequest)
+			return
+		}
+
+		u, existe, err := h.buscarUsuario(mail)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "corroborando existencia del usuario"), http.StatusInternalServerError)
+			return
+		}
+		if existe && request.OrganizacionID == "" {
+			httpErr(w, errors.Errorf("ya existe un usuario con mail %v", mail), http.StatusBadRequest)
+			return
+		}
+		if existe {
+			_, esMiembro, err := h.Miembro(request.OrganizacionID, u.ID)
+			if err != nil {
+				httpErr(w, err, http.StatusInternalServerError)
+				return
+			}
+			if esMiembro {
+				httpErr(w, errors.Errorf("%v ya es miembro de la organización", mail), http.StatusBadRequest)
+				return
+			}
+		}
+
+		inv := Invitacion{}
+		inv.ID, _ = uuid.NewV4()
+		inv.Email = mail
+		inv.OrganizacionID = request.OrganizacionID
+		inv.Roles = strings.Join(request.Roles, ",")
+		inv.InvitadoPor = admin.ID
+		err = h.db.Create(&inv).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "creando invitación"), http.StatusInternalServerError)
+			return
+		}
+
+		body, err := h.MailInvitacion.body(mail, inv.ID.String())
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "generando el body del mail"), http.StatusInternalServerError)
+			return
+		}
+		err = h.MailSender.Send(mail, h.MailSender.SenderAlias(), "Invitación", body)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "enviando la invitación"), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// AceptarInvitacion crea el usuario invitado, ya confirmado y con los roles
+// que le asignó el administrador. Si la invitación es a una organización lo
+// agrega como miembro; si el usuario ya existía tiene que aceptarla con su
+// sesión iniciada y no hace falta el resto de los datos.
+func (h *Handler) AceptarInvitacion() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			ID        uuid.UUID
+			Nombre    string
+			Apellido  string
+			Username  string
+			Pass      string
+			Metadatos Metadatos
+		}{}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		// Busco la invitación
+		inv := Invitacion{}
+		err = h.db.First(&inv, "id = ?", request.ID).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "no se pudo obtener la invitación"), http.StatusBadRequest)
+			return
+		}
+		if inv.Aceptada {
+			httpErr(w, errors.New("la invitación ya fue aceptada"), http.StatusBadRequest)
+			return
+		}
+		if h.DuracionInvitacion > 0 && time.Since(inv.CreatedAt) > h.DuracionInvitacion {
+			httpErr(w, errors.New("la invitación está vencida"), http.StatusBadRequest)
+			return
+		}
+
+		// Usuario existente invitado a una organización
+		if inv.OrganizacionID != "" {
+			existente, existe, err := h.buscarUsuario(inv.Email)
+			if err != nil {
+				httpErr(w, errors.Wrap(err, "corroborando existencia del usuario"), http.StatusInternalServerError)
+				return
+			}
+			if existe {
+				usuario, err := h.usuarioSesion(r)
+				if err != nil {
+					httpErr(w, errors.Wrap(err, "debe iniciar sesión para aceptar la invitación"), http.StatusUnauthorized)
+					return
+				}
+				if usuario.ID != existente.ID {
+					httpErr(w, errors.New("la invitación es para otro usuario"), http.StatusForbidden)
+					return
+				}
+				err = h.unirseOrganizacion(inv, usuario.ID)
+				if err != nil {
+					httpErr(w, err, http.StatusInternalServerError)
+					return
+				}
+				return
+			}
+		}
+
+		// Datos del usuario
+		u := Usuario{}
+		id, _ := uuid.NewV4()
+		u.ID = id.String()
+		u.Email = inv.Email
+		u.Username = normalizarLogin(request.Username)
+		u.Nombre = request.Nombre
+		u.Apellido = request.Apellido
+
+		if u.Nombre == "" {
+			httpErr(w, errors.New("debe ingresar un nombre"), http.StatusBadRequest)
+			return
+		}
+		err = h.validarMetadatos(request.Metadatos, false, true)
+		if err != nil {
+			httpErr(w, err, http.StatusBadRequest)
+			return
+		}
+		u.Metadatos = aplicarMetadatos(nil, request.Metadatos)
+		if strings.Contains(u.Username, "@") {
+			httpErr(w, errors.New("el nombre de usuario no puede contener '@'"), http.StatusBadRequest)
+			return
+		}
+		err = h.validarPassword(request.Pass)
+		if err != nil {
+			httpErr(w, err, http.StatusBadRequest)
+			return
+		}
+
+		// Que no se haya registrado mientras tanto
+		for _, v := range []string{u.Email, u.Username} {
+			if v == "" {
+				continue
+			}
+			_, existe, err := h.buscarUsuario(v)
+			if err != nil {
+				httpErr(w, errors.Wrap(err, "corroborando existencia del usuario"), http.StatusInternalServerError)
+				return
+			}
+			if existe {
+				httpErr(w, errors.Errorf("ya existe el usuario %v", v), http.StatusBadRequest)
+				return
+			}
+		}
+
+		u.Hash = calcularHash(request.Pass)
+		u.UltimaActualizacionContraseña = time.Now()
+		u.Estado = EstadoConfirmado
+
+		inv.Aceptada = true
+		inv.FechaAceptacion = time.Now()
+		inv.UserID = u.ID
+
+		e := nuevoEvento(EventoUsuarioCreado, u, r)
+		err = h.validarEvento(e)
+		if err != nil {
+			httpErr(w, err, http.StatusForbidden)
+			return
+		}
+
+		tx := h.db.Begin()
+
+		err = tx.Create(&u).Error
+		if err != nil {
+			tx.Rollback()
+			httpErr(w, errors.Wrap(err, "persistiendo usuario en base de datos"), http.StatusInternalServerError)
+			return
+		}
+
+		// Los roles de una invitación a una organización son de la organización
+		rolesGlobales := inv.Roles
+		if inv.OrganizacionID != "" {
+			err = h.guardarMiembro(tx, inv.OrganizacionID, u.ID, strings.Split(inv.Roles, ","))
+			if err != nil {
+				tx.Rollback()
+				httpErr(w, err, http.StatusInternalServerError)
+				return
+			}
+			rolesGlobales = ""
+		}
+		for _, rol := range strings.Split(rolesGlobales, ",") {
+			if rol == "" {
+				continue
+			}
+			err = tx.Create(&UsuarioRol{UserID: u.ID, Rol: rol}).Error
+			if err != nil {
+				tx.Rollback()
+				httpErr(w, errors.Wrap(err, "asignando roles"), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		err = tx.Save(&inv).Error
+		if err != nil {
+			tx.Rollback()
+			httpErr(w, errors.Wrap(err, "actualizando invitación"), http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit().Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "confirmando transaccion"), http.StatusInternalServerError)
+			return
+		}
+		h.emitir(e)
+	}
+}
+
+// unirseOrganizacion agrega a un usuario existente a la organización de la
+// invitación y la marca como aceptada.
+func (h *Handler) unirseOrganizacion(inv Invitacion, userID string) (err error) {
+	inv.Aceptada = true
+	inv.FechaAceptacion = time.Now()
+	inv.UserID = userID
+
+	tx := h.db.Begin()
+	err = h.guardarMiembro(tx, inv.OrganizacionID, userID, strings.Split(inv.Roles, ","))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Save(&inv).Error
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "actualizando invitación")
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return errors.Wrap(err, "confirmando transaccion")
+	}
+	return nil
+}
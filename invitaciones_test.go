@@ -0,0 +1,17 @@
+package sesiones
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidarPassword(t *testing.T) {
+	h := Handler{}
+	h.PassMinLength = 6
+	h.PassMaxLength = 10
+
+	assert.NotNil(t, h.validarPassword("corta"))
+	assert.NotNil(t, h.validarPassword("demasiado larga"))
+	assert.Nil(t, h.validarPassword("correcta"))
+}
@@ -1,11 +1,40 @@
 package sesiones
 
-import "github.com/go-mail/mail"
+import (
+	"bytes"
+	netmail "net/mail"
+	"sync"
+
+	"github.com/go-mail/mail"
+	"github.com/pkg/errors"
+)
+
+// defaultMaxConexiones es la cantidad de conexiones SMTP simultáneas que
+// mantiene abiertas el DefaultMailSender si no se indica otra cosa.
+const defaultMaxConexiones = 4
 
 // DefaultMailSender es la implementación estandar del mail sender.
+//
+// Mantiene un pool de conexiones SMTP abiertas que se reutilizan entre envíos.
+// Si una conexión falla (por ejemplo porque el servidor la cerró por
+// inactividad) se descarta, se abre una nueva y se reintenta el envío.
 type DefaultMailSender struct {
 	Dialer      *mail.Dialer
 	senderAlias string
+
+	// MaxConexiones es la cantidad máxima de envíos simultáneos (y de
+	// conexiones abiertas). Se lee en el primer envío, modificarlo luego no
+	// tiene efecto.
+	MaxConexiones int
+
+	// DKIM, si no es nil, firma todos los mensajes salientes.
+	DKIM *DKIMSigner
+
+	init    sync.Once
+	turnos  chan struct{}
+	mu      sync.Mutex
+	libres  []mail.SendCloser
+	cerrado bool
 }
 
 // NewDefaultMailSender creau un MailSender.
@@ -15,6 +44,7 @@ func NewDefaultMailSender(host string, port int, user, pass, senderAlias string)
 	sender = &DefaultMailSender{}
 	sender.Dialer = d
 	sender.senderAlias = senderAlias
+	sender.MaxConexiones = defaultMaxConexiones
 	return
 }
 
@@ -26,8 +56,109 @@ func (d *DefaultMailSender) Send(to, from, subject, body string) (err error) {
 	m.SetHeader("Subject", subject)
 	m.SetBody("text/html", body)
 
-	// Send the email to
-	err = d.Dialer.DialAndSend(m)
+	// Armo el mensaje y si corresponde lo firmo
+	buf := &bytes.Buffer{}
+	_, err = m.WriteTo(buf)
+	if err != nil {
+		return errors.Wrap(err, "armando mensaje")
+	}
+	mensaje := buf.Bytes()
+	if d.DKIM != nil {
+		mensaje, err = d.DKIM.firmar(mensaje)
+		if err != nil {
+			return errors.Wrap(err, "firmando DKIM")
+		}
+	}
+
+	return d.enviar(direccionSobre(from), []string{direccionSobre(to)}, mensaje)
+}
+
+// direccionSobre devuelve la dirección de "Nombre <direccion>" para el sobre
+// SMTP. Si no se puede parsear, por ejemplo un alias que es sólo la
+// dirección o un nombre, se usa tal cual, como antes.
+func direccionSobre(s string) string {
+	a, err := netmail.ParseAddress(s)
+	if err != nil {
+		return s
+	}
+	return a.Address
+}
+
+// enviar manda el mensaje usando una conexión del pool.
+func (d *DefaultMailSender) enviar(from string, to []string, mensaje []byte) (err error) {
+	d.init.Do(func() {
+		n := d.MaxConexiones
+		if n <= 0 {
+			n = 1
+		}
+		d.turnos = make(chan struct{}, n)
+	})
+
+	// Espero turno
+	d.turnos <- struct{}{}
+	defer func() { <-d.turnos }()
+
+	conn, err := d.tomarConexion()
+	if err != nil {
+		return errors.Wrap(err, "conectando al servidor SMTP")
+	}
+
+	err = conn.Send(from, to, bytes.NewReader(mensaje))
+	if err != nil {
+		// La conexión puede estar muerta, pruebo con una nueva
+		conn.Close()
+		conn, err = d.Dialer.Dial()
+		if err != nil {
+			return errors.Wrap(err, "reconectando al servidor SMTP")
+		}
+		err = conn.Send(from, to, bytes.NewReader(mensaje))
+		if err != nil {
+			conn.Close()
+			return errors.Wrap(err, "enviando mail")
+		}
+	}
+
+	d.devolverConexion(conn)
+	return nil
+}
+
+// tomarConexion devuelve una conexión libre del pool o abre una nueva.
+func (d *DefaultMailSender) tomarConexion() (mail.SendCloser, error) {
+	d.mu.Lock()
+	if n := len(d.libres); n > 0 {
+		conn := d.libres[n-1]
+		d.libres = d.libres[:n-1]
+		d.mu.Unlock()
+		return conn, nil
+	}
+	d.mu.Unlock()
+
+	return d.Dialer.Dial()
+}
+
+// devolverConexion deja la conexión disponible para el próximo envío.
+func (d *DefaultMailSender) devolverConexion(conn mail.SendCloser) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cerrado {
+		conn.Close()
+		return
+	}
+	d.libres = append(d.libres, conn)
+}
+
+// Close cierra las conexiones abiertas. Los envíos posteriores abren
+// conexiones nuevas que se cierran al terminar.
+func (d *DefaultMailSender) Close() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cerrado = true
+	for _, v := range d.libres {
+		if e := v.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	d.libres = nil
 	return
 }
 
@@ -0,0 +1,160 @@
+package sesiones
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// smtpFalso es un servidor SMTP mínimo que guarda los mensajes recibidos.
+type smtpFalso struct {
+	ln         net.Listener
+	mu         sync.Mutex
+	conexiones int
+	mensajes   []string
+}
+
+func nuevoSMTPFalso(t *testing.T) *smtpFalso {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &smtpFalso{ln: ln}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conexiones++
+			s.mu.Unlock()
+			go s.atender(c)
+		}
+	}()
+	return s
+}
+
+func (s *smtpFalso) atender(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	c.Write([]byte("220 localhost ESMTP\r\n"))
+	for {
+		linea, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(linea))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			c.Write([]byte("250 localhost\r\n"))
+		case strings.HasPrefix(cmd, "DATA"):
+			c.Write([]byte("354 adelante\r\n"))
+			msj := &strings.Builder{}
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msj.WriteString(l)
+			}
+			s.mu.Lock()
+			s.mensajes = append(s.mensajes, msj.String())
+			s.mu.Unlock()
+			c.Write([]byte("250 ok\r\n"))
+		case strings.HasPrefix(cmd, "QUIT"):
+			c.Write([]byte("221 chau\r\n"))
+			return
+		default:
+			c.Write([]byte("250 ok\r\n"))
+		}
+	}
+}
+
+func (s *smtpFalso) sender() *DefaultMailSender {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return NewDefaultMailSender("127.0.0.1", addr.Port, "", "", "Sweet <no-reply@sweet.com.ar>")
+}
+
+func TestMailSenderReutilizaConexion(t *testing.T) {
+	srv := nuevoSMTPFalso(t)
+	defer srv.ln.Close()
+
+	s := srv.sender()
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		err := s.Send("ornela@sweet.com.ar", s.SenderAlias(), "Prueba", "<p>hola</p>")
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, 1, srv.conexiones)
+	assert.Len(t, srv.mensajes, 3)
+}
+
+func TestMailSenderDKIM(t *testing.T) {
+	srv := nuevoSMTPFalso(t)
+	defer srv.ln.Close()
+
+	clave, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(t, err)
+	clavePEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(clave)})
+
+	s := srv.sender()
+	defer s.Close()
+	s.DKIM, err = NewDKIMSigner("sweet.com.ar", "mail", clavePEM)
+	assert.Nil(t, err)
+
+	err = s.Send("ornela@sweet.com.ar", s.SenderAlias(), "Prueba", "<p>hola</p>")
+	assert.Nil(t, err)
+	assert.Len(t, srv.mensajes, 1)
+
+	// Verifico la firma con la clave pública
+	headers, body := separarMensaje([]byte(srv.mensajes[0]))
+	assert.True(t, strings.HasPrefix(headers[0], "DKIM-Signature:"))
+	dkim := headers[0]
+	assert.Contains(t, dkim, "d=sweet.com.ar; s=mail;")
+
+	bh := sha256.Sum256(canonicalizarBodyRelaxed(body))
+	assert.Contains(t, dkim, "bh="+base64.StdEncoding.EncodeToString(bh[:]))
+
+	i := strings.LastIndex(dkim, "b=")
+	firma, err := base64.StdEncoding.DecodeString(dkim[i+2:])
+	assert.Nil(t, err)
+
+	hasher := sha256.New()
+	for _, nombre := range []string{"from", "to", "subject", "date", "mime-version", "content-type"} {
+		for _, h := range headers[1:] {
+			if strings.HasPrefix(strings.ToLower(h), nombre+":") {
+				hasher.Write([]byte(canonicalizarHeaderRelaxed(h) + "\r\n"))
+			}
+		}
+	}
+	hasher.Write([]byte(canonicalizarHeaderRelaxed(dkim[:i+2])))
+	err = rsa.VerifyPKCS1v15(&clave.PublicKey, crypto.SHA256, hasher.Sum(nil), firma)
+	assert.Nil(t, err)
+}
+
+func TestCanonicalizacionRelaxed(t *testing.T) {
+	assert.Equal(t, "subject:Hola que tal", canonicalizarHeaderRelaxed("SubJect :  Hola\r\n \tque  tal "))
+	assert.Equal(t, " a b\r\nc\r\n", string(canonicalizarBodyRelaxed([]byte("  a \t b  \r\nc\r\n\r\n\r\n"))))
+	assert.Nil(t, canonicalizarBodyRelaxed([]byte("\r\n\r\n")))
+}
+
+func TestDireccionSobre(t *testing.T) {
+	assert.Equal(t, "no-responder@sweet.com", direccionSobre("Sweet <no-responder@sweet.com>"))
+	assert.Equal(t, "no-responder@sweet.com", direccionSobre("no-responder@sweet.com"))
+	// Los alias que no son una dirección se mandan como estaban
+	assert.Equal(t, "Sweet", direccionSobre("Sweet"))
+}
@@ -3,6 +3,8 @@ package sesiones
 import (
 	"bytes"
 	"html/template"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -36,16 +38,52 @@ func NewMailTemplate(t, frontEndPath string) (mt *MailTemplate, err error) {
 	return
 }
 
+// templateHermano crea un template cuyo link va a la ruta indicada del mismo
+// front end que el de base. Por ejemplo, con base en
+// www.sweet.com.ar/#/auth/blanquear y ruta "no_fui_yo" el link es
+// www.sweet.com.ar/#/auth/no_fui_yo.
+func templateHermano(base *MailTemplate, t, ruta string) (mt *MailTemplate, err error) {
+	dir := ""
+	if i := strings.LastIndex(base.frontEndPath, "/"); i >= 0 {
+		dir = base.frontEndPath[:i]
+	}
+	return NewMailTemplate(t, dir+"/"+ruta)
+}
+
 func (mt *MailTemplate) body(nombre, idConfirmacion string) (html string, err error) {
+	return mt.bodyAviso(nombre, idConfirmacion, datosAviso{})
+}
+
+// datosAviso son los datos adicionales que pueden usar los templates de los
+// avisos de seguridad, además de Nombre y URLConfirmacion.
+type datosAviso struct {
+	Fecha     time.Time
+	IP        string
+	UserAgent string
+	MailNuevo string
+	// Vencimiento es la fecha en que caduca la contraseña
+	Vencimiento time.Time
+	// Motivo es el motivo que ingresó el administrador, por ejemplo al
+	// rechazar una cuenta.
+	Motivo string
+	// Password es la contraseña temporal generada por un administrador
+	Password string
+}
+
+// bodyAviso genera el HTML incluyendo los datos del aviso. En los avisos de
+// seguridad URLConfirmacion es el link de "no fui yo".
+func (mt *MailTemplate) bodyAviso(nombre, idConfirmacion string, aviso datosAviso) (html string, err error) {
 
 	url := mt.frontEndPath + "/?id=" + idConfirmacion
 
 	datos := struct {
 		Nombre          string
 		URLConfirmacion string
+		datosAviso
 	}{
 		Nombre:          nombre,
 		URLConfirmacion: url,
+		datosAviso:      aviso,
 	}
 
 	out := &bytes.Buffer{}
@@ -149,3 +187,85 @@ var defaultConfirmacionUsuarioTemplate = `
 </body>
 </html>
 `
+
+var defaultAvisoCambioContraseñaTemplate = `
+<!DOCTYPE html>
+<html>
+
+<body>
+    <div id='main'>
+        <p> Hola {{ .Nombre }}!</p>
+        <p>
+            Te avisamos que el {{ .Fecha.Format "02/01/2006 15:04" }} se cambió la contraseña de tu cuenta.
+        </p>
+
+        <p id="rechazar">
+            Si no fuiste tú, haz clic <a href='{{ .URLConfirmacion }}'>AQUÍ</a> para cerrar todas las sesiones
+            y bloquear la cuenta hasta que blanquees la contraseña.
+        </p>
+    </div>
+</body>
+</html>
+`
+
+var defaultAvisoNuevoDispositivoTemplate = `
+<!DOCTYPE html>
+<html>
+
+<body>
+    <div id='main'>
+        <p> Hola {{ .Nombre }}!</p>
+        <p>
+            El {{ .Fecha.Format "02/01/2006 15:04" }} se ingresó a tu cuenta desde un dispositivo que no
+            reconocemos.
+        </p>
+        <p>
+            IP: {{ .IP }}<br>
+            Navegador: {{ .UserAgent }}
+        </p>
+
+        <p id="rechazar">
+            Si no fuiste tú, haz clic <a href='{{ .URLConfirmacion }}'>AQUÍ</a> para cerrar todas las sesiones
+            y bloquear la cuenta hasta que blanquees la contraseña.
+        </p>
+    </div>
+</body>
+</html>
+`
+
+var defaultAvisoCambioMailTemplate = `
+<!DOCTYPE html>
+<html>
+
+<body>
+    <div id='main'>
+        <p> Hola {{ .Nombre }}!</p>
+        <p>
+            Te avisamos que el {{ .Fecha.Format "02/01/2006 15:04" }} se solicitó cambiar la dirección de
+            correo electrónico de tu cuenta a {{ .MailNuevo }}.
+        </p>
+
+        <p id="rechazar">
+            Si no fuiste tú, haz clic <a href='{{ .URLConfirmacion }}'>AQUÍ</a> para cerrar todas las sesiones
+            y bloquear la cuenta hasta que blanquees la contraseña.
+        </p>
+    </div>
+</body>
+</html>
+`
+
+var defaultAvisoVencimientoTemplate = `
+<!DOCTYPE html>
+<html>
+
+<body>
+    <div id='main'>
+        <p> Hola {{ .Nombre }}!</p>
+        <p>
+            Tu contraseña vence el {{ .Vencimiento.Format "02/01/2006" }}. Para cambiarla haz clic
+            <a href='{{ .URLConfirmacion }}'>AQUÍ</a>.
+        </p>
+    </div>
+</body>
+</html>
+`
@@ -2,6 +2,7 @@ package sesiones
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -20,3 +21,20 @@ func TestTemplates(t *testing.T) {
 	assert.True(t, len(html) > 300)
 
 }
+
+func TestTemplateAviso(t *testing.T) {
+
+	tpl, err := NewMailTemplate(defaultAvisoNuevoDispositivoTemplate, "www.sweet.com.ar/#/auth/no_fui_yo")
+	assert.Nil(t, err)
+
+	html, err := tpl.bodyAviso("Ornelita", "51651651651651651", datosAviso{
+		Fecha:     time.Date(2019, 7, 10, 15, 30, 0, 0, time.UTC),
+		IP:        "190.2.3.4",
+		UserAgent: "Firefox",
+	})
+	assert.Nil(t, err)
+
+	assert.Contains(t, html, "10/07/2019 15:30")
+	assert.Contains(t, html, "190.2.3.4")
+	assert.Contains(t, html, "www.sweet.com.ar/#/auth/no_fui_yo/?id=51651651651651651")
+}
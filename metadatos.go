@@ -0,0 +1,311 @@
+package sesiones
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofrs/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Tipos de los atributos de los usuarios
+const (
+	TipoTexto    = "texto"
+	TipoNumero   = "numero"
+	TipoBooleano = "booleano"
+	// TipoFecha es un string en formato RFC 3339
+	TipoFecha = "fecha"
+)
+
+// claimMetadatos es el claim del JWT donde van los atributos con EnToken.
+const claimMetadatos = "meta"
+
+// Metadatos son los atributos propios de cada aplicación que tiene un
+// usuario. Se persisten como JSON.
+type Metadatos map[string]interface{}
+
+// Value implementa driver.Valuer
+func (m Metadatos) Value() (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "serializando metadatos")
+	}
+	return string(b), nil
+}
+
+// Scan implementa sql.Scanner
+func (m *Metadatos) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*m = Metadatos{}
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return errors.Errorf("no se pueden leer metadatos de %T", src)
+	}
+	if len(b) == 0 {
+		*m = Metadatos{}
+		return nil
+	}
+	return json.Unmarshal(b, m)
+}
+
+// AtributoUsuario es la definición de un atributo de los usuarios. Los
+// atributos que acepta el package se registran en Handler.Atributos.
+type AtributoUsuario struct {
+	Nombre string
+	Tipo   string
+	// Requerido no permite crear usuarios sin este atributo ni borrarlo.
+	// Si no es EditablePorUsuario sólo se exige cuando lo carga un
+	// administrador.
+	Requerido bool
+	// EditablePorUsuario permite que el usuario lo cargue al registrarse y lo
+	// modifique desde su perfil. Si es false sólo lo puede modificar un
+	// administrador.
+	EditablePorUsuario bool
+	// EnToken agrega el atributo a los claims del JWT, dentro de "meta".
+	EnToken bool
+}
+
+// atributo devuelve la definición del atributo.
+func (h *Handler) atributo(nombre string) (a AtributoUsuario, ok bool) {
+	for _, v := range h.Atributos {
+		if v.Nombre == nombre {
+			return v, true
+		}
+	}
+	return a, false
+}
+
+// validarMetadatos controla que los cambios respeten el esquema. cambios
+// tiene sólo los atributos que se modifican; un valor null borra el
+// atributo. Si alta es true se controla que estén los requeridos.
+func (h *Handler) validarMetadatos(cambios Metadatos, admin, alta bool) error {
+	for k, v := range cambios {
+		a, ok := h.atributo(k)
+		if !ok {
+			return errors.Errorf("no existe el atributo %v", k)
+		}
+		if !admin && !a.EditablePorUsuario {
+			return errors.Errorf("el atributo %v sólo lo puede modificar un administrador", k)
+		}
+		if v == nil {
+			if a.Requerido {
+				return errors.Errorf("el atributo %v es requerido", k)
+			}
+			continue
+		}
+		err := validarTipo(a.Tipo, v)
+		if err != nil {
+			return errors.Wrapf(err, "atributo %v", k)
+		}
+	}
+
+	if alta {
+		for _, a := range h.Atributos {
+			if !a.Requerido || (!admin && !a.EditablePorUsuario) {
+				continue
+			}
+			if cambios[a.Nombre] == nil {
+				return errors.Errorf("el atributo %v es requerido", a.Nombre)
+			}
+		}
+	}
+	return nil
+}
+
+// validarTipo controla que el valor, tal como queda después de leerlo de un
+// JSON, sea del tipo indicado.
+func validarTipo(tipo string, v interface{}) error {
+	switch tipo {
+	case TipoTexto:
+		if _, ok := v.(string); ok {
+			return nil
+		}
+	case TipoNumero:
+		if _, ok := v.(float64); ok {
+			return nil
+		}
+	case TipoBooleano:
+		if _, ok := v.(bool); ok {
+			return nil
+		}
+	case TipoFecha:
+		if s, ok := v.(string); ok {
+			_, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return errors.Errorf("fecha inválida: %v", s)
+			}
+			return nil
+		}
+	default:
+		return errors.Errorf("tipo desconocido %v", tipo)
+	}
+	return errors.Errorf("se esperaba un valor de tipo %v", tipo)
+}
+
+// aplicarMetadatos devuelve una copia de los metadatos actuales con los
+// cambios.
+func aplicarMetadatos(actual, cambios Metadatos) Metadatos {
+	m := Metadatos{}
+	for k, v := range actual {
+		m[k] = v
+	}
+	for k, v := range cambios {
+		if v == nil {
+			delete(m, k)
+			continue
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// ActualizarMetadatos modifica los atributos del usuario y registra cada
+// cambio en el historial del perfil. admin indica si el cambio lo hace un
+// administrador; por es el ID de quien lo hace.
+func (h *Handler) ActualizarMetadatos(userID string, cambios Metadatos, admin bool, por string) (usuario Usuario, err error) {
+	err = h.validarMetadatos(cambios, admin, false)
+	if err != nil {
+		return usuario, err
+	}
+
+	usuario, existe, err := h.existeUsuario(userID)
+	if err != nil {
+		return usuario, errors.Wrap(err, "buscando usuario")
+	}
+	if !existe {
+		return usuario, errors.Errorf("no existe el usuario %v", userID)
+	}
+
+	tx := h.db.Begin()
+	err = guardarMetadatos(tx, &usuario, cambios, por)
+	if err != nil {
+		tx.Rollback()
+		return usuario, err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return usuario, errors.Wrap(err, "confirmando transaccion")
+	}
+	return usuario, nil
+}
+
+// guardarMetadatos aplica los cambios a los atributos del usuario, los guarda
+// y registra cada uno en el historial del perfil. Los cambios ya tienen que
+// estar validados.
+func guardarMetadatos(tx *gorm.DB, usuario *Usuario, cambios Metadatos, por string) (err error) {
+
+	// Registro los atributos que cambian, en orden para que el historial sea
+	// estable
+	claves := []string{}
+	for k := range cambios {
+		claves = append(claves, k)
+	}
+	sort.Strings(claves)
+
+	registros := []UsuarioCambioPerfil{}
+	for _, k := range claves {
+		anterior, nuevo := valorAuditoria(usuario.Metadatos[k]), valorAuditoria(cambios[k])
+		if anterior == nuevo {
+			continue
+		}
+		c := UsuarioCambioPerfil{UserID: usuario.ID, Campo: "Metadatos." + k, Anterior: anterior, Nuevo: nuevo, Por: por}
+		c.ID, _ = uuid.NewV4()
+		registros = append(registros, c)
+	}
+	if len(registros) == 0 {
+		return nil
+	}
+	usuario.Metadatos = aplicarMetadatos(usuario.Metadatos, cambios)
+
+	err = tx.Model(&Usuario{}).Where("id = ?", usuario.ID).Update("Metadatos", usuario.Metadatos).Error
+	if err != nil {
+		return errors.Wrap(err, "actualizando metadatos")
+	}
+	for i := range registros {
+		err = tx.Create(&registros[i]).Error
+		if err != nil {
+			return errors.Wrap(err, "registrando cambio de metadatos")
+		}
+	}
+	return nil
+}
+
+// valorAuditoria es como se guarda un valor de metadatos en el historial.
+func valorAuditoria(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// agregarMetadatosToken pega en el token los atributos del usuario que
+// tienen EnToken. Reemplaza los que tuviera el token.
+func (h *Handler) agregarMetadatosToken(token *jwt.Token, usuario Usuario) {
+	delete(token.Claims.(jwt.MapClaims), claimMetadatos)
+	meta := map[string]interface{}{}
+	for _, a := range h.Atributos {
+		if v, ok := usuario.Metadatos[a.Nombre]; ok && a.EnToken {
+			meta[a.Nombre] = v
+		}
+	}
+	if len(meta) > 0 {
+		token.Claims.(jwt.MapClaims)[claimMetadatos] = meta
+	}
+}
+
+// EditarMetadatos modifica los atributos de cualquier usuario, incluidos los
+// que no son editables por el usuario. Sólo lo puede hacer un administrador.
+func (h *Handler) EditarMetadatos() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			UserID    string
+			Metadatos Metadatos
+		}{}
+
+		admin, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		err = h.validarMetadatos(request.Metadatos, true, false)
+		if err != nil {
+			httpErr(w, err, http.StatusBadRequest)
+			return
+		}
+
+		usuario, err := h.ActualizarMetadatos(request.UserID, request.Metadatos, true, admin.ID)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usuario)
+	}
+}
@@ -0,0 +1,49 @@
+package sesiones
+
+import (
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadatos(t *testing.T) {
+	h := Handler{}
+	h.Atributos = []AtributoUsuario{
+		{Nombre: "area", Tipo: TipoTexto, Requerido: true, EditablePorUsuario: true, EnToken: true},
+		{Nombre: "cliente", Tipo: TipoNumero},
+	}
+
+	assert.Nil(t, h.validarMetadatos(Metadatos{"area": "ventas"}, false, true))
+	assert.NotNil(t, h.validarMetadatos(Metadatos{}, false, true), "falta requerido")
+	assert.NotNil(t, h.validarMetadatos(Metadatos{"area": 3.0}, false, false), "tipo")
+	assert.NotNil(t, h.validarMetadatos(Metadatos{"cliente": 3.0}, false, false), "sólo admin")
+	assert.Nil(t, h.validarMetadatos(Metadatos{"cliente": 3.0}, true, false))
+	assert.NotNil(t, h.validarMetadatos(Metadatos{"otro": "x"}, true, false), "no existe")
+	assert.NotNil(t, h.validarMetadatos(Metadatos{"area": nil}, true, false), "borrar requerido")
+
+	m := aplicarMetadatos(Metadatos{"area": "ventas", "cliente": 3.0}, Metadatos{"cliente": nil})
+	assert.Equal(t, Metadatos{"area": "ventas"}, m)
+
+	// Sin cambios no se toca la base
+	u := Usuario{ID: "marcos", Metadatos: Metadatos{"area": "ventas"}}
+	assert.Nil(t, guardarMetadatos(nil, &u, Metadatos{"area": "ventas"}, "marcos"))
+
+	token, err := h.newToken("marcos")
+	assert.Nil(t, err)
+	h.agregarMetadatosToken(token, Usuario{Metadatos: Metadatos{"area": "ventas", "cliente": 3.0}})
+	assert.Equal(t, map[string]interface{}{"area": "ventas"}, token.Claims.(jwt.MapClaims)[claimMetadatos])
+
+	// Al renovar no se arrastran los atributos viejos
+	renovado, err := h.renovarToken(token.Claims.(jwt.MapClaims))
+	assert.Nil(t, err)
+	assert.Nil(t, renovado.Claims.(jwt.MapClaims)[claimMetadatos])
+	h.agregarMetadatosToken(token, Usuario{})
+	assert.Nil(t, token.Claims.(jwt.MapClaims)[claimMetadatos])
+
+	v, err := m.Value()
+	assert.Nil(t, err)
+	leido := Metadatos{}
+	assert.Nil(t, leido.Scan(v))
+	assert.Equal(t, m, leido)
+}
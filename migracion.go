@@ -0,0 +1,181 @@
+package sesiones
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// indiceEmail es el índice único sobre usuarios.email
+const indiceEmail = "idx_usuarios_email"
+
+// indiceUsername es el índice único sobre usuarios.username. Excluye los
+// vacíos porque la mayoría de los usuarios no tienen nombre de usuario.
+const indiceUsername = "idx_usuarios_username"
+
+// Migrar crea o actualiza las tablas del package.
+//
+// Además migra los usuarios creados cuando el ID era la dirección de mail:
+// a cada uno le asigna un UUID como ID y pasa el mail (normalizado) al campo
+// Email. alMigrar, si no es nil, se llama dentro de la misma transacción para
+// que la aplicación actualice sus propias claves foráneas; si devuelve error
+// la migración de ese usuario se deshace.
+//
+// Si dos usuarios quedarían con el mismo mail normalizado (por ejemplo
+// "A@x.com" y "a@x.com") no se migra ninguno y se devuelve el error con los
+// IDs en conflicto, para que se resuelvan a mano.
+func (h *Handler) Migrar(alMigrar func(tx *gorm.DB, idAnterior, idNuevo string) error) (err error) {
+
+	err = h.db.AutoMigrate(
+		&Usuario{},
+		&UsuarioConfirmacion{},
+		&UsuarioDispositivo{},
+		&UsuarioRol{},
+		&Invitacion{},
+		&UsuarioCambioEstado{},
+		&UsuarioCambioPerfil{},
+		&Webhook{},
+		&EntregaWebhook{},
+		&IntentoWebhook{},
+		&ClienteOIDC{},
+		&ConsentimientoOIDC{},
+		&CodigoOIDC{},
+		&AutorizacionDispositivo{},
+		&IdentidadExterna{},
+		&ClaveAPI{},
+		&Organizacion{},
+		&MiembroOrganizacion{},
+		&Suplantacion{},
+	).Error
+	if err != nil {
+		return errors.Wrap(err, "migrando tablas")
+	}
+
+	// Usuarios viejos
+	usuarios := []Usuario{}
+	err = h.db.Where("email = '' OR email IS NULL").Find(&usuarios).Error
+	if err != nil {
+		return errors.Wrap(err, "buscando usuarios a migrar")
+	}
+	if len(usuarios) > 0 {
+		existentes := []string{}
+		err = h.db.Model(&Usuario{}).Where("email <> ''").Pluck("email", &existentes).Error
+		if err != nil {
+			return errors.Wrap(err, "buscando mails existentes")
+		}
+		colisiones := colisionesMigracion(existentes, usuarios)
+		if len(colisiones) > 0 {
+			return errors.Errorf("hay usuarios que quedarían con el mismo mail, no se migró ninguno: %v", strings.Join(colisiones, "; "))
+		}
+	}
+	for _, u := range usuarios {
+		err = h.migrarUsuario(u, alMigrar)
+		if err != nil {
+			return errors.Wrapf(err, "migrando usuario %v", u.ID)
+		}
+	}
+
+	// Recién ahora que todos tienen mail puedo crear el índice
+	tabla := h.db.NewScope(&Usuario{}).TableName()
+	if !h.db.Dialect().HasIndex(tabla, indiceEmail) {
+		err = h.db.Model(&Usuario{}).AddUniqueIndex(indiceEmail, "email").Error
+		if err != nil {
+			return errors.Wrap(err, "creando índice de email")
+		}
+	}
+	if !h.db.Dialect().HasIndex(tabla, indiceUsername) {
+		err = h.db.Exec(sqlIndiceUsername(h.db.Dialect(), tabla)).Error
+		if err != nil {
+			return errors.Wrap(err, "creando índice de nombre de usuario")
+		}
+	}
+
+	return nil
+}
+
+// colisionesMigracion devuelve los mails que quedarían repetidos al migrar los
+// usuarios, con los IDs que los comparten. existentes son los mails de los
+// usuarios que ya estaban migrados.
+func colisionesMigracion(existentes []string, usuarios []Usuario) (out []string) {
+	ids := map[string][]string{}
+	orden := []string{}
+	agregar := func(mail, id string) {
+		if _, ok := ids[mail]; !ok {
+			orden = append(orden, mail)
+		}
+		ids[mail] = append(ids[mail], id)
+	}
+	for _, v := range existentes {
+		agregar(normalizarLogin(v), v)
+	}
+	for _, v := range usuarios {
+		agregar(normalizarLogin(v.ID), v.ID)
+	}
+
+	for _, v := range orden {
+		if len(ids[v]) > 1 {
+			out = append(out, fmt.Sprintf("%v (%v)", v, strings.Join(ids[v], ", ")))
+		}
+	}
+	return
+}
+
+// sqlIndiceUsername devuelve el CREATE INDEX del índice de nombre de usuario.
+// MySQL no tiene índices parciales: indexa el username con NULLIF, que da NULL
+// para los vacíos, y los NULL no chocan en un índice único (MySQL 8.0.13+).
+func sqlIndiceUsername(d gorm.Dialect, tabla string) string {
+	if d.GetName() == "mysql" {
+		return fmt.Sprintf(
+			"CREATE UNIQUE INDEX %v ON %v ((NULLIF(username, '')))",
+			d.Quote(indiceUsername), d.Quote(tabla),
+		)
+	}
+	return fmt.Sprintf(
+		"CREATE UNIQUE INDEX %v ON %v (username) WHERE username <> ''",
+		d.Quote(indiceUsername), d.Quote(tabla),
+	)
+}
+
+// migrarUsuario le cambia el ID a un usuario cuyo ID era el mail.
+func (h *Handler) migrarUsuario(u Usuario, alMigrar func(tx *gorm.DB, idAnterior, idNuevo string) error) (err error) {
+	id, _ := uuid.NewV4()
+	nuevo := id.String()
+
+	tx := h.db.Begin()
+
+	err = tx.
+		Model(&Usuario{}).
+		Where("id = ?", u.ID).
+		Update(map[string]interface{}{"id": nuevo, "email": normalizarLogin(u.ID)}).
+		Error
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "actualizando usuario")
+	}
+
+	// Registros relacionados
+	for _, v := range []interface{}{&UsuarioConfirmacion{}, &UsuarioDispositivo{}, &UsuarioRol{}, &UsuarioCambioEstado{}} {
+		err = tx.
+			Model(v).
+			Where("user_id = ?", u.ID).
+			Update(map[string]interface{}{"user_id": nuevo}).
+			Error
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "actualizando registros del usuario")
+		}
+	}
+
+	if alMigrar != nil {
+		err = alMigrar(tx, u.ID, nuevo)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "migrando datos de la aplicación")
+		}
+	}
+
+	return tx.Commit().Error
+}
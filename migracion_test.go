@@ -0,0 +1,43 @@
+package sesiones
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestColisionesMigracion(t *testing.T) {
+	cases := []struct {
+		nombre     string
+		existentes []string
+		usuarios   []string
+		esperado   []string
+	}{
+		{"sin colisiones", []string{"a@x.com"}, []string{"b@x.com", "c@x.com"}, nil},
+		{"mayúsculas", nil, []string{"A@x.com", "a@x.com"}, []string{"a@x.com (A@x.com, a@x.com)"}},
+		{"contra existente", []string{"a@x.com"}, []string{" A@X.com"}, []string{"a@x.com (a@x.com,  A@X.com)"}},
+		{"NFC", nil, []string{"jos\u00e9@x.com", "jose\u0301@x.com"}, []string{"jos\u00e9@x.com (jos\u00e9@x.com, jose\u0301@x.com)"}},
+	}
+	for _, c := range cases {
+		usuarios := []Usuario{}
+		for _, v := range c.usuarios {
+			usuarios = append(usuarios, Usuario{ID: v})
+		}
+		assert.Equal(t, c.esperado, colisionesMigracion(c.existentes, usuarios), c.nombre)
+	}
+}
+
+func TestSQLIndiceUsername(t *testing.T) {
+	mysql, _ := gorm.GetDialect("mysql")
+	assert.Equal(t,
+		"CREATE UNIQUE INDEX `idx_usuarios_username` ON `usuarios` ((NULLIF(username, '')))",
+		sqlIndiceUsername(mysql, "usuarios"),
+	)
+
+	postgres, _ := gorm.GetDialect("postgres")
+	assert.Equal(t,
+		`CREATE UNIQUE INDEX "idx_usuarios_username" ON "usuarios" (username) WHERE username <> ''`,
+		sqlIndiceUsername(postgres, "usuarios"),
+	)
+}
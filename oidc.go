@@ -0,0 +1,636 @@
+package sesiones
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// Scopes que entiende el proveedor OIDC
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+	ScopePhone   = "phone"
+)
+
+var scopesOIDC = []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopePhone}
+
+// ConfigOIDC habilita el modo proveedor de OpenID Connect.
+type ConfigOIDC struct {
+	// Emisor es la URL pública del Handler, por ejemplo
+	// "https://auth.empresa.com/sesiones". Va en el claim "iss" y de ella
+	// salen las URL de los endpoints.
+	Emisor string
+	// Clave firma los tokens con RS256. La pública se publica en "jwks".
+	Clave *rsa.PrivateKey
+	// PaginaLogin es la página del front end donde el usuario ingresa
+	// (con Login). Recibe en el parámetro "volver" la URL a la que tiene que
+	// ir después.
+	PaginaLogin string
+	// PaginaConsentimiento es la página del front end que le pregunta al
+	// usuario si autoriza al cliente. Recibe "cliente", "scope" y "volver", y
+	// llama a "consentimiento_oidc".
+	PaginaConsentimiento string
+	// DuracionCodigo es la validez del código de autorización (1 minuto si
+	// es cero) y DuracionToken la del access token y el ID token (1 hora si
+	// es cero).
+	DuracionCodigo time.Duration
+	DuracionToken  time.Duration
+	// PaginaDispositivo es la página del front end donde el usuario ingresa
+	// el código que le muestra un dispositivo (verification_uri de RFC
+	// 8628). Recibe el código en el parámetro "codigo" y llama a
+	// "verificar_dispositivo". DuracionDispositivo es la validez del código
+	// (10 minutos si es cero).
+	PaginaDispositivo   string
+	DuracionDispositivo time.Duration
+}
+
+func (c ConfigOIDC) duracionCodigo() time.Duration {
+	if c.DuracionCodigo > 0 {
+		return c.DuracionCodigo
+	}
+	return time.Minute
+}
+
+func (c ConfigOIDC) duracionToken() time.Duration {
+	if c.DuracionToken > 0 {
+		return c.DuracionToken
+	}
+	return time.Hour
+}
+
+func (c ConfigOIDC) duracionDispositivo() time.Duration {
+	if c.DuracionDispositivo > 0 {
+		return c.DuracionDispositivo
+	}
+	return 10 * time.Minute
+}
+
+// kid es el identificador de la clave en el JWKS.
+func (c ConfigOIDC) kid() string {
+	der, _ := x509.MarshalPKIXPublicKey(&c.Clave.PublicKey)
+	s := sha256.Sum256(der)
+	return hex.EncodeToString(s[:8])
+}
+
+// CodigoOIDC es un código de autorización emitido y todavía no canjeado.
+type CodigoOIDC struct {
+	// ID es el hash del código; el código no se guarda.
+	ID            string `gorm:"primary_key"`
+	ClienteID     string
+	UserID        string
+	RedirectURI   string
+	Scopes        string
+	Nonce         string
+	CodeChallenge string
+	Vence         time.Time
+	Usado         bool
+	CreatedAt     time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (c CodigoOIDC) TableName() string {
+	return "oidc_codigos"
+}
+
+// pedidoAutorizacion son los parámetros de "authorize" ya validados.
+type pedidoAutorizacion struct {
+	cliente       ClienteOIDC
+	redirectURI   string
+	scopes        []string
+	state         string
+	nonce         string
+	codeChallenge string
+}
+
+// errorAutorizacion es un error que se le informa al cliente en su
+// redirect URI.
+type errorAutorizacion struct {
+	codigo      string
+	descripcion string
+}
+
+func (e errorAutorizacion) Error() string {
+	return e.codigo + ": " + e.descripcion
+}
+
+// leerPedidoAutorizacion valida los parámetros de "authorize". Si el cliente
+// o la redirect URI no son válidos devuelve un error común: no se puede
+// volver al cliente. Los demás errores son errorAutorizacion.
+func (h *Handler) leerPedidoAutorizacion(q url.Values) (p pedidoAutorizacion, err error) {
+	err = h.db.First(&p.cliente, "id = ?", q.Get("client_id")).Error
+	if err != nil {
+		return p, errors.New("cliente inexistente")
+	}
+	p.redirectURI = q.Get("redirect_uri")
+	if !p.cliente.aceptaRedirect(p.redirectURI) {
+		return p, errors.New("redirect_uri no registrada")
+	}
+	p.state = q.Get("state")
+	p.nonce = q.Get("nonce")
+
+	if q.Get("response_type") != "code" {
+		return p, errorAutorizacion{"unsupported_response_type", "sólo se admite code"}
+	}
+
+	// Los scopes que no conozco se ignoran
+	for _, s := range strings.Fields(q.Get("scope")) {
+		if contiene(scopesOIDC, s) {
+			p.scopes = append(p.scopes, s)
+		}
+	}
+	if !contiene(p.scopes, ScopeOpenID) {
+		return p, errorAutorizacion{"invalid_scope", "falta el scope openid"}
+	}
+
+	p.codeChallenge = q.Get("code_challenge")
+	if p.codeChallenge == "" || q.Get("code_challenge_method") != "S256" {
+		return p, errorAutorizacion{"invalid_request", "se requiere PKCE con S256"}
+	}
+	return p, nil
+}
+
+// redirigir arma la URL de vuelta al cliente con los parámetros.
+func (p pedidoAutorizacion) redirigir(params url.Values) string {
+	if p.state != "" {
+		params.Set("state", p.state)
+	}
+	sep := "?"
+	if strings.Contains(p.redirectURI, "?") {
+		sep = "&"
+	}
+	return p.redirectURI + sep + params.Encode()
+}
+
+// emitirCodigo crea el código de autorización y devuelve la URL de vuelta
+// al cliente.
+func (h *Handler) emitirCodigo(p pedidoAutorizacion, userID string) (redireccion string, err error) {
+	codigo, err := textoAleatorio(32)
+	if err != nil {
+		return "", err
+	}
+
+	c := CodigoOIDC{}
+	c.ID = calcularHash(codigo)
+	c.ClienteID = p.cliente.ID
+	c.UserID = userID
+	c.RedirectURI = p.redirectURI
+	c.Scopes = strings.Join(p.scopes, " ")
+	c.Nonce = p.nonce
+	c.CodeChallenge = p.codeChallenge
+	c.Vence = time.Now().Add(h.OIDC.duracionCodigo())
+	err = h.db.Create(&c).Error
+	if err != nil {
+		return "", errors.Wrap(err, "creando código de autorización")
+	}
+
+	return p.redirigir(url.Values{"code": {codigo}}), nil
+}
+
+// Autorizar es el authorization endpoint. Si el usuario no tiene sesión lo
+// manda a PaginaLogin, si no autorizó al cliente a PaginaConsentimiento, y
+// si está todo en orden vuelve al cliente con el código.
+func (h *Handler) Autorizar() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if h.OIDC == nil {
+			httpErr(w, errors.New("OIDC no está habilitado"), http.StatusNotImplemented)
+			return
+		}
+
+		p, err := h.leerPedidoAutorizacion(r.URL.Query())
+		if e, ok := err.(errorAutorizacion); ok {
+			http.Redirect(w, r, p.redirigir(url.Values{"error": {e.codigo}, "error_description": {e.descripcion}}), http.StatusFound)
+			return
+		}
+		if err != nil {
+			httpErr(w, err, http.StatusBadRequest)
+			return
+		}
+
+		volver := h.OIDC.Emisor + "/" + pathAutorizar + "?" + r.URL.RawQuery
+
+		// El usuario ingresa con Login en el front end y vuelve
+		usuario, err := h.usuarioSesionPropia(r)
+		if err == errSuplantando {
+			httpErr(w, err, http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Redirect(w, r, h.OIDC.PaginaLogin+"?"+url.Values{"volver": {volver}}.Encode(), http.StatusFound)
+			return
+		}
+
+		// ¿Autorizó al cliente?
+		if !p.cliente.Confiable {
+			c := ConsentimientoOIDC{}
+			err = h.db.Where("user_id = ? AND cliente_id = ?", usuario.ID, p.cliente.ID).Find(&c).Error
+			if err != nil || !c.cubre(p.scopes) {
+				q := url.Values{"cliente": {p.cliente.Nombre}, "scope": {strings.Join(p.scopes, " ")}, "volver": {volver}}
+				http.Redirect(w, r, h.OIDC.PaginaConsentimiento+"?"+q.Encode(), http.StatusFound)
+				return
+			}
+		}
+
+		redireccion, err := h.emitirCodigo(p, usuario.ID)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, redireccion, http.StatusFound)
+	}
+}
+
+// ConsentirOIDC registra la respuesta del usuario de la sesión al
+// pedido de autorización. Volver es la URL de "authorize" que recibió la
+// página de consentimiento. Devuelve la URL a la que tiene que ir el
+// navegador: de vuelta al cliente, con el código o con access_denied.
+func (h *Handler) ConsentirOIDC() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			Volver  string
+			Aceptar bool
+		}{}
+
+		if h.OIDC == nil {
+			httpErr(w, errors.New("OIDC no está habilitado"), http.StatusNotImplemented)
+			return
+		}
+
+		usuario, err := h.usuarioSesionPropia(r)
+		if err != nil {
+			httpErr(w, err, codigoSesion(err))
+			return
+		}
+
+		err = json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		u, err := url.Parse(request.Volver)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "leyendo URL"), http.StatusBadRequest)
+			return
+		}
+		p, err := h.leerPedidoAutorizacion(u.Query())
+		if err != nil {
+			httpErr(w, err, http.StatusBadRequest)
+			return
+		}
+
+		redireccion := p.redirigir(url.Values{"error": {"access_denied"}})
+		if request.Aceptar {
+			err = guardarConsentimiento(h.db, usuario.ID, p.cliente.ID, p.scopes)
+			if err != nil {
+				httpErr(w, err, http.StatusInternalServerError)
+				return
+			}
+			redireccion, err = h.emitirCodigo(p, usuario.ID)
+			if err != nil {
+				httpErr(w, err, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct{ Redireccion string }{redireccion})
+	}
+}
+
+// errorOAuth responde un error con el formato de RFC 6749.
+func errorOAuth(w http.ResponseWriter, status int, codigo, descripcion string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": codigo, "error_description": descripcion})
+}
+
+// verificarPKCE corrobora que el verifier corresponda al challenge S256.
+func verificarPKCE(verifier, challenge string) bool {
+	s := sha256.Sum256([]byte(verifier))
+	calculado := base64.RawURLEncoding.EncodeToString(s[:])
+	return subtle.ConstantTimeCompare([]byte(calculado), []byte(challenge)) == 1
+}
+
+// autenticarClienteOIDC autentica al cliente con client_secret_basic o
+// client_secret_post. Los clientes públicos sólo mandan client_id.
+func (h *Handler) autenticarClienteOIDC(r *http.Request) (cliente ClienteOIDC, ok bool) {
+	clienteID, secreto, ok := r.BasicAuth()
+	if !ok {
+		clienteID, secreto = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	err := h.db.First(&cliente, "id = ?", clienteID).Error
+	if err != nil || !cliente.controlarSecreto(secreto) {
+		return cliente, false
+	}
+	return cliente, true
+}
+
+// TokenOIDC es el token endpoint. Canjea el código de autorización, o el
+// device code de un dispositivo autorizado, por el access token y el ID
+// token.
+func (h *Handler) TokenOIDC() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if h.OIDC == nil {
+			errorOAuth(w, http.StatusNotImplemented, "server_error", "OIDC no está habilitado")
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			errorOAuth(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		grant := r.PostForm.Get("grant_type")
+		if grant != "authorization_code" && grant != grantDeviceCode {
+			errorOAuth(w, http.StatusBadRequest, "unsupported_grant_type", "sólo se admite authorization_code y device_code")
+			return
+		}
+
+		// Autentico al cliente
+		cliente, ok := h.autenticarClienteOIDC(r)
+		if !ok {
+			errorOAuth(w, http.StatusUnauthorized, "invalid_client", "cliente o secreto incorrectos")
+			return
+		}
+
+		if grant == grantDeviceCode {
+			h.tokenDispositivo(w, r, cliente)
+			return
+		}
+
+		// Canjeo el código
+		c := CodigoOIDC{}
+		err = h.db.First(&c, "id = ?", calcularHash(r.PostForm.Get("code"))).Error
+		if err != nil || c.Usado || time.Now().After(c.Vence) || c.ClienteID != cliente.ID {
+			errorOAuth(w, http.StatusBadRequest, "invalid_grant", "código inválido o vencido")
+			return
+		}
+		if c.RedirectURI != r.PostForm.Get("redirect_uri") {
+			errorOAuth(w, http.StatusBadRequest, "invalid_grant", "la redirect_uri no coincide")
+			return
+		}
+		if !verificarPKCE(r.PostForm.Get("code_verifier"), c.CodeChallenge) {
+			errorOAuth(w, http.StatusBadRequest, "invalid_grant", "code_verifier incorrecto")
+			return
+		}
+
+		// Se usa una sola vez, aunque lleguen dos pedidos juntos
+		res := h.db.Model(&CodigoOIDC{}).Where("id = ? AND usado = ?", c.ID, false).Update("usado", true)
+		if res.Error != nil || res.RowsAffected != 1 {
+			errorOAuth(w, http.StatusBadRequest, "invalid_grant", "el código ya fue usado")
+			return
+		}
+
+		h.responderTokens(w, c.UserID, cliente, c.Scopes, c.Nonce)
+	}
+}
+
+// responderTokens firma y devuelve el access token y el ID token.
+func (h *Handler) responderTokens(w http.ResponseWriter, userID string, cliente ClienteOIDC, scopes, nonce string) {
+	usuario, existe, err := h.existeUsuario(userID)
+	if err != nil || !existe || controlarEstado(usuario) != nil {
+		errorOAuth(w, http.StatusBadRequest, "invalid_grant", "el usuario no puede ingresar")
+		return
+	}
+
+	accessToken, err := h.firmarOIDC(h.claimsAccessToken(usuario, cliente.ID, scopes), "at+jwt")
+	if err != nil {
+		errorOAuth(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	idToken, err := h.firmarOIDC(h.claimsIDToken(usuario, cliente.ID, nonce, strings.Fields(scopes)), "JWT")
+	if err != nil {
+		errorOAuth(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(h.OIDC.duracionToken().Seconds()),
+		"id_token":     idToken,
+		"scope":        scopes,
+	})
+}
+
+// firmarOIDC firma los claims con la clave del proveedor.
+func (h *Handler) firmarOIDC(claims jwt.MapClaims, typ string) (string, error) {
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	t.Header["kid"] = h.OIDC.kid()
+	t.Header["typ"] = typ
+	s, err := t.SignedString(h.OIDC.Clave)
+	if err != nil {
+		return "", errors.Wrap(err, "firmando token")
+	}
+	return s, nil
+}
+
+func (h *Handler) claimsAccessToken(u Usuario, clienteID, scopes string) jwt.MapClaims {
+	ahora := time.Now()
+	return jwt.MapClaims{
+		"iss":       h.OIDC.Emisor,
+		"sub":       u.ID,
+		"aud":       clienteID,
+		"client_id": clienteID,
+		"scope":     scopes,
+		"iat":       ahora.Unix(),
+		"exp":       ahora.Add(h.OIDC.duracionToken()).Unix(),
+	}
+}
+
+func (h *Handler) claimsIDToken(u Usuario, clienteID, nonce string, scopes []string) jwt.MapClaims {
+	ahora := time.Now()
+	claims := jwt.MapClaims{
+		"iss": h.OIDC.Emisor,
+		"sub": u.ID,
+		"aud": clienteID,
+		"iat": ahora.Unix(),
+		"exp": ahora.Add(h.OIDC.duracionToken()).Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	for k, v := range claimsUsuario(u, scopes) {
+		claims[k] = v
+	}
+	return claims
+}
+
+// claimsUsuario son los datos del usuario que corresponden a los scopes.
+func claimsUsuario(u Usuario, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": u.ID}
+	if contiene(scopes, ScopeEmail) {
+		claims["email"] = u.Email
+		claims["email_verified"] = u.Estado != EstadoPendienteConfirmación
+	}
+	if contiene(scopes, ScopeProfile) {
+		claims["name"] = strings.TrimSpace(u.Nombre + " " + u.Apellido)
+		claims["given_name"] = u.Nombre
+		claims["family_name"] = u.Apellido
+		if u.Username != "" {
+			claims["preferred_username"] = u.Username
+		}
+		if u.Idioma != "" {
+			claims["locale"] = u.Idioma
+		}
+		if u.ZonaHoraria != "" {
+			claims["zoneinfo"] = u.ZonaHoraria
+		}
+		claims["updated_at"] = u.UpdatedAt.Unix()
+	}
+	if contiene(scopes, ScopePhone) && u.Telefono != "" {
+		claims["phone_number"] = u.Telefono
+	}
+	return claims
+}
+
+// UserInfoOIDC devuelve los datos del usuario del access token según los
+// scopes que autorizó.
+func (h *Handler) UserInfoOIDC() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if h.OIDC == nil {
+			errorOAuth(w, http.StatusNotImplemented, "server_error", "OIDC no está habilitado")
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			errorOAuth(w, http.StatusUnauthorized, "invalid_token", "falta el access token")
+			return
+		}
+
+		claims, err := h.leerAccessToken(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			errorOAuth(w, http.StatusUnauthorized, "invalid_token", err.Error())
+			return
+		}
+
+		sub, _ := claims["sub"].(string)
+		usuario, existe, err := h.existeUsuario(sub)
+		if err != nil || !existe || controlarEstado(usuario) != nil || sesionRevocada(usuario, claims) {
+			errorOAuth(w, http.StatusUnauthorized, "invalid_token", "el usuario no puede ingresar")
+			return
+		}
+
+		scope, _ := claims["scope"].(string)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(claimsUsuario(usuario, strings.Fields(scope)))
+	}
+}
+
+// leerAccessToken verifica un access token emitido por TokenOIDC.
+func (h *Handler) leerAccessToken(s string) (claims jwt.MapClaims, err error) {
+	t, err := jwt.Parse(s, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, errors.Errorf("método de firma inesperado: %v", t.Header["alg"])
+		}
+		return &h.OIDC.Clave.PublicKey, nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "access token inválido")
+	}
+	if t.Header["typ"] != "at+jwt" {
+		return nil, errors.New("no es un access token")
+	}
+	claims = t.Claims.(jwt.MapClaims)
+	if !claims.VerifyIssuer(h.OIDC.Emisor, true) {
+		return nil, errors.New("emisor incorrecto")
+	}
+	return claims, nil
+}
+
+// JWKS publica la clave pública con la que se verifican los tokens.
+func (h *Handler) JWKS() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if h.OIDC == nil {
+			httpErr(w, errors.New("OIDC no está habilitado"), http.StatusNotImplemented)
+			return
+		}
+
+		pub := h.OIDC.Clave.PublicKey
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": h.OIDC.kid(),
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			}},
+		})
+	}
+}
+
+// DescubrimientoOIDC es el documento de /.well-known/openid-configuration.
+func (h *Handler) DescubrimientoOIDC() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if h.OIDC == nil {
+			httpErr(w, errors.New("OIDC no está habilitado"), http.StatusNotImplemented)
+			return
+		}
+
+		e := h.OIDC.Emisor
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                e,
+			"authorization_endpoint":                e + "/" + pathAutorizar,
+			"device_authorization_endpoint":         e + "/" + pathAutorizarDispositivo,
+			"token_endpoint":                        e + "/" + pathTokenOIDC,
+			"userinfo_endpoint":                     e + "/" + pathUserInfoOIDC,
+			"jwks_uri":                              e + "/" + pathJWKS,
+			"response_types_supported":              []string{"code"},
+			"grant_types_supported":                 []string{"authorization_code", grantDeviceCode},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"scopes_supported":                      scopesOIDC,
+			"code_challenge_methods_supported":      []string{"S256"},
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+			"claims_supported": []string{
+				"sub", "iss", "aud", "exp", "iat", "nonce", "email", "email_verified", "name",
+				"given_name", "family_name", "preferred_username", "locale", "zoneinfo", "phone_number",
+			},
+		})
+	}
+}
+
+// contiene devuelve true si el slice tiene el valor.
+func contiene(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package sesiones
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// ClienteOIDC es cada aplicación que usa el Handler como proveedor de
+// identidad.
+type ClienteOIDC struct {
+	ID     string `gorm:"primary_key"`
+	Nombre string
+	// SecretoHash es el hash del secreto. Los clientes públicos (aplicaciones
+	// de página única o móviles) no tienen secreto y se autentican sólo con
+	// PKCE.
+	SecretoHash string `json:"-"`
+	Publico     bool
+	// RedirectURIs son las URL a las que se puede volver, separadas por
+	// espacio. Tienen que coincidir exactamente.
+	RedirectURIs string
+	// Confiable evita pedirle consentimiento al usuario. Es para las
+	// aplicaciones propias.
+	Confiable bool
+	CreadoPor string
+	CreatedAt time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (c ClienteOIDC) TableName() string {
+	return "oidc_clientes"
+}
+
+// aceptaRedirect devuelve true si la URL está registrada para el cliente.
+func (c ClienteOIDC) aceptaRedirect(uri string) bool {
+	for _, v := range strings.Fields(c.RedirectURIs) {
+		if v == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// controlarSecreto corrobora el secreto de un cliente confidencial.
+func (c ClienteOIDC) controlarSecreto(secreto string) bool {
+	if c.Publico {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(calcularHash(secreto)), []byte(c.SecretoHash)) == 1
+}
+
+// ConsentimientoOIDC es la autorización que dio un usuario para que un
+// cliente acceda a sus datos.
+type ConsentimientoOIDC struct {
+	UserID    string `gorm:"primary_key"`
+	ClienteID string `gorm:"primary_key"`
+	// Scopes son los permisos otorgados, separados por espacio
+	Scopes    string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (c ConsentimientoOIDC) TableName() string {
+	return "oidc_consentimientos"
+}
+
+// cubre devuelve true si el consentimiento incluye todos los scopes.
+func (c ConsentimientoOIDC) cubre(scopes []string) bool {
+	otorgados := strings.Fields(c.Scopes)
+	for _, s := range scopes {
+		if !contiene(otorgados, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// agregar suma los scopes a los ya otorgados.
+func (c *ConsentimientoOIDC) agregar(scopes []string) {
+	otorgados := strings.Fields(c.Scopes)
+	for _, s := range scopes {
+		if !contiene(otorgados, s) {
+			otorgados = append(otorgados, s)
+		}
+	}
+	c.Scopes = strings.Join(otorgados, " ")
+}
+
+// guardarConsentimiento registra que el usuario le otorgó los scopes al
+// cliente, conservando los que ya le había otorgado antes.
+func guardarConsentimiento(tx *gorm.DB, userID, clienteID string, scopes []string) (err error) {
+	c := ConsentimientoOIDC{}
+	err = tx.Where("user_id = ? AND cliente_id = ?", userID, clienteID).First(&c).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return errors.Wrap(err, "buscando consentimiento")
+	}
+	c.UserID = userID
+	c.ClienteID = clienteID
+	c.agregar(scopes)
+	err = tx.Save(&c).Error
+	if err != nil {
+		return errors.Wrap(err, "registrando consentimiento")
+	}
+	return nil
+}
+
+// NuevoClienteOIDC registra una aplicación cliente. La respuesta incluye el
+// ID y, si no es pública, el secreto, que no se vuelve a mostrar. Sólo para
+// administradores.
+func (h *Handler) NuevoClienteOIDC() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			Nombre       string
+			RedirectURIs []string
+			Publico      bool
+			Confiable    bool
+		}{}
+
+		admin, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		if request.Nombre == "" {
+			httpErr(w, errors.New("debe ingresar un nombre"), http.StatusBadRequest)
+			return
+		}
+		if len(request.RedirectURIs) == 0 {
+			httpErr(w, errors.New("debe ingresar al menos una redirect URI"), http.StatusBadRequest)
+			return
+		}
+		for _, v := range request.RedirectURIs {
+			u, err := url.Parse(v)
+			if err != nil || !u.IsAbs() || u.Fragment != "" {
+				httpErr(w, errors.Errorf("redirect URI inválida: %v", v), http.StatusBadRequest)
+				return
+			}
+		}
+
+		c := ClienteOIDC{}
+		c.ID, err = textoAleatorio(16)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		c.Nombre = request.Nombre
+		c.Publico = request.Publico
+		c.Confiable = request.Confiable
+		c.RedirectURIs = strings.Join(request.RedirectURIs, " ")
+		c.CreadoPor = admin.ID
+
+		secreto := ""
+		if !c.Publico {
+			secreto, err = textoAleatorio(32)
+			if err != nil {
+				httpErr(w, err, http.StatusInternalServerError)
+				return
+			}
+			c.SecretoHash = calcularHash(secreto)
+		}
+
+		err = h.db.Create(&c).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "creando cliente"), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			ClienteOIDC
+			Secreto string `json:",omitempty"`
+		}{c, secreto})
+	}
+}
+
+// textoAleatorio devuelve n bytes aleatorios en hexadecimal.
+func textoAleatorio(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "generando valor aleatorio")
+	}
+	return hex.EncodeToString(b), nil
+}
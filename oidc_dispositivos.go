@@ -0,0 +1,315 @@
+package sesiones
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// grantDeviceCode es el grant_type del flujo de dispositivos (RFC 8628).
+const grantDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+// caracteresCodigoUsuario son consonantes, para que el código sea fácil de
+// tipear y no forme palabras.
+const caracteresCodigoUsuario = "BCDFGHJKLMNPQRSTVWXZ"
+
+// intervaloDispositivo es el tiempo mínimo entre consultas del dispositivo.
+const intervaloDispositivo = 5
+
+// intentosCodigoUsuario es la cantidad de códigos que se prueban si el
+// generado ya está en uso.
+const intentosCodigoUsuario = 3
+
+// AutorizacionDispositivo es el pedido de un dispositivo sin navegador, por
+// ejemplo una CLI, que espera que el usuario lo apruebe desde otro equipo.
+type AutorizacionDispositivo struct {
+	// ID es el hash del device code; el device code no se guarda.
+	ID        string `gorm:"primary_key"`
+	ClienteID string
+	// CodigoUsuario es el código que el usuario ingresa, sin el guión
+	CodigoUsuario string `gorm:"unique_index"`
+	Scopes        string
+	// UserID es el usuario que lo aprobó o rechazó
+	UserID    string
+	Aprobada  bool
+	Rechazada bool
+	Usada     bool
+	Vence     time.Time
+	// Intervalo son los segundos que tiene que esperar el dispositivo entre
+	// consultas. Aumenta si consulta más seguido.
+	Intervalo      int
+	UltimaConsulta time.Time
+	CreatedAt      time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (a AutorizacionDispositivo) TableName() string {
+	return "oidc_autorizaciones_dispositivo"
+}
+
+// generarCodigoUsuario devuelve un código de 8 letras.
+func generarCodigoUsuario() (string, error) {
+	b := make([]byte, 8)
+	max := big.NewInt(int64(len(caracteresCodigoUsuario)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", errors.Wrap(err, "generando código")
+		}
+		b[i] = caracteresCodigoUsuario[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// formatearCodigoUsuario lo muestra como XXXX-XXXX.
+func formatearCodigoUsuario(c string) string {
+	if len(c) != 8 {
+		return c
+	}
+	return c[:4] + "-" + c[4:]
+}
+
+// normalizarCodigoUsuario deja sólo las letras en mayúscula, para aceptar el
+// código con o sin guión y en minúsculas.
+func normalizarCodigoUsuario(c string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		if r < 'A' || r > 'Z' {
+			return -1
+		}
+		return r
+	}, c)
+}
+
+// AutorizarDispositivo es el device authorization endpoint. El dispositivo
+// manda client_id y scope y recibe el device code, con el que consulta el
+// token endpoint, y el código que le muestra al usuario.
+func (h *Handler) AutorizarDispositivo() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if h.OIDC == nil {
+			errorOAuth(w, http.StatusNotImplemented, "server_error", "OIDC no está habilitado")
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			errorOAuth(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		cliente, ok := h.autenticarClienteOIDC(r)
+		if !ok {
+			errorOAuth(w, http.StatusUnauthorized, "invalid_client", "cliente o secreto incorrectos")
+			return
+		}
+
+		scopes := []string{}
+		for _, v := range strings.Fields(r.PostForm.Get("scope")) {
+			if contiene(scopesOIDC, v) && !contiene(scopes, v) {
+				scopes = append(scopes, v)
+			}
+		}
+		if !contiene(scopes, ScopeOpenID) {
+			scopes = append([]string{ScopeOpenID}, scopes...)
+		}
+
+		deviceCode, err := textoAleatorio(32)
+		if err != nil {
+			errorOAuth(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		a := AutorizacionDispositivo{}
+		a.ID = calcularHash(deviceCode)
+		a.ClienteID = cliente.ID
+		a.Scopes = strings.Join(scopes, " ")
+		a.Vence = time.Now().Add(h.OIDC.duracionDispositivo())
+		a.Intervalo = intervaloDispositivo
+		err = h.crearAutorizacionDispositivo(&a)
+		if err != nil {
+			h.logf("creando autorización de dispositivo: %v", err)
+			errorOAuth(w, http.StatusInternalServerError, "server_error", "creando autorización")
+			return
+		}
+
+		codigo := formatearCodigoUsuario(a.CodigoUsuario)
+		verificacion := h.OIDC.PaginaDispositivo
+		sep := "?"
+		if strings.Contains(verificacion, "?") {
+			sep = "&"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code":               deviceCode,
+			"user_code":                 codigo,
+			"verification_uri":          verificacion,
+			"verification_uri_complete": verificacion + sep + url.Values{"codigo": {codigo}}.Encode(),
+			"expires_in":                int(h.OIDC.duracionDispositivo().Seconds()),
+			"interval":                  a.Intervalo,
+		})
+	}
+}
+
+// crearAutorizacionDispositivo le asigna un código de usuario y la guarda.
+// Antes borra las vencidas, para liberar sus códigos, y si el código ya está
+// en uso prueba con otro. Las vencidas se conservan un tiempo más para que el
+// dispositivo que sigue consultando reciba expired_token.
+func (h *Handler) crearAutorizacionDispositivo(a *AutorizacionDispositivo) (err error) {
+	limite := time.Now().Add(-h.OIDC.duracionDispositivo())
+	err = h.db.Where("vence < ?", limite).Delete(&AutorizacionDispositivo{}).Error
+	if err != nil {
+		return errors.Wrap(err, "borrando autorizaciones vencidas")
+	}
+
+	for i := 0; i < intentosCodigoUsuario; i++ {
+		a.CodigoUsuario, err = generarCodigoUsuario()
+		if err != nil {
+			return err
+		}
+		err = h.db.Create(a).Error
+		if err == nil {
+			return nil
+		}
+	}
+	return errors.Wrap(err, "guardando autorización")
+}
+
+// VerificarDispositivo es lo que llama PaginaDispositivo con la sesión del
+// usuario. Con Aceptar en nil sólo devuelve el cliente y los scopes para
+// mostrarlos; con true o false aprueba o rechaza el pedido.
+func (h *Handler) VerificarDispositivo() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			Codigo  string
+			Aceptar *bool
+		}{}
+
+		if h.OIDC == nil {
+			httpErr(w, errors.New("OIDC no está habilitado"), http.StatusNotImplemented)
+			return
+		}
+
+		usuario, err := h.usuarioSesionPropia(r)
+		if err != nil {
+			httpErr(w, err, codigoSesion(err))
+			return
+		}
+
+		err = json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		a := AutorizacionDispositivo{}
+		err = h.db.First(&a, "codigo_usuario = ?", normalizarCodigoUsuario(request.Codigo)).Error
+		if err == gorm.ErrRecordNotFound || (err == nil && (a.Aprobada || a.Rechazada || time.Now().After(a.Vence))) {
+			httpErr(w, errors.New("el código no existe o venció"), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando código"), http.StatusInternalServerError)
+			return
+		}
+		cliente := ClienteOIDC{}
+		err = h.db.First(&cliente, "id = ?", a.ClienteID).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando cliente"), http.StatusInternalServerError)
+			return
+		}
+
+		if request.Aceptar != nil {
+			tx := h.db.Begin()
+			res := tx.Model(&AutorizacionDispositivo{}).
+				Where("id = ? AND aprobada = ? AND rechazada = ?", a.ID, false, false).
+				Updates(map[string]interface{}{"user_id": usuario.ID, "aprobada": *request.Aceptar, "rechazada": !*request.Aceptar})
+			if res.Error != nil || res.RowsAffected != 1 {
+				tx.Rollback()
+				httpErr(w, errors.New("el código ya fue usado"), http.StatusBadRequest)
+				return
+			}
+			if *request.Aceptar {
+				err = guardarConsentimiento(tx, usuario.ID, cliente.ID, strings.Fields(a.Scopes))
+				if err != nil {
+					tx.Rollback()
+					httpErr(w, err, http.StatusInternalServerError)
+					return
+				}
+			}
+			err = tx.Commit().Error
+			if err != nil {
+				httpErr(w, errors.Wrap(err, "confirmando transaccion"), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Cliente string
+			Scopes  []string
+		}{cliente.Nombre, strings.Fields(a.Scopes)})
+	}
+}
+
+// tokenDispositivo responde la consulta del dispositivo al token endpoint:
+// authorization_pending mientras el usuario no responde, slow_down si
+// consulta antes del intervalo, y los tokens cuando lo aprobó.
+func (h *Handler) tokenDispositivo(w http.ResponseWriter, r *http.Request, cliente ClienteOIDC) {
+	a := AutorizacionDispositivo{}
+	err := h.db.First(&a, "id = ?", calcularHash(r.PostForm.Get("device_code"))).Error
+	if err != nil || a.ClienteID != cliente.ID || a.Usada {
+		errorOAuth(w, http.StatusBadRequest, "invalid_grant", "device code inválido")
+		return
+	}
+	if a.Rechazada {
+		errorOAuth(w, http.StatusBadRequest, "access_denied", "el usuario rechazó el pedido")
+		return
+	}
+	if time.Now().After(a.Vence) {
+		errorOAuth(w, http.StatusBadRequest, "expired_token", "el device code venció")
+		return
+	}
+
+	if !a.Aprobada {
+		ahora := time.Now()
+		cambios := map[string]interface{}{"ultima_consulta": ahora}
+		demasiadoPronto := ahora.Sub(a.UltimaConsulta) < time.Duration(a.Intervalo)*time.Second
+		if demasiadoPronto {
+			cambios["intervalo"] = a.Intervalo + intervaloDispositivo
+		}
+		err = h.db.Model(&a).Updates(cambios).Error
+		if err != nil {
+			errorOAuth(w, http.StatusInternalServerError, "server_error", "registrando consulta")
+			return
+		}
+		if demasiadoPronto {
+			errorOAuth(w, http.StatusBadRequest, "slow_down", "consultó antes del intervalo")
+			return
+		}
+		errorOAuth(w, http.StatusBadRequest, "authorization_pending", "el usuario todavía no respondió")
+		return
+	}
+
+	// Se usa una sola vez, aunque lleguen dos pedidos juntos
+	res := h.db.Model(&AutorizacionDispositivo{}).Where("id = ? AND usada = ?", a.ID, false).Update("usada", true)
+	if res.Error != nil || res.RowsAffected != 1 {
+		errorOAuth(w, http.StatusBadRequest, "invalid_grant", "el device code ya fue usado")
+		return
+	}
+
+	h.responderTokens(w, a.UserID, cliente, a.Scopes, "")
+}
@@ -0,0 +1,92 @@
+package sesiones
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPKCE(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	s := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(s[:])
+
+	assert.True(t, verificarPKCE(verifier, challenge))
+	assert.False(t, verificarPKCE("otro", challenge))
+	assert.False(t, verificarPKCE("", challenge))
+}
+
+func TestTokensOIDC(t *testing.T) {
+	clave, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	h := Handler{}
+	h.OIDC = &ConfigOIDC{Emisor: "https://auth.ejemplo.com", Clave: clave}
+
+	u := Usuario{ID: "1234", Email: "ornela@sweet.com.ar", Nombre: "Ornela", Apellido: "Sweet", Estado: EstadoConfirmado}
+
+	// El access token se puede leer, el ID token no sirve como access token
+	at, err := h.firmarOIDC(h.claimsAccessToken(u, "cliente", "openid email"), "at+jwt")
+	assert.Nil(t, err)
+	claims, err := h.leerAccessToken(at)
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", claims["sub"])
+
+	id, err := h.firmarOIDC(h.claimsIDToken(u, "cliente", "n-0S6", []string{ScopeOpenID}), "JWT")
+	assert.Nil(t, err)
+	_, err = h.leerAccessToken(id)
+	assert.NotNil(t, err)
+
+	// Con otra clave no se puede leer
+	otra, _ := rsa.GenerateKey(rand.Reader, 2048)
+	h2 := Handler{}
+	h2.OIDC = &ConfigOIDC{Emisor: "https://auth.ejemplo.com", Clave: otra}
+	_, err = h2.leerAccessToken(at)
+	assert.NotNil(t, err)
+
+	// Los claims dependen de los scopes
+	c := claimsUsuario(u, []string{ScopeOpenID})
+	assert.NotContains(t, c, "email")
+	c = claimsUsuario(u, []string{ScopeOpenID, ScopeEmail, ScopeProfile})
+	assert.Equal(t, "ornela@sweet.com.ar", c["email"])
+	assert.Equal(t, true, c["email_verified"])
+	assert.Equal(t, "Ornela Sweet", c["name"])
+}
+
+func TestRedireccionOIDC(t *testing.T) {
+	p := pedidoAutorizacion{redirectURI: "https://app.ejemplo.com/cb?x=1", state: "af0ifjsldkj"}
+	r, err := url.Parse(p.redirigir(url.Values{"code": {"abc"}}))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", r.Query().Get("x"))
+	assert.Equal(t, "abc", r.Query().Get("code"))
+	assert.Equal(t, "af0ifjsldkj", r.Query().Get("state"))
+
+	c := ClienteOIDC{RedirectURIs: "https://app.ejemplo.com/cb https://app.ejemplo.com/otro"}
+	assert.True(t, c.aceptaRedirect("https://app.ejemplo.com/otro"))
+	assert.False(t, c.aceptaRedirect("https://app.ejemplo.com/cb/../malo"))
+
+	assert.True(t, ConsentimientoOIDC{Scopes: "openid email"}.cubre([]string{"openid"}))
+	assert.False(t, ConsentimientoOIDC{Scopes: "openid"}.cubre([]string{"openid", "email"}))
+
+	// Un consentimiento nuevo no saca los scopes otorgados antes
+	cons := ConsentimientoOIDC{Scopes: "openid email"}
+	cons.agregar([]string{"openid", "profile"})
+	assert.Equal(t, "openid email profile", cons.Scopes)
+	assert.Equal(t, time.Minute, ConfigOIDC{}.duracionCodigo())
+}
+
+func TestCodigoUsuario(t *testing.T) {
+	c, err := generarCodigoUsuario()
+	assert.Nil(t, err)
+	assert.Len(t, c, 8)
+	assert.Equal(t, c, normalizarCodigoUsuario(c))
+
+	assert.Equal(t, "WDJB-MJHT", formatearCodigoUsuario("WDJBMJHT"))
+	assert.Equal(t, "WDJBMJHT", normalizarCodigoUsuario("wdjb-mjht "))
+	assert.Equal(t, "WDJBMJHT", normalizarCodigoUsuario(formatearCodigoUsuario("WDJBMJHT")))
+}
@@ -0,0 +1,537 @@
+package sesiones
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofrs/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// claimOrganizacion es el claim del JWT con el ID de la organización activa.
+const claimOrganizacion = "org"
+
+// Organizacion es cada cliente que comparte la instalación. Los usuarios son
+// globales y pertenecen a una o más organizaciones, con roles propios en
+// cada una.
+type Organizacion struct {
+	ID     string `gorm:"primary_key"`
+	Nombre string
+	// Slug es el identificador legible, por ejemplo para el subdominio
+	Slug      string `gorm:"unique_index"`
+	CreadaPor string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (o Organizacion) TableName() string {
+	return "organizaciones"
+}
+
+// MiembroOrganizacion es la pertenencia de un usuario a una organización.
+type MiembroOrganizacion struct {
+	OrganizacionID string `gorm:"primary_key"`
+	UserID         string `gorm:"primary_key"`
+	// Roles son los roles del usuario en la organización, separados por coma
+	Roles string
+	// AltaSCIM es true si el usuario lo creó el proveedor SCIM de la
+	// organización.
+	AltaSCIM  bool
+	CreatedAt time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (m MiembroOrganizacion) TableName() string {
+	return "organizacion_miembros"
+}
+
+// ListaRoles devuelve los roles como slice.
+func (m MiembroOrganizacion) ListaRoles() []string {
+	roles := []string{}
+	for _, v := range strings.Split(m.Roles, ",") {
+		if v != "" {
+			roles = append(roles, v)
+		}
+	}
+	return roles
+}
+
+var regexpSlug = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// CrearOrganizacion da de alta una organización. por es el usuario que la
+// crea, que no queda como miembro.
+func (h *Handler) CrearOrganizacion(nombre, slug, por string) (o Organizacion, err error) {
+	o.Nombre = strings.TrimSpace(nombre)
+	o.Slug = strings.ToLower(strings.TrimSpace(slug))
+	if o.Nombre == "" {
+		return o, errors.New("debe ingresar un nombre")
+	}
+	if !regexpSlug.MatchString(o.Slug) {
+		return o, errors.New("el slug sólo puede tener letras minúsculas, números y guiones")
+	}
+
+	n := 0
+	err = h.db.Model(&Organizacion{}).Where("slug = ?", o.Slug).Count(&n).Error
+	if err != nil {
+		return o, errors.Wrap(err, "buscando organización")
+	}
+	if n > 0 {
+		return o, errors.Errorf("ya existe la organización %v", o.Slug)
+	}
+
+	id, _ := uuid.NewV4()
+	o.ID = id.String()
+	o.CreadaPor = por
+	err = h.db.Create(&o).Error
+	if err != nil {
+		return o, errors.Wrap(err, "creando organización")
+	}
+	return o, nil
+}
+
+// existeOrganizacion devuelve la organización si existe.
+func (h *Handler) existeOrganizacion(id string) (o Organizacion, existe bool, err error) {
+	err = h.db.First(&o, "id = ?", id).Error
+	if err == gorm.ErrRecordNotFound {
+		return o, false, nil
+	}
+	if err != nil {
+		return o, false, errors.Wrap(err, "buscando organización")
+	}
+	return o, true, nil
+}
+
+// Miembro devuelve la pertenencia del usuario a la organización.
+func (h *Handler) Miembro(organizacionID, userID string) (m MiembroOrganizacion, existe bool, err error) {
+	err = h.db.First(&m, "organizacion_id = ? AND user_id = ?", organizacionID, userID).Error
+	if err == gorm.ErrRecordNotFound {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, errors.Wrap(err, "buscando miembro")
+	}
+	return m, true, nil
+}
+
+// GuardarMiembro agrega al usuario a la organización con los roles
+// indicados. Si ya era miembro le reemplaza los roles.
+func (h *Handler) GuardarMiembro(organizacionID, userID string, roles []string) (err error) {
+	return h.guardarMiembro(h.db, organizacionID, userID, roles)
+}
+
+func (h *Handler) guardarMiembro(tx *gorm.DB, organizacionID, userID string, roles []string) (err error) {
+	m := MiembroOrganizacion{}
+	err = tx.First(&m, "organizacion_id = ? AND user_id = ?", organizacionID, userID).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return errors.Wrap(err, "buscando miembro")
+	}
+	m.OrganizacionID = organizacionID
+	m.UserID = userID
+	m.Roles = strings.Join(roles, ",")
+	err = tx.Save(&m).Error
+	if err != nil {
+		return errors.Wrap(err, "guardando miembro")
+	}
+	return nil
+}
+
+// QuitarMiembro saca al usuario de la organización.
+func (h *Handler) QuitarMiembro(organizacionID, userID string) (err error) {
+	err = h.db.Where("organizacion_id = ? AND user_id = ?", organizacionID, userID).Delete(&MiembroOrganizacion{}).Error
+	if err != nil {
+		return errors.Wrap(err, "quitando miembro")
+	}
+	return nil
+}
+
+// TieneRolOrganizacion devuelve true si el usuario tiene el rol en la
+// organización.
+func (h *Handler) TieneRolOrganizacion(organizacionID, userID, rol string) (ok bool, err error) {
+	m, existe, err := h.Miembro(organizacionID, userID)
+	if err != nil || !existe {
+		return false, err
+	}
+	return contiene(m.ListaRoles(), rol), nil
+}
+
+// exigirRolOrganizacion devuelve el usuario de la sesión si tiene el rol en
+// la organización. Los administradores globales pueden todo. Si no tiene el
+// rol responde con el error correspondiente y devuelve false.
+func (h *Handler) exigirRolOrganizacion(w http.ResponseWriter, r *http.Request, organizacionID, rol string) (usuario Usuario, ok bool) {
+	usuario, err := h.usuarioSesion(r)
+	if err != nil {
+		httpErr(w, err, http.StatusUnauthorized)
+		return usuario, false
+	}
+
+	_, existe, err := h.existeOrganizacion(organizacionID)
+	if err != nil {
+		httpErr(w, err, http.StatusInternalServerError)
+		return usuario, false
+	}
+	if !existe {
+		httpErr(w, errors.Errorf("no existe la organización %v", organizacionID), http.StatusNotFound)
+		return usuario, false
+	}
+
+	tiene, err := h.TieneRol(usuario.ID, RolAdmin)
+	if err == nil && !tiene {
+		tiene, err = h.TieneRolOrganizacion(organizacionID, usuario.ID, rol)
+	}
+	if err != nil {
+		httpErr(w, err, http.StatusInternalServerError)
+		return usuario, false
+	}
+	if !tiene {
+		httpErr(w, errors.Errorf("se requiere el rol %v en la organización", rol), http.StatusForbidden)
+		return usuario, false
+	}
+	return usuario, true
+}
+
+// agregarOrganizacionToken pone en el token la organización con la que
+// empieza la sesión: la primera a la que se unió el usuario.
+func (h *Handler) agregarOrganizacionToken(token *jwt.Token, usuario Usuario) error {
+	mm := []MiembroOrganizacion{}
+	err := h.db.Where("user_id = ?", usuario.ID).Order("created_at").Limit(1).Find(&mm).Error
+	if err != nil {
+		return errors.Wrap(err, "buscando organizaciones")
+	}
+	if len(mm) > 0 {
+		token.Claims.(jwt.MapClaims)[claimOrganizacion] = mm[0].OrganizacionID
+	}
+	return nil
+}
+
+// sesionOrganizacion devuelve el usuario y la organización activa de la
+// sesión. Controla igual que usuarioSesion que la sesión siga siendo válida.
+func (h *Handler) sesionOrganizacion(r *http.Request) (usuario Usuario, claims jwt.MapClaims, err error) {
+	tokenString, err := extraerToken(r)
+	if err != nil {
+		return usuario, nil, errors.Wrap(err, "extrayendo token de request")
+	}
+
+	token, err := h.parseToken(tokenString)
+	if err != nil {
+		return usuario, nil, errors.Wrap(err, "parseando token")
+	}
+
+	claims = token.Claims.(jwt.MapClaims)
+	usuario, err = h.controlarSesion(claims)
+	if err != nil {
+		return usuario, nil, errors.Wrap(err, "controlando sesión")
+	}
+	return usuario, claims, nil
+}
+
+// OrganizacionID devuelve el ID de la organización activa de la sesión, o
+// vacío si no tiene. Igual que MiddlewareOrganizacion controla que la sesión
+// siga siendo válida y que el usuario siga siendo miembro.
+func (h *Handler) OrganizacionID(r *http.Request) (id string, err error) {
+	usuario, claims, err := h.sesionOrganizacion(r)
+	if err != nil {
+		return id, err
+	}
+
+	id, _ = claims[claimOrganizacion].(string)
+	if id == "" {
+		return id, nil
+	}
+	_, existe, err := h.Miembro(id, usuario.ID)
+	if err != nil {
+		return "", err
+	}
+	if !existe {
+		return "", errors.New("el usuario no es miembro de la organización")
+	}
+	return id, nil
+}
+
+// OrganizacionActiva es lo que MiddlewareOrganizacion deja en el contexto.
+type OrganizacionActiva struct {
+	ID     string
+	UserID string
+	Roles  []string
+}
+
+// TieneRol devuelve true si el usuario tiene el rol en la organización.
+func (o OrganizacionActiva) TieneRol(rol string) bool {
+	return contiene(o.Roles, rol)
+}
+
+type claveContexto int
+
+const claveOrganizacion claveContexto = 0
+
+// OrganizacionDeContexto devuelve la organización que agregó
+// MiddlewareOrganizacion. ok es false si la sesión no tiene organización.
+func OrganizacionDeContexto(ctx context.Context) (o OrganizacionActiva, ok bool) {
+	o, ok = ctx.Value(claveOrganizacion).(OrganizacionActiva)
+	return o, ok
+}
+
+// MiddlewareOrganizacion exige una sesión con organización activa y la
+// agrega al contexto del request, con los roles del usuario en ella, para
+// que la aplicación la lea con OrganizacionDeContexto. Si el usuario dejó
+// de ser miembro responde 403.
+func (h *Handler) MiddlewareOrganizacion(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		usuario, claims, err := h.sesionOrganizacion(r)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		orgID, _ := claims[claimOrganizacion].(string)
+		if orgID == "" {
+			httpErr(w, errors.New("la sesión no tiene una organización activa"), http.StatusForbidden)
+			return
+		}
+		m, existe, err := h.Miembro(orgID, usuario.ID)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !existe {
+			httpErr(w, errors.New("el usuario no es miembro de la organización"), http.StatusForbidden)
+			return
+		}
+
+		o := OrganizacionActiva{ID: orgID, UserID: usuario.ID, Roles: m.ListaRoles()}
+		ctx := contextoSesion(r.Context(), claims)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, claveOrganizacion, o)))
+	})
+}
+
+// Organizaciones devuelve las organizaciones del usuario de la sesión, con
+// sus roles en cada una y cuál es la activa.
+func (h *Handler) Organizaciones() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usuario, claims, err := h.sesionOrganizacion(r)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+		activa, _ := claims[claimOrganizacion].(string)
+
+		type item struct {
+			Organizacion
+			Roles  []string
+			Activa bool
+		}
+		mm := []MiembroOrganizacion{}
+		err = h.db.Where("user_id = ?", usuario.ID).Order("created_at").Find(&mm).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando organizaciones"), http.StatusInternalServerError)
+			return
+		}
+		res := []item{}
+		for _, m := range mm {
+			o, existe, err := h.existeOrganizacion(m.OrganizacionID)
+			if err != nil {
+				httpErr(w, err, http.StatusInternalServerError)
+				return
+			}
+			if existe {
+				res = append(res, item{o, m.ListaRoles(), o.ID == activa})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// NuevaOrganizacion crea una organización. Sólo lo puede hacer un
+// administrador.
+func (h *Handler) NuevaOrganizacion() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			Nombre string
+			Slug   string
+		}{}
+
+		admin, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		o, err := h.CrearOrganizacion(request.Nombre, request.Slug, admin.ID)
+		if err != nil {
+			httpErr(w, err, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(o)
+	}
+}
+
+// MiembrosOrganizacion devuelve los miembros de la organización del
+// parámetro "id". Lo puede ver un administrador de la organización.
+func (h *Handler) MiembrosOrganizacion() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		id := r.URL.Query().Get("id")
+		_, ok := h.exigirRolOrganizacion(w, r, id, RolAdmin)
+		if !ok {
+			return
+		}
+
+		mm := []MiembroOrganizacion{}
+		err := h.db.Where("organizacion_id = ?", id).Order("created_at").Find(&mm).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando miembros"), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mm)
+	}
+}
+
+// EditarMiembroOrganizacion le cambia los roles a un miembro de la
+// organización. Lo puede hacer un administrador de la organización. Los
+// miembros nuevos entran aceptando una invitación.
+func (h *Handler) EditarMiembroOrganizacion() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			OrganizacionID string
+			UserID         string
+			Roles          []string
+		}{}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		_, ok := h.exigirRolOrganizacion(w, r, request.OrganizacionID, RolAdmin)
+		if !ok {
+			return
+		}
+
+		_, existe, err := h.Miembro(request.OrganizacionID, request.UserID)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !existe {
+			httpErr(w, errors.Errorf("el usuario %v no es miembro de la organización, hay que invitarlo", request.UserID), http.StatusBadRequest)
+			return
+		}
+
+		err = h.GuardarMiembro(request.OrganizacionID, request.UserID, request.Roles)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// QuitarMiembroOrganizacion saca a un usuario de la organización. Lo puede
+// hacer un administrador de la organización. Si es su organización activa,
+// la sesión deja de pasar MiddlewareOrganizacion.
+func (h *Handler) QuitarMiembroOrganizacion() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			OrganizacionID string
+			UserID         string
+		}{}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		_, ok := h.exigirRolOrganizacion(w, r, request.OrganizacionID, RolAdmin)
+		if !ok {
+			return
+		}
+
+		err = h.QuitarMiembro(request.OrganizacionID, request.UserID)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// CambiarOrganizacion cambia la organización activa de la sesión. Le pega
+// al usuario un token nuevo, que conserva la fecha del login. Con
+// OrganizacionID vacío la sesión queda sin organización.
+func (h *Handler) CambiarOrganizacion() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			OrganizacionID string
+		}{}
+
+		usuario, claims, err := h.sesionOrganizacion(r)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		err = json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		if request.OrganizacionID != "" {
+			_, existe, err := h.Miembro(request.OrganizacionID, usuario.ID)
+			if err != nil {
+				httpErr(w, err, http.StatusInternalServerError)
+				return
+			}
+			if !existe {
+				httpErr(w, errors.New("el usuario no es miembro de la organización"), http.StatusForbidden)
+				return
+			}
+		}
+
+		claims[claimOrganizacion] = request.OrganizacionID
+		if request.OrganizacionID == "" {
+			delete(claims, claimOrganizacion)
+		}
+		token, err := h.renovarToken(claims)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		h.agregarMetadatosToken(token, usuario)
+		err = h.setToken(w, token)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "pegando token"), http.StatusInternalServerError)
+			return
+		}
+	}
+}
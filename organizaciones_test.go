@@ -0,0 +1,57 @@
+package sesiones
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrganizacionToken(t *testing.T) {
+	h := Handler{}
+	h.secretKey = []byte("secreto")
+
+	token, err := h.newToken("marcos")
+	assert.Nil(t, err)
+	token.Claims.(jwt.MapClaims)[claimOrganizacion] = "org1"
+	tokenString, err := token.SignedString(h.secretKey)
+	assert.Nil(t, err)
+
+	// La organización activa se conserva al renovar el token
+	t2, err := h.chequearToken(tokenString)
+	assert.Nil(t, err)
+	assert.Equal(t, "org1", t2.Claims.(jwt.MapClaims)[claimOrganizacion])
+
+	// Sin sesión no hay organización
+	_, err = h.OrganizacionID(httptest.NewRequest("GET", "/", nil))
+	assert.NotNil(t, err)
+}
+
+func TestOrganizacionDeContexto(t *testing.T) {
+	_, ok := OrganizacionDeContexto(context.Background())
+	assert.False(t, ok)
+
+	m := MiembroOrganizacion{OrganizacionID: "org1", UserID: "marcos", Roles: "admin,ventas"}
+	ctx := context.WithValue(context.Background(), claveOrganizacion, OrganizacionActiva{"org1", "marcos", m.ListaRoles()})
+	o, ok := OrganizacionDeContexto(ctx)
+	assert.True(t, ok)
+	assert.True(t, o.TieneRol("ventas"))
+	assert.False(t, o.TieneRol("soporte"))
+
+	assert.Equal(t, []string{}, MiembroOrganizacion{}.ListaRoles())
+
+	// Sin sesión el middleware no deja pasar
+	h := &Handler{}
+	h.secretKey = []byte("secreto")
+	llamado := false
+	mw := h.MiddlewareOrganizacion(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		llamado = true
+	}))
+	w := httptest.NewRecorder()
+	mw.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.False(t, llamado)
+}
@@ -0,0 +1,255 @@
+package sesiones
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofrs/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"golang.org/x/text/language"
+)
+
+const largoMaximoNombre = 100
+
+// reTelefono es un número en formato E.164, por ejemplo +5493415551234.
+var reTelefono = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// UsuarioCambioPerfil es el historial de cambios del perfil de los usuarios.
+// Se registra un renglón por cada campo modificado.
+type UsuarioCambioPerfil struct {
+	ID       uuid.UUID
+	UserID   string
+	Campo    string
+	Anterior string
+	Nuevo    string
+	// Por es el ID del usuario que hizo el cambio
+	Por       string
+	CreatedAt time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (u UsuarioCambioPerfil) TableName() string {
+	return "usuario_cambios_perfil"
+}
+
+// DatosPerfil son los datos del perfil que puede modificar el usuario. Los
+// campos en nil no se modifican.
+type DatosPerfil struct {
+	Nombre      *string
+	Apellido    *string
+	Idioma      *string
+	ZonaHoraria *string
+	Telefono    *string
+	// Metadatos son los atributos que se modifican. Un valor null borra el
+	// atributo.
+	Metadatos Metadatos
+}
+
+// normalizar saca los espacios de los extremos y deja los valores en su forma
+// canónica.
+func (d *DatosPerfil) normalizar() {
+	for _, v := range []*string{d.Nombre, d.Apellido, d.Idioma, d.ZonaHoraria, d.Telefono} {
+		if v != nil {
+			*v = strings.TrimSpace(*v)
+		}
+	}
+	if d.Telefono != nil {
+		*d.Telefono = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(*d.Telefono)
+	}
+	if d.Idioma != nil && *d.Idioma != "" {
+		if tag, err := language.Parse(*d.Idioma); err == nil {
+			*d.Idioma = tag.String()
+		}
+	}
+}
+
+// validar devuelve error si alguno de los datos ingresados no es válido.
+func (d DatosPerfil) validar() error {
+	if d.Nombre != nil {
+		if *d.Nombre == "" {
+			return errors.New("no se ingresó nombre")
+		}
+		if utf8.RuneCountInString(*d.Nombre) > largoMaximoNombre {
+			return errors.Errorf("el nombre no puede tener más de %v caracteres", largoMaximoNombre)
+		}
+	}
+	if d.Apellido != nil && utf8.RuneCountInString(*d.Apellido) > largoMaximoNombre {
+		return errors.Errorf("el apellido no puede tener más de %v caracteres", largoMaximoNombre)
+	}
+	if d.Idioma != nil && *d.Idioma != "" {
+		_, err := language.Parse(*d.Idioma)
+		if err != nil {
+			return errors.Errorf("idioma inválido: %v", *d.Idioma)
+		}
+	}
+	if d.ZonaHoraria != nil && *d.ZonaHoraria != "" {
+		_, err := time.LoadLocation(*d.ZonaHoraria)
+		if err != nil {
+			return errors.Errorf("zona horaria inválida: %v", *d.ZonaHoraria)
+		}
+	}
+	if d.Telefono != nil && *d.Telefono != "" && !reTelefono.MatchString(*d.Telefono) {
+		return errors.Errorf("el teléfono debe tener formato internacional (+5493415551234)")
+	}
+	return nil
+}
+
+// ActualizarPerfil modifica los datos del perfil del usuario y registra cada
+// cambio en el historial. por es el ID del usuario que hace el cambio.
+func (h *Handler) ActualizarPerfil(userID string, d DatosPerfil, por string) (usuario Usuario, err error) {
+	d.normalizar()
+	err = d.validar()
+	if err != nil {
+		return usuario, err
+	}
+
+	usuario, existe, err := h.existeUsuario(userID)
+	if err != nil {
+		return usuario, errors.Wrap(err, "buscando usuario")
+	}
+	if !existe {
+		return usuario, errors.Errorf("no existe el usuario %v", userID)
+	}
+
+	tx := h.db.Begin()
+	err = guardarCambiosPerfil(tx, userID, usuario.camposPerfil(d), por)
+	if err != nil {
+		tx.Rollback()
+		return usuario, err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return usuario, errors.Wrap(err, "confirmando transaccion")
+	}
+	return usuario, nil
+}
+
+// campoPerfil es un campo del usuario con el valor nuevo, nil si no cambia.
+type campoPerfil struct {
+	campo  string
+	actual *string
+	nuevo  *string
+}
+
+// camposPerfil devuelve los campos del perfil del usuario con los valores de
+// d.
+func (u *Usuario) camposPerfil(d DatosPerfil) []campoPerfil {
+	return []campoPerfil{
+		{"Nombre", &u.Nombre, d.Nombre},
+		{"Apellido", &u.Apellido, d.Apellido},
+		{"Idioma", &u.Idioma, d.Idioma},
+		{"ZonaHoraria", &u.ZonaHoraria, d.ZonaHoraria},
+		{"Telefono", &u.Telefono, d.Telefono},
+	}
+}
+
+// guardarCambiosPerfil compara cada campo con el valor actual, guarda los que
+// cambiaron y los registra en el historial. Los valores nuevos quedan en el
+// usuario.
+func guardarCambiosPerfil(tx *gorm.DB, userID string, campos []campoPerfil, por string) (err error) {
+	valores := map[string]interface{}{}
+	cambios := []UsuarioCambioPerfil{}
+	for _, v := range campos {
+		if v.nuevo == nil || *v.nuevo == *v.actual {
+			continue
+		}
+		c := UsuarioCambioPerfil{UserID: userID, Campo: v.campo, Anterior: *v.actual, Nuevo: *v.nuevo, Por: por}
+		c.ID, _ = uuid.NewV4()
+		cambios = append(cambios, c)
+		valores[v.campo] = *v.nuevo
+		*v.actual = *v.nuevo
+	}
+	if len(cambios) == 0 {
+		return nil
+	}
+
+	err = tx.Model(&Usuario{}).Where("id = ?", userID).Update(valores).Error
+	if err != nil {
+		return errors.Wrap(err, "actualizando perfil")
+	}
+	for i := range cambios {
+		err = tx.Create(&cambios[i]).Error
+		if err != nil {
+			return errors.Wrap(err, "registrando cambio de perfil")
+		}
+	}
+	return nil
+}
+
+// MiUsuario devuelve el perfil del usuario de la sesión.
+func (h *Handler) MiUsuario() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usuario, err := h.usuarioSesion(r)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usuario)
+	}
+}
+
+// EditarPerfil modifica el perfil del usuario de la sesión. Sólo se cambian
+// los campos presentes en el JSON. Devuelve el perfil actualizado.
+func (h *Handler) EditarPerfil() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := DatosPerfil{}
+
+		// Si es un administrador que suplanta al usuario, el cambio queda a
+		// su nombre
+		usuario, por, err := h.usuarioSesionActor(r)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+		if por == "" {
+			por = usuario.ID
+		}
+
+		err = json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		request.normalizar()
+		err = request.validar()
+		if err == nil {
+			err = h.validarMetadatos(request.Metadatos, false, false)
+		}
+		if err != nil {
+			httpErr(w, err, http.StatusBadRequest)
+			return
+		}
+
+		// Los datos y los atributos se guardan juntos o no se guarda nada
+		tx := h.db.Begin()
+		err = guardarCambiosPerfil(tx, usuario.ID, usuario.camposPerfil(request), por)
+		if err == nil {
+			err = guardarMetadatos(tx, &usuario, request.Metadatos, por)
+		}
+		if err != nil {
+			tx.Rollback()
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		err = tx.Commit().Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "confirmando transaccion"), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usuario)
+	}
+}
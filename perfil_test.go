@@ -0,0 +1,24 @@
+package sesiones
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidarPerfil(t *testing.T) {
+	s := func(v string) *string { return &v }
+
+	d := DatosPerfil{Nombre: s(" Juan "), Idioma: s("ES-ar"), Telefono: s("+54 9 341 555-1234")}
+	d.normalizar()
+	assert.Nil(t, d.validar())
+	assert.Equal(t, "Juan", *d.Nombre)
+	assert.Equal(t, "es-AR", *d.Idioma)
+	assert.Equal(t, "+5493415551234", *d.Telefono)
+
+	assert.NotNil(t, DatosPerfil{Nombre: s("")}.validar())
+	assert.NotNil(t, DatosPerfil{Idioma: s("no es un idioma")}.validar())
+	assert.NotNil(t, DatosPerfil{ZonaHoraria: s("Marte/Olympus")}.validar())
+	assert.NotNil(t, DatosPerfil{Telefono: s("4555123")}.validar())
+	assert.Nil(t, DatosPerfil{Telefono: s("")}.validar())
+}
@@ -0,0 +1,111 @@
+package sesiones
+
+import (
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// RolAdmin es el rol que habilita los endpoints de administración.
+const RolAdmin = "admin"
+
+// UsuarioRol es cada rol que tiene asignado un usuario.
+type UsuarioRol struct {
+	UserID    string `gorm:"primary_key"`
+	Rol       string `gorm:"primary_key"`
+	CreatedAt time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (u UsuarioRol) TableName() string {
+	return "usuario_roles"
+}
+
+// Roles devuelve los roles del usuario.
+func (h *Handler) Roles(userID string) (roles []string, err error) {
+	rr := []UsuarioRol{}
+	err = h.db.Where("user_id = ?", userID).Order("rol").Find(&rr).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "buscando roles")
+	}
+	for _, v := range rr {
+		roles = append(roles, v.Rol)
+	}
+	return
+}
+
+// TieneRol devuelve true si el usuario tiene asignado el rol.
+func (h *Handler) TieneRol(userID, rol string) (ok bool, err error) {
+	n := 0
+	err = h.db.Model(&UsuarioRol{}).Where("user_id = ? AND rol = ?", userID, rol).Count(&n).Error
+	if err != nil {
+		return false, errors.Wrap(err, "buscando rol")
+	}
+	return n > 0, nil
+}
+
+// AsignarRol le agrega el rol al usuario. Si ya lo tenía no hace nada.
+func (h *Handler) AsignarRol(userID, rol string) (err error) {
+	ok, err := h.TieneRol(userID, rol)
+	if err != nil || ok {
+		return err
+	}
+	err = h.db.Create(&UsuarioRol{UserID: userID, Rol: rol}).Error
+	if err != nil {
+		return errors.Wrap(err, "asignando rol")
+	}
+	return nil
+}
+
+// QuitarRol le saca el rol al usuario.
+func (h *Handler) QuitarRol(userID, rol string) (err error) {
+	err = h.db.Where("user_id = ? AND rol = ?", userID, rol).Delete(&UsuarioRol{}).Error
+	if err != nil {
+		return errors.Wrap(err, "quitando rol")
+	}
+	return nil
+}
+
+// usuarioSesion devuelve el usuario de la sesión. A diferencia de UsuarioID
+// controla también que la sesión no haya sido revocada y que el usuario esté
+// activo.
+func (h *Handler) usuarioSesion(r *http.Request) (usuario Usuario, err error) {
+	tokenString, err := extraerToken(r)
+	if err != nil {
+		return usuario, errors.Wrap(err, "extrayendo token de request")
+	}
+
+	token, err := h.parseToken(tokenString)
+	if err != nil {
+		return usuario, errors.Wrap(err, "parseando token")
+	}
+
+	usuario, err = h.controlarSesion(token.Claims.(jwt.MapClaims))
+	if err != nil {
+		return usuario, errors.Wrap(err, "controlando sesión")
+	}
+	return usuario, nil
+}
+
+// exigirRol devuelve el usuario de la sesión si tiene el rol. Si no lo tiene
+// responde con el error correspondiente y devuelve false.
+func (h *Handler) exigirRol(w http.ResponseWriter, r *http.Request, rol string) (usuario Usuario, ok bool) {
+	usuario, err := h.usuarioSesion(r)
+	if err != nil {
+		httpErr(w, err, http.StatusUnauthorized)
+		return usuario, false
+	}
+
+	tiene, err := h.TieneRol(usuario.ID, rol)
+	if err != nil {
+		httpErr(w, err, http.StatusInternalServerError)
+		return usuario, false
+	}
+	if !tiene {
+		httpErr(w, errors.Errorf("se requiere el rol %v", rol), http.StatusForbidden)
+		return usuario, false
+	}
+	return usuario, true
+}
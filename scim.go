@@ -0,0 +1,1382 @@
+package sesiones
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// Esquemas de SCIM 2.0 (RFC 7643 y 7644)
+const (
+	esquemaUsuarioSCIM    = "urn:ietf:params:scim:schemas:core:2.0:User"
+	esquemaGrupoSCIM      = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	esquemaListaSCIM      = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	esquemaErrorSCIM      = "urn:ietf:params:scim:api:messages:2.0:Error"
+	esquemaConfigSCIM     = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	esquemaTipoSCIM       = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	esquemaDefinicionSCIM = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+)
+
+const (
+	// porSCIM es lo que queda en el historial como autor de los cambios
+	porSCIM = "scim"
+
+	limiteSCIMDefault = 100
+	limiteSCIMMaximo  = 500
+)
+
+// ConfigSCIM habilita los endpoints de SCIM 2.0, con los que el proveedor de
+// identidad de un cliente da de alta, modifica y da de baja usuarios.
+type ConfigSCIM struct {
+	// Token es el bearer token con el que se autentica el proveedor de
+	// identidad de toda la instalación.
+	Token string
+	// TokensOrganizacion son los tokens de los proveedores de identidad de
+	// cada organización, por ID de organización. Con uno de estos tokens
+	// sólo se ven los miembros de la organización, los usuarios nuevos
+	// quedan como miembros y los grupos son los roles en la organización.
+	TokensOrganizacion map[string]string
+	// URL es la dirección pública de los endpoints, por ejemplo
+	// "https://app.empresa.com/sesiones/scim/v2". Se usa en meta.location.
+	URL string
+	// Roles son los roles que el proveedor de identidad puede administrar
+	// como grupos. Si está vacío puede administrar todos salvo RolAdmin.
+	Roles []string
+}
+
+// rolPermitido devuelve true si el rol se puede administrar por SCIM.
+func (c ConfigSCIM) rolPermitido(rol string) bool {
+	if len(c.Roles) == 0 {
+		return rol != RolAdmin
+	}
+	return contiene(c.Roles, rol)
+}
+
+// autorizado corrobora el bearer token del request. org es la organización
+// del token, vacío si es el de toda la instalación.
+func (c ConfigSCIM) autorizado(r *http.Request) (org string, ok bool) {
+	a := r.Header.Get("Authorization")
+	if !strings.HasPrefix(a, "Bearer ") {
+		return "", false
+	}
+	token := []byte(strings.TrimPrefix(a, "Bearer "))
+	if c.Token != "" && subtle.ConstantTimeCompare(token, []byte(c.Token)) == 1 {
+		return "", true
+	}
+	for id, v := range c.TokensOrganizacion {
+		if id != "" && v != "" && subtle.ConstantTimeCompare(token, []byte(v)) == 1 {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func (c ConfigSCIM) url(recurso, id string) string {
+	if c.URL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(c.URL, "/") + "/" + recurso + "/" + url.PathEscape(id)
+}
+
+// rutaSCIM devuelve el recurso y el ID de un path .../scim/v2/Users/{id}.
+func rutaSCIM(path string) (recurso, id string, ok bool) {
+	partes := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 0; i+1 < len(partes); i++ {
+		if partes[i] != pathSCIM || partes[i+1] != "v2" {
+			continue
+		}
+		resto := partes[i+2:]
+		if len(resto) > 2 {
+			return "", "", false
+		}
+		if len(resto) > 0 {
+			recurso = resto[0]
+		}
+		if len(resto) > 1 {
+			id = resto[1]
+		}
+		return recurso, id, true
+	}
+	return "", "", false
+}
+
+// errorSCIM es un error con el formato de RFC 7644.
+type errorSCIM struct {
+	status  int
+	tipo    string
+	detalle string
+}
+
+func (e errorSCIM) Error() string {
+	return e.detalle
+}
+
+func responderSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func responderErrorSCIM(w http.ResponseWriter, err error) {
+	e, ok := errors.Cause(err).(errorSCIM)
+	if !ok {
+		e = errorSCIM{http.StatusInternalServerError, "", err.Error()}
+		switch errors.Cause(err).(type) {
+		case ErrTransicionEstado:
+			e.status, e.tipo = http.StatusBadRequest, "mutability"
+		case ErrOperacionRechazada:
+			e.status = http.StatusForbidden
+		}
+	}
+	respuesta := map[string]interface{}{
+		"schemas": []string{esquemaErrorSCIM},
+		"status":  strconv.Itoa(e.status),
+		"detail":  e.detalle,
+	}
+	if e.tipo != "" {
+		respuesta["scimType"] = e.tipo
+	}
+	responderSCIM(w, e.status, respuesta)
+}
+
+// boolSCIM acepta también "True" y "False", que mandan algunos proveedores.
+type boolSCIM bool
+
+func (b *boolSCIM) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	switch x := v.(type) {
+	case nil:
+		*b = false
+	case bool:
+		*b = boolSCIM(x)
+	case string:
+		p, err := strconv.ParseBool(x)
+		if err != nil {
+			return errors.Errorf("valor booleano inválido: %v", x)
+		}
+		*b = boolSCIM(p)
+	default:
+		return errors.Errorf("valor booleano inválido: %v", x)
+	}
+	return nil
+}
+
+type metaSCIM struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location,omitempty"`
+}
+
+type nombreSCIM struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// valorSCIM es cada elemento de un atributo multivaluado.
+type valorSCIM struct {
+	Value   string   `json:"value"`
+	Display string   `json:"display,omitempty"`
+	Type    string   `json:"type,omitempty"`
+	Primary boolSCIM `json:"primary,omitempty"`
+	Ref     string   `json:"$ref,omitempty"`
+}
+
+// usuarioSCIM es el recurso User. Lo que no tiene lugar en Usuario (por
+// ejemplo externalId) se ignora.
+type usuarioSCIM struct {
+	Schemas      []string    `json:"schemas"`
+	ID           string      `json:"id,omitempty"`
+	UserName     string      `json:"userName"`
+	Name         nombreSCIM  `json:"name"`
+	DisplayName  string      `json:"displayName,omitempty"`
+	Emails       []valorSCIM `json:"emails,omitempty"`
+	PhoneNumbers []valorSCIM `json:"phoneNumbers,omitempty"`
+	Locale       string      `json:"locale,omitempty"`
+	Timezone     string      `json:"timezone,omitempty"`
+	Active       *boolSCIM   `json:"active,omitempty"`
+	// Groups son los roles. Son de sólo lectura: se cambian con /Groups.
+	Groups []valorSCIM `json:"groups,omitempty"`
+	Meta   *metaSCIM   `json:"meta,omitempty"`
+}
+
+// mail devuelve el mail principal, o el primero, o userName si es un mail.
+func (s usuarioSCIM) mail() string {
+	for _, v := range s.Emails {
+		if v.Primary {
+			return v.Value
+		}
+	}
+	if len(s.Emails) > 0 {
+		return s.Emails[0].Value
+	}
+	if strings.Contains(s.UserName, "@") {
+		return s.UserName
+	}
+	return ""
+}
+
+// grupoSCIM es el recurso Group. Cada grupo es un rol y sus miembros los
+// usuarios que lo tienen, así que un grupo existe mientras tenga miembros.
+type grupoSCIM struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	DisplayName string      `json:"displayName"`
+	Members     []valorSCIM `json:"members,omitempty"`
+	Meta        *metaSCIM   `json:"meta,omitempty"`
+}
+
+// operacionSCIM es cada operación de un PATCH.
+type operacionSCIM struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// listaSCIM es la respuesta de las búsquedas.
+type listaSCIM struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+// paginaSCIM lee startIndex y count.
+func paginaSCIM(q url.Values) (inicio, cantidad int) {
+	inicio, cantidad = 1, limiteSCIMDefault
+	if v, err := strconv.Atoi(q.Get("startIndex")); err == nil && v > 1 {
+		inicio = v
+	}
+	if v, err := strconv.Atoi(q.Get("count")); err == nil {
+		cantidad = v
+	}
+	if cantidad < 0 {
+		cantidad = 0
+	}
+	if cantidad > limiteSCIMMaximo {
+		cantidad = limiteSCIMMaximo
+	}
+	return inicio, cantidad
+}
+
+var regexpFiltroSCIM = regexp.MustCompile(`^\s*(\S+)\s+(?i:eq)\s+(.+?)\s*$`)
+
+// leerFiltroSCIM interpreta un filtro "atributo eq valor", el único que se
+// admite.
+func leerFiltroSCIM(f string) (atributo, valor string, err error) {
+	m := regexpFiltroSCIM.FindStringSubmatch(f)
+	if m == nil {
+		return "", "", errorSCIM{http.StatusBadRequest, "invalidFilter", "sólo se admiten filtros 'atributo eq valor'"}
+	}
+	atributo, valor = sinEsquemaSCIM(m[1]), m[2]
+	if strings.HasPrefix(valor, `"`) {
+		err = json.Unmarshal([]byte(valor), &valor)
+		if err != nil {
+			return "", "", errorSCIM{http.StatusBadRequest, "invalidFilter", "valor inválido en el filtro"}
+		}
+	}
+	return atributo, valor, nil
+}
+
+// sinEsquemaSCIM saca el prefijo de esquema de un atributo, por ejemplo
+// "urn:ietf:params:scim:schemas:core:2.0:User:userName".
+func sinEsquemaSCIM(atributo string) string {
+	if strings.HasPrefix(strings.ToLower(atributo), "urn:") {
+		return atributo[strings.LastIndex(atributo, ":")+1:]
+	}
+	return atributo
+}
+
+// claveSCIM devuelve la clave del mapa que coincide con el nombre sin
+// distinguir mayúsculas, como pide SCIM. Si no hay ninguna devuelve el
+// nombre.
+func claveSCIM(m map[string]interface{}, nombre string) string {
+	for k := range m {
+		if strings.EqualFold(k, nombre) {
+			return k
+		}
+	}
+	return nombre
+}
+
+var regexpRutaSCIM = regexp.MustCompile(`^([^\[\].]+)(?:\[(.+)\])?(?:\.([^\[\].]+))?$`)
+
+// aplicarPatchSCIM aplica las operaciones sobre el recurso en forma de mapa.
+// Se admiten rutas "atributo", "atributo.subatributo" y
+// "atributo[filtro].subatributo".
+func aplicarPatchSCIM(recurso map[string]interface{}, ops []operacionSCIM) error {
+	for _, o := range ops {
+		op := strings.ToLower(o.Op)
+		if op != "add" && op != "replace" && op != "remove" {
+			return errorSCIM{http.StatusBadRequest, "invalidSyntax", "operación inválida: " + o.Op}
+		}
+
+		// Sin ruta el valor es un objeto con los atributos
+		if o.Path == "" {
+			valores, ok := o.Value.(map[string]interface{})
+			if op == "remove" || !ok {
+				return errorSCIM{http.StatusBadRequest, "noTarget", "falta la ruta de la operación"}
+			}
+			for k, v := range valores {
+				err := aplicarRutaSCIM(recurso, k, op, v)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		err := aplicarRutaSCIM(recurso, o.Path, op, o.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func aplicarRutaSCIM(recurso map[string]interface{}, ruta, op string, valor interface{}) error {
+	m := regexpRutaSCIM.FindStringSubmatch(sinEsquemaSCIM(ruta))
+	if m == nil {
+		return errorSCIM{http.StatusBadRequest, "invalidPath", "ruta inválida: " + ruta}
+	}
+	k, filtro, sub := claveSCIM(recurso, m[1]), m[2], m[3]
+
+	// Atributo simple o complejo
+	if filtro == "" {
+		if sub != "" {
+			obj, _ := recurso[k].(map[string]interface{})
+			if obj == nil {
+				obj = map[string]interface{}{}
+			}
+			if op == "remove" {
+				delete(obj, claveSCIM(obj, sub))
+			} else {
+				obj[claveSCIM(obj, sub)] = valor
+			}
+			recurso[k] = obj
+			return nil
+		}
+		actual, esLista := recurso[k].([]interface{})
+		nuevos, sonLista := valor.([]interface{})
+		switch {
+		case op == "remove":
+			delete(recurso, k)
+		case op == "add" && esLista && sonLista:
+			recurso[k] = append(actual, nuevos...)
+		default:
+			recurso[k] = valor
+		}
+		return nil
+	}
+
+	// Elementos de un atributo multivaluado que cumplen el filtro
+	atributo, buscado, err := leerFiltroSCIM(filtro)
+	if err != nil {
+		return errorSCIM{http.StatusBadRequest, "invalidPath", "filtro inválido en la ruta: " + ruta}
+	}
+	lista, _ := recurso[k].([]interface{})
+	resultado := []interface{}{}
+	encontrado := false
+	for _, v := range lista {
+		elem, _ := v.(map[string]interface{})
+		if elem == nil || !strings.EqualFold(textoSCIM(elem[claveSCIM(elem, atributo)]), buscado) {
+			resultado = append(resultado, v)
+			continue
+		}
+		encontrado = true
+		switch {
+		case op == "remove" && sub == "":
+			continue
+		case op == "remove":
+			delete(elem, claveSCIM(elem, sub))
+		case sub == "":
+			if nuevo, ok := valor.(map[string]interface{}); ok {
+				for kk, vv := range nuevo {
+					elem[claveSCIM(elem, kk)] = vv
+				}
+			}
+		default:
+			elem[claveSCIM(elem, sub)] = valor
+		}
+		resultado = append(resultado, elem)
+	}
+	if !encontrado && op != "remove" {
+		elem := map[string]interface{}{atributo: buscado}
+		if sub != "" {
+			elem[sub] = valor
+		} else if nuevo, ok := valor.(map[string]interface{}); ok {
+			for kk, vv := range nuevo {
+				elem[kk] = vv
+			}
+		}
+		resultado = append(resultado, elem)
+	}
+	recurso[k] = resultado
+	return nil
+}
+
+// textoSCIM pasa a texto un valor del JSON para compararlo con un filtro.
+func textoSCIM(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case nil:
+		return ""
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// convertirSCIM pasa un recurso de un tipo a otro a través de su JSON, por
+// ejemplo de struct a mapa para aplicar un PATCH.
+func convertirSCIM(desde, hasta interface{}) error {
+	b, err := json.Marshal(desde)
+	if err != nil {
+		return errors.Wrap(err, "convirtiendo recurso")
+	}
+	err = json.Unmarshal(b, hasta)
+	if err != nil {
+		return errorSCIM{http.StatusBadRequest, "invalidValue", err.Error()}
+	}
+	return nil
+}
+
+// EndpointsSCIM atiende todas las rutas de SCIM: .../scim/v2/Users,
+// .../scim/v2/Groups y los endpoints de descubrimiento. Se autentica con uno
+// de los bearer tokens de ConfigSCIM.
+func (h *Handler) EndpointsSCIM() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if h.SCIM == nil {
+			responderErrorSCIM(w, errorSCIM{http.StatusNotImplemented, "", "SCIM no está habilitado"})
+			return
+		}
+		org, ok := h.SCIM.autorizado(r)
+		if !ok {
+			responderErrorSCIM(w, errorSCIM{http.StatusUnauthorized, "", "token inválido"})
+			return
+		}
+
+		recurso, id, _ := rutaSCIM(r.URL.Path)
+		var err error
+		switch recurso {
+		case "Users":
+			err = h.usuariosSCIM(w, r, org, id)
+		case "Groups":
+			err = h.gruposSCIM(w, r, org, id)
+		case "ServiceProviderConfig", "ResourceTypes", "Schemas":
+			err = h.descubrimientoSCIM(w, r, recurso, id)
+		default:
+			err = errorSCIM{http.StatusNotFound, "", "no existe el recurso " + recurso}
+		}
+		if err != nil {
+			responderErrorSCIM(w, err)
+		}
+	}
+}
+
+func metodoInvalidoSCIM(r *http.Request) error {
+	return errorSCIM{http.StatusMethodNotAllowed, "", "método no permitido: " + r.Method}
+}
+
+// usuariosSCIM atiende /Users y /Users/{id}. Con el token de una
+// organización sólo existen sus miembros.
+func (h *Handler) usuariosSCIM(w http.ResponseWriter, r *http.Request, org, id string) (err error) {
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			return h.listarUsuariosSCIM(w, r, org)
+		case http.MethodPost:
+			s := usuarioSCIM{}
+			err = json.NewDecoder(r.Body).Decode(&s)
+			if err != nil {
+				return errorSCIM{http.StatusBadRequest, "invalidSyntax", err.Error()}
+			}
+			usuario, err := h.crearUsuarioSCIM(s, org, r)
+			if err != nil {
+				return err
+			}
+			return h.responderUsuarioSCIM(w, http.StatusCreated, org, usuario)
+		}
+		return metodoInvalidoSCIM(r)
+	}
+
+	usuario, existe, err := h.existeUsuario(id)
+	if err != nil {
+		return errors.Wrap(err, "buscando usuario")
+	}
+	if existe && usuario.Estado != EstadoBorrado {
+		existe, err = h.miembroSCIM(org, usuario.ID)
+		if err != nil {
+			return err
+		}
+	}
+	if !existe || usuario.Estado == EstadoBorrado {
+		return errorSCIM{http.StatusNotFound, "", "no existe el usuario " + id}
+	}
+
+	// Si el usuario no lo creó el proveedor de la organización, es también de
+	// otras o tiene roles globales, el proveedor no puede cambiar sus datos ni
+	// borrarlo: sólo sacarlo de la organización
+	exclusivo, err := h.exclusivoSCIM(org, usuario.ID)
+	if err != nil {
+		return err
+	}
+	if !exclusivo && (r.Method == http.MethodPut || r.Method == http.MethodPatch) {
+		return errorSCIM{http.StatusForbidden, "", "el proveedor de la organización no administra los datos del usuario"}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		return h.responderUsuarioSCIM(w, http.StatusOK, org, usuario)
+
+	case http.MethodPut:
+		s := usuarioSCIM{}
+		err = json.NewDecoder(r.Body).Decode(&s)
+		if err != nil {
+			return errorSCIM{http.StatusBadRequest, "invalidSyntax", err.Error()}
+		}
+		usuario, err = h.reemplazarUsuarioSCIM(usuario, s)
+		if err != nil {
+			return err
+		}
+		return h.responderUsuarioSCIM(w, http.StatusOK, org, usuario)
+
+	case http.MethodPatch:
+		patch := struct {
+			Operations []operacionSCIM
+		}{}
+		err = json.NewDecoder(r.Body).Decode(&patch)
+		if err != nil {
+			return errorSCIM{http.StatusBadRequest, "invalidSyntax", err.Error()}
+		}
+		actual, err := h.usuarioSCIM(org, usuario)
+		if err != nil {
+			return err
+		}
+		m := map[string]interface{}{}
+		err = convertirSCIM(actual, &m)
+		if err != nil {
+			return err
+		}
+		err = aplicarPatchSCIM(m, patch.Operations)
+		if err != nil {
+			return err
+		}
+		s := usuarioSCIM{}
+		err = convertirSCIM(m, &s)
+		if err != nil {
+			return err
+		}
+		usuario, err = h.reemplazarUsuarioSCIM(usuario, s)
+		if err != nil {
+			return err
+		}
+		return h.responderUsuarioSCIM(w, http.StatusOK, org, usuario)
+
+	case http.MethodDelete:
+		if exclusivo {
+			err = h.AnonimizarUsuario(usuario.ID, porSCIM, "Baja por SCIM")
+		} else {
+			err = h.QuitarMiembro(org, usuario.ID)
+		}
+		if err != nil {
+			return err
+		}
+		responderSCIM(w, http.StatusNoContent, nil)
+		return nil
+	}
+	return metodoInvalidoSCIM(r)
+}
+
+// miembroSCIM devuelve true si el usuario es visible con el token: todos con
+// el de la instalación, y los miembros con el de una organización.
+func (h *Handler) miembroSCIM(org, userID string) (ok bool, err error) {
+	if org == "" {
+		return true, nil
+	}
+	_, ok, err = h.Miembro(org, userID)
+	return ok, err
+}
+
+// exclusivoSCIM devuelve true si el token puede cambiar los datos del
+// usuario o borrarlo: siempre con el de la instalación, y con el de una
+// organización sólo si lo creó ese token, no es miembro de ninguna otra y no
+// tiene roles globales.
+func (h *Handler) exclusivoSCIM(org, userID string) (ok bool, err error) {
+	if org == "" {
+		return true, nil
+	}
+	m, existe, err := h.Miembro(org, userID)
+	if err != nil || !existe || !m.AltaSCIM {
+		return false, err
+	}
+	n := 0
+	err = h.db.Model(&MiembroOrganizacion{}).Where("user_id = ? AND organizacion_id <> ?", userID, org).Count(&n).Error
+	if err != nil {
+		return false, errors.Wrap(err, "buscando organizaciones del usuario")
+	}
+	if n > 0 {
+		return false, nil
+	}
+	err = h.db.Model(&UsuarioRol{}).Where("user_id = ?", userID).Count(&n).Error
+	if err != nil {
+		return false, errors.Wrap(err, "buscando roles del usuario")
+	}
+	return n == 0, nil
+}
+
+// usuarioSCIM arma el recurso User del usuario.
+func (h *Handler) usuarioSCIM(org string, u Usuario) (s usuarioSCIM, err error) {
+	roles, err := h.rolesSCIM(org, u.ID)
+	if err != nil {
+		return s, err
+	}
+
+	s.Schemas = []string{esquemaUsuarioSCIM}
+	s.ID = u.ID
+	s.UserName = u.Username
+	if s.UserName == "" {
+		s.UserName = u.Email
+	}
+	s.Name = nombreSCIM{strings.TrimSpace(u.Nombre + " " + u.Apellido), u.Nombre, u.Apellido}
+	s.DisplayName = s.Name.Formatted
+	s.Emails = []valorSCIM{{Value: u.Email, Type: "work", Primary: true}}
+	if u.Telefono != "" {
+		s.PhoneNumbers = []valorSCIM{{Value: u.Telefono, Type: "work"}}
+	}
+	s.Locale = u.Idioma
+	s.Timezone = u.ZonaHoraria
+	activo := boolSCIM(estadoActivo(u.Estado))
+	s.Active = &activo
+	for _, v := range roles {
+		if !h.SCIM.rolPermitido(v) {
+			continue
+		}
+		s.Groups = append(s.Groups, valorSCIM{Value: v, Display: v, Ref: h.SCIM.url("Groups", v)})
+	}
+	s.Meta = &metaSCIM{"User", u.CreatedAt, u.UpdatedAt, h.SCIM.url("Users", u.ID)}
+	return s, nil
+}
+
+func (h *Handler) responderUsuarioSCIM(w http.ResponseWriter, status int, org string, u Usuario) error {
+	s, err := h.usuarioSCIM(org, u)
+	if err != nil {
+		return err
+	}
+	if s.Meta.Location != "" {
+		w.Header().Set("Location", s.Meta.Location)
+	}
+	responderSCIM(w, status, s)
+	return nil
+}
+
+// listarUsuariosSCIM busca los usuarios. Se puede filtrar por userName,
+// emails, id y active.
+func (h *Handler) listarUsuariosSCIM(w http.ResponseWriter, r *http.Request, org string) (err error) {
+	qs := r.URL.Query()
+	q := h.db.Model(&Usuario{}).Where("estado <> ?", EstadoBorrado)
+	if org != "" {
+		miembros := h.db.Model(&MiembroOrganizacion{}).Select("user_id").Where("organizacion_id = ?", org).QueryExpr()
+		q = q.Where("id IN (?)", miembros)
+	}
+
+	if f := qs.Get("filter"); f != "" {
+		atributo, valor, err := leerFiltroSCIM(f)
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(atributo) {
+		case "username":
+			v := normalizarLogin(valor)
+			q = q.Where("email = ? OR username = ?", v, v)
+		case "emails", "emails.value":
+			q = q.Where("email = ?", normalizarLogin(valor))
+		case "id":
+			q = q.Where("id = ?", valor)
+		case "externalid":
+			// No se guarda, así que no hay ninguno
+			q = q.Where("1 = 0")
+		case "active":
+			activo, err := strconv.ParseBool(valor)
+			if err != nil {
+				return errorSCIM{http.StatusBadRequest, "invalidFilter", "active tiene que ser true o false"}
+			}
+			if activo {
+				q = q.Where("estado = ?", EstadoConfirmado)
+			} else {
+				q = q.Where("estado <> ?", EstadoConfirmado)
+			}
+		default:
+			return errorSCIM{http.StatusBadRequest, "invalidFilter", "no se puede filtrar por " + atributo}
+		}
+	}
+
+	inicio, cantidad := paginaSCIM(qs)
+	l := listaSCIM{Schemas: []string{esquemaListaSCIM}, StartIndex: inicio, Resources: []interface{}{}}
+	err = q.Count(&l.TotalResults).Error
+	if err != nil {
+		return errors.Wrap(err, "contando usuarios")
+	}
+	usuarios := []Usuario{}
+	if cantidad > 0 {
+		err = q.Order("created_at").Order("id").Offset(inicio - 1).Limit(cantidad).Find(&usuarios).Error
+		if err != nil {
+			return errors.Wrap(err, "buscando usuarios")
+		}
+	}
+	for _, v := range usuarios {
+		s, err := h.usuarioSCIM(org, v)
+		if err != nil {
+			return err
+		}
+		l.Resources = append(l.Resources, s)
+	}
+	l.ItemsPerPage = len(l.Resources)
+
+	responderSCIM(w, http.StatusOK, l)
+	return nil
+}
+
+// datosUsuarioSCIM valida el recurso y devuelve los datos del usuario.
+func datosUsuarioSCIM(s usuarioSCIM) (email, username string, d DatosPerfil, err error) {
+	email = normalizarLogin(s.mail())
+	if email == "" {
+		return "", "", d, errorSCIM{http.StatusBadRequest, "invalidValue", "falta el mail del usuario"}
+	}
+	// Si userName es el mail no hace falta guardarlo aparte, y si es otro
+	// mail tampoco se guarda: el nombre de usuario no puede contener '@'
+	// porque se confundiría con el mail de otro usuario al ingresar
+	username = normalizarLogin(s.UserName)
+	if strings.Contains(username, "@") {
+		username = ""
+	}
+
+	telefono := ""
+	if len(s.PhoneNumbers) > 0 {
+		telefono = s.PhoneNumbers[0].Value
+	}
+	d = DatosPerfil{
+		Nombre:      &s.Name.GivenName,
+		Apellido:    &s.Name.FamilyName,
+		Idioma:      &s.Locale,
+		ZonaHoraria: &s.Timezone,
+		Telefono:    &telefono,
+	}
+	d.normalizar()
+	err = d.validar()
+	if err != nil {
+		return "", "", d, errorSCIM{http.StatusBadRequest, "invalidValue", err.Error()}
+	}
+	return email, username, d, nil
+}
+
+// controlarUnicidadSCIM devuelve error si el mail o el nombre de usuario
+// son de otro usuario.
+func (h *Handler) controlarUnicidadSCIM(userID string, logins ...string) error {
+	for _, v := range logins {
+		if v == "" {
+			continue
+		}
+		u, existe, err := h.buscarUsuario(v)
+		if err != nil {
+			return errors.Wrap(err, "buscando usuario")
+		}
+		if existe && u.ID != userID {
+			return errorSCIM{http.StatusConflict, "uniqueness", "ya existe un usuario con " + v}
+		}
+	}
+	return nil
+}
+
+// crearUsuarioSCIM da de alta el usuario. Queda confirmado porque el mail lo
+// administra el proveedor de identidad, salvo que venga con active false. Con
+// el token de una organización queda como miembro.
+func (h *Handler) crearUsuarioSCIM(s usuarioSCIM, org string, r *http.Request) (usuario Usuario, err error) {
+	email, username, d, err := datosUsuarioSCIM(s)
+	if err != nil {
+		return usuario, err
+	}
+	err = h.controlarUnicidadSCIM("", email, username)
+	if err != nil {
+		return usuario, err
+	}
+
+	uid, _ := uuid.NewV4()
+	usuario.ID = uid.String()
+	usuario.Email = email
+	usuario.Username = username
+	usuario.Nombre = *d.Nombre
+	usuario.Apellido = *d.Apellido
+	usuario.Idioma = *d.Idioma
+	usuario.ZonaHoraria = *d.ZonaHoraria
+	usuario.Telefono = *d.Telefono
+	usuario.Estado = EstadoConfirmado
+	usuario.UltimaActualizacionContraseña = time.Now()
+
+	e := nuevoEvento(EventoUsuarioCreado, usuario, r)
+	e.Datos = map[string]interface{}{"Origen": porSCIM}
+	err = h.validarEvento(e)
+	if err != nil {
+		return usuario, err
+	}
+
+	tx := h.db.Begin()
+	err = tx.Create(&usuario).Error
+	if err != nil {
+		tx.Rollback()
+		return usuario, errors.Wrap(err, "creando usuario")
+	}
+	if org != "" {
+		err = h.guardarMiembro(tx, org, usuario.ID, nil)
+		if err == nil {
+			err = tx.Model(&MiembroOrganizacion{}).
+				Where("organizacion_id = ? AND user_id = ?", org, usuario.ID).
+				Update("alta_scim", true).
+				Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return usuario, errors.Wrap(err, "guardando miembro")
+		}
+	}
+	if s.Active != nil && !*s.Active {
+		err = h.cambiarEstado(tx, usuario, EstadoDeshabilitado, porSCIM, "Alta inactiva por SCIM")
+		if err != nil {
+			tx.Rollback()
+			return usuario, err
+		}
+		usuario.Estado = EstadoDeshabilitado
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return usuario, errors.Wrap(err, "confirmando transaccion")
+	}
+	h.emitir(e)
+	return usuario, nil
+}
+
+// reemplazarUsuarioSCIM deja el usuario como indica el recurso. Los cambios
+// quedan en el historial de perfil y de estado, todo en una transacción.
+func (h *Handler) reemplazarUsuarioSCIM(usuario Usuario, s usuarioSCIM) (Usuario, error) {
+	email, username, d, err := datosUsuarioSCIM(s)
+	if err != nil {
+		return usuario, err
+	}
+	err = h.controlarUnicidadSCIM(usuario.ID, email, username)
+	if err != nil {
+		return usuario, err
+	}
+
+	// Estado
+	nuevo := usuario.Estado
+	if s.Active != nil {
+		propio := false
+		if *s.Active && usuario.Estado == EstadoDeshabilitado {
+			propio, err = h.deshabilitadoPorSCIM(usuario.ID)
+			if err != nil {
+				return usuario, err
+			}
+		}
+		nuevo, err = estadoActivoSCIM(usuario.Estado, bool(*s.Active), propio)
+		if err != nil {
+			return usuario, err
+		}
+	}
+
+	anterior := usuario
+	tx := h.db.Begin()
+
+	// Mail, nombre de usuario y el resto del perfil
+	campos := append([]campoPerfil{
+		{"Email", &usuario.Email, &email},
+		{"Username", &usuario.Username, &username},
+	}, usuario.camposPerfil(d)...)
+	err = guardarCambiosPerfil(tx, usuario.ID, campos, porSCIM)
+	if err != nil {
+		tx.Rollback()
+		return usuario, err
+	}
+
+	if nuevo != usuario.Estado {
+		err = h.cambiarEstado(tx, usuario, nuevo, porSCIM, "SCIM")
+		if err != nil {
+			tx.Rollback()
+			return usuario, err
+		}
+		usuario.Estado = nuevo
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		return usuario, errors.Wrap(err, "confirmando transaccion")
+	}
+
+	// Como en CambiarMail, se avisa a la dirección anterior
+	if usuario.Email != anterior.Email {
+		h.avisarCambioMail(anterior, usuario.Email)
+	}
+	return usuario, nil
+}
+
+// estadoActivoSCIM devuelve el estado en que queda el usuario cuando el
+// proveedor indica active. El proveedor sólo pasa de Confirmado a
+// Deshabilitado y de vuelta si lo deshabilitó él: los demás estados los
+// maneja la instalación.
+func estadoActivoSCIM(estado string, activo, deshabilitadoPorSCIM bool) (nuevo string, err error) {
+	switch {
+	case activo == estadoActivo(estado):
+		return estado, nil
+	case !activo:
+		return EstadoDeshabilitado, nil
+	case estado == EstadoDeshabilitado && deshabilitadoPorSCIM:
+		return EstadoConfirmado, nil
+	}
+	return estado, errorSCIM{http.StatusConflict, "", "el usuario está " + estado + " y el proveedor no lo puede activar"}
+}
+
+// deshabilitadoPorSCIM devuelve true si el último cambio de estado del
+// usuario fue a Deshabilitado por SCIM.
+func (h *Handler) deshabilitadoPorSCIM(userID string) (ok bool, err error) {
+	cc := []UsuarioCambioEstado{}
+	err = h.db.Where("user_id = ?", userID).Order("created_at DESC").Limit(1).Find(&cc).Error
+	if err != nil {
+		return false, errors.Wrap(err, "buscando cambios de estado")
+	}
+	return len(cc) == 1 && cc[0].EstadoNuevo == EstadoDeshabilitado && cc[0].Por == porSCIM, nil
+}
+
+// gruposSCIM atiende /Groups y /Groups/{id}. El ID de cada grupo es el rol,
+// global o, con el token de una organización, en la organización.
+func (h *Handler) gruposSCIM(w http.ResponseWriter, r *http.Request, org, id string) (err error) {
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			return h.listarGruposSCIM(w, r, org)
+		case http.MethodPost:
+			g := grupoSCIM{}
+			err = json.NewDecoder(r.Body).Decode(&g)
+			if err != nil {
+				return errorSCIM{http.StatusBadRequest, "invalidSyntax", err.Error()}
+			}
+			if strings.TrimSpace(g.DisplayName) == "" {
+				return errorSCIM{http.StatusBadRequest, "invalidValue", "falta displayName"}
+			}
+			if !h.SCIM.rolPermitido(g.DisplayName) {
+				return errorSCIM{http.StatusBadRequest, "invalidValue", "no se puede administrar el rol " + g.DisplayName}
+			}
+			_, existe, err := h.grupoSCIM(org, g.DisplayName)
+			if err != nil {
+				return err
+			}
+			if existe {
+				return errorSCIM{http.StatusConflict, "uniqueness", "ya existe el grupo " + g.DisplayName}
+			}
+			return h.guardarGrupoSCIM(w, http.StatusCreated, org, g.DisplayName, g)
+		}
+		return metodoInvalidoSCIM(r)
+	}
+
+	// Los roles que no administra el proveedor de identidad no existen
+	if !h.SCIM.rolPermitido(id) {
+		return errorSCIM{http.StatusNotFound, "", "no existe el grupo " + id}
+	}
+
+	actual, existe, err := h.grupoSCIM(org, id)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !existe {
+			return errorSCIM{http.StatusNotFound, "", "no existe el grupo " + id}
+		}
+		responderSCIM(w, http.StatusOK, actual)
+		return nil
+
+	case http.MethodPut:
+		g := grupoSCIM{}
+		err = json.NewDecoder(r.Body).Decode(&g)
+		if err != nil {
+			return errorSCIM{http.StatusBadRequest, "invalidSyntax", err.Error()}
+		}
+		return h.guardarGrupoSCIM(w, http.StatusOK, org, id, g)
+
+	case http.MethodPatch:
+		// Un grupo sin miembros no existe todavía, pero se le pueden agregar
+		patch := struct {
+			Operations []operacionSCIM
+		}{}
+		err = json.NewDecoder(r.Body).Decode(&patch)
+		if err != nil {
+			return errorSCIM{http.StatusBadRequest, "invalidSyntax", err.Error()}
+		}
+		if !existe {
+			actual = grupoSCIM{Schemas: []string{esquemaGrupoSCIM}, ID: id, DisplayName: id}
+		}
+		m := map[string]interface{}{}
+		err = convertirSCIM(actual, &m)
+		if err != nil {
+			return err
+		}
+		err = aplicarPatchSCIM(m, patch.Operations)
+		if err != nil {
+			return err
+		}
+		g := grupoSCIM{}
+		err = convertirSCIM(m, &g)
+		if err != nil {
+			return err
+		}
+		return h.guardarGrupoSCIM(w, http.StatusOK, org, id, g)
+
+	case http.MethodDelete:
+		if org == "" {
+			err = h.db.Where("rol = ?", id).Delete(&UsuarioRol{}).Error
+			if err != nil {
+				return errors.Wrap(err, "borrando grupo")
+			}
+		} else {
+			for _, v := range actual.Members {
+				err = h.cambiarRolSCIM(org, v.Value, id, false)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		responderSCIM(w, http.StatusNoContent, nil)
+		return nil
+	}
+	return metodoInvalidoSCIM(r)
+}
+
+// rolesSCIM devuelve los roles del usuario, globales o en la organización.
+func (h *Handler) rolesSCIM(org, userID string) ([]string, error) {
+	if org == "" {
+		return h.Roles(userID)
+	}
+	m, _, err := h.Miembro(org, userID)
+	if err != nil {
+		return nil, err
+	}
+	return m.ListaRoles(), nil
+}
+
+// miembrosRolSCIM devuelve quiénes tienen el rol, por fecha de alta.
+func (h *Handler) miembrosRolSCIM(org, rol string) (rr []UsuarioRol, err error) {
+	if org == "" {
+		err = h.db.Where("rol = ?", rol).Order("created_at").Find(&rr).Error
+		if err != nil {
+			return nil, errors.Wrap(err, "buscando grupo")
+		}
+		return rr, nil
+	}
+
+	mm := []MiembroOrganizacion{}
+	err = h.db.Where("organizacion_id = ?", org).Order("created_at").Find(&mm).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "buscando grupo")
+	}
+	for _, m := range mm {
+		if contiene(m.ListaRoles(), rol) {
+			rr = append(rr, UsuarioRol{UserID: m.UserID, Rol: rol, CreatedAt: m.CreatedAt})
+		}
+	}
+	return rr, nil
+}
+
+// cambiarRolSCIM le asigna o le quita el rol al usuario.
+func (h *Handler) cambiarRolSCIM(org, userID, rol string, asignar bool) (err error) {
+	if org == "" {
+		if asignar {
+			return h.AsignarRol(userID, rol)
+		}
+		return h.QuitarRol(userID, rol)
+	}
+
+	m, existe, err := h.Miembro(org, userID)
+	if err != nil || !existe {
+		return err
+	}
+	roles := []string{}
+	for _, v := range m.ListaRoles() {
+		if v != rol {
+			roles = append(roles, v)
+		}
+	}
+	if asignar {
+		roles = append(roles, rol)
+	}
+	return h.GuardarMiembro(org, userID, roles)
+}
+
+// grupoSCIM arma el grupo del rol. existe es false si nadie tiene el rol.
+func (h *Handler) grupoSCIM(org, rol string) (g grupoSCIM, existe bool, err error) {
+	rr, err := h.miembrosRolSCIM(org, rol)
+	if err != nil {
+		return g, false, err
+	}
+	if len(rr) == 0 {
+		return g, false, nil
+	}
+
+	g.Schemas = []string{esquemaGrupoSCIM}
+	g.ID = rol
+	g.DisplayName = rol
+	g.Meta = &metaSCIM{"Group", rr[0].CreatedAt, rr[len(rr)-1].CreatedAt, h.SCIM.url("Groups", rol)}
+	for _, v := range rr {
+		g.Members = append(g.Members, valorSCIM{Value: v.UserID, Ref: h.SCIM.url("Users", v.UserID)})
+	}
+	return g, true, nil
+}
+
+// guardarGrupoSCIM deja como miembros del rol a los usuarios del grupo.
+func (h *Handler) guardarGrupoSCIM(w http.ResponseWriter, status int, org, rol string, g grupoSCIM) error {
+	if g.DisplayName != "" && g.DisplayName != rol {
+		return errorSCIM{http.StatusBadRequest, "mutability", "no se puede cambiar el nombre de un grupo"}
+	}
+
+	miembros := map[string]bool{}
+	for _, v := range g.Members {
+		_, existe, err := h.existeUsuario(v.Value)
+		if err != nil {
+			return errors.Wrap(err, "buscando usuario")
+		}
+		if existe {
+			existe, err = h.miembroSCIM(org, v.Value)
+			if err != nil {
+				return err
+			}
+		}
+		if !existe {
+			return errorSCIM{http.StatusBadRequest, "invalidValue", "no existe el usuario " + v.Value}
+		}
+		miembros[v.Value] = true
+	}
+
+	actuales, err := h.miembrosRolSCIM(org, rol)
+	if err != nil {
+		return err
+	}
+	for _, v := range actuales {
+		if miembros[v.UserID] {
+			delete(miembros, v.UserID)
+			continue
+		}
+		err = h.cambiarRolSCIM(org, v.UserID, rol, false)
+		if err != nil {
+			return err
+		}
+	}
+	for id := range miembros {
+		err = h.cambiarRolSCIM(org, id, rol, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	res, existe, err := h.grupoSCIM(org, rol)
+	if err != nil {
+		return err
+	}
+	if !existe {
+		res = grupoSCIM{Schemas: []string{esquemaGrupoSCIM}, ID: rol, DisplayName: rol, Members: []valorSCIM{}}
+	}
+	if l := h.SCIM.url("Groups", rol); l != "" {
+		w.Header().Set("Location", l)
+	}
+	responderSCIM(w, status, res)
+	return nil
+}
+
+// listarGruposSCIM busca los grupos. Se puede filtrar por displayName e id.
+func (h *Handler) listarGruposSCIM(w http.ResponseWriter, r *http.Request, org string) (err error) {
+	qs := r.URL.Query()
+	filtro := ""
+	if f := qs.Get("filter"); f != "" {
+		atributo, valor, err := leerFiltroSCIM(f)
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(atributo) {
+		case "displayname", "id":
+			filtro = valor
+		default:
+			return errorSCIM{http.StatusBadRequest, "invalidFilter", "no se puede filtrar por " + atributo}
+		}
+	}
+
+	todos, err := h.rolesExistentesSCIM(org)
+	if err != nil {
+		return err
+	}
+	roles := []string{}
+	for _, v := range todos {
+		if h.SCIM.rolPermitido(v) && (filtro == "" || v == filtro) {
+			roles = append(roles, v)
+		}
+	}
+
+	inicio, cantidad := paginaSCIM(qs)
+	l := listaSCIM{Schemas: []string{esquemaListaSCIM}, TotalResults: len(roles), StartIndex: inicio, Resources: []interface{}{}}
+	for i := inicio - 1; i < len(roles) && len(l.Resources) < cantidad; i++ {
+		g, _, err := h.grupoSCIM(org, roles[i])
+		if err != nil {
+			return err
+		}
+		l.Resources = append(l.Resources, g)
+	}
+	l.ItemsPerPage = len(l.Resources)
+
+	responderSCIM(w, http.StatusOK, l)
+	return nil
+}
+
+// rolesExistentesSCIM devuelve los roles que tiene algún usuario, ordenados.
+func (h *Handler) rolesExistentesSCIM(org string) (roles []string, err error) {
+	if org == "" {
+		err = h.db.Model(&UsuarioRol{}).Order("rol").Pluck("DISTINCT(rol)", &roles).Error
+		if err != nil {
+			return nil, errors.Wrap(err, "buscando grupos")
+		}
+		return roles, nil
+	}
+
+	mm := []MiembroOrganizacion{}
+	err = h.db.Where("organizacion_id = ?", org).Find(&mm).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "buscando grupos")
+	}
+	for _, m := range mm {
+		for _, v := range m.ListaRoles() {
+			if !contiene(roles, v) {
+				roles = append(roles, v)
+			}
+		}
+	}
+	sort.Strings(roles)
+	return roles, nil
+}
+
+// atributoSCIM describe un atributo en /Schemas.
+func atributoSCIM(nombre, tipo string, multivaluado, requerido bool, mutabilidad string, sub ...map[string]interface{}) map[string]interface{} {
+	a := map[string]interface{}{
+		"name":        nombre,
+		"type":        tipo,
+		"multiValued": multivaluado,
+		"required":    requerido,
+		"caseExact":   false,
+		"mutability":  mutabilidad,
+		"returned":    "default",
+		"uniqueness":  "none",
+	}
+	if nombre == "userName" {
+		a["uniqueness"] = "server"
+	}
+	if len(sub) > 0 {
+		a["subAttributes"] = sub
+	}
+	return a
+}
+
+// descubrimientoSCIM atiende /ServiceProviderConfig, /ResourceTypes y
+// /Schemas.
+func (h *Handler) descubrimientoSCIM(w http.ResponseWriter, r *http.Request, recurso, id string) error {
+	if r.Method != http.MethodGet {
+		return metodoInvalidoSCIM(r)
+	}
+
+	if recurso == "ServiceProviderConfig" {
+		responderSCIM(w, http.StatusOK, map[string]interface{}{
+			"schemas":        []string{esquemaConfigSCIM},
+			"patch":          map[string]bool{"supported": true},
+			"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+			"filter":         map[string]interface{}{"supported": true, "maxResults": limiteSCIMMaximo},
+			"changePassword": map[string]bool{"supported": false},
+			"sort":           map[string]bool{"supported": false},
+			"etag":           map[string]bool{"supported": false},
+			"authenticationSchemes": []map[string]interface{}{{
+				"type":        "oauthbearertoken",
+				"name":        "Bearer token",
+				"description": "Token configurado en ConfigSCIM",
+				"primary":     true,
+			}},
+		})
+		return nil
+	}
+
+	var recursos []map[string]interface{}
+	if recurso == "ResourceTypes" {
+		recursos = []map[string]interface{}{
+			{"schemas": []string{esquemaTipoSCIM}, "id": "User", "name": "User", "endpoint": "/Users", "schema": esquemaUsuarioSCIM},
+			{"schemas": []string{esquemaTipoSCIM}, "id": "Group", "name": "Group", "endpoint": "/Groups", "schema": esquemaGrupoSCIM},
+		}
+	} else {
+		valor := atributoSCIM("value", "string", false, false, "readWrite")
+		tipo := atributoSCIM("type", "string", false, false, "readWrite")
+		primario := atributoSCIM("primary", "boolean", false, false, "readWrite")
+		recursos = []map[string]interface{}{
+			{
+				"schemas": []string{esquemaDefinicionSCIM}, "id": esquemaUsuarioSCIM, "name": "User",
+				"attributes": []map[string]interface{}{
+					atributoSCIM("userName", "string", false, true, "readWrite"),
+					atributoSCIM("name", "complex", false, false, "readWrite",
+						atributoSCIM("formatted", "string", false, false, "readOnly"),
+						atributoSCIM("givenName", "string", false, false, "readWrite"),
+						atributoSCIM("familyName", "string", false, false, "readWrite"),
+					),
+					atributoSCIM("displayName", "string", false, false, "readOnly"),
+					atributoSCIM("emails", "complex", true, true, "readWrite", valor, tipo, primario),
+					atributoSCIM("phoneNumbers", "complex", true, false, "readWrite", valor, tipo),
+					atributoSCIM("locale", "string", false, false, "readWrite"),
+					atributoSCIM("timezone", "string", false, false, "readWrite"),
+					atributoSCIM("active", "boolean", false, false, "readWrite"),
+					atributoSCIM("groups", "complex", true, false, "readOnly", atributoSCIM("value", "string", false, false, "readOnly")),
+				},
+			},
+			{
+				"schemas": []string{esquemaDefinicionSCIM}, "id": esquemaGrupoSCIM, "name": "Group",
+				"attributes": []map[string]interface{}{
+					atributoSCIM("displayName", "string", false, true, "immutable"),
+					atributoSCIM("members", "complex", true, false, "readWrite", atributoSCIM("value", "string", false, false, "immutable")),
+				},
+			},
+		}
+	}
+
+	if id != "" {
+		for _, v := range recursos {
+			if v["id"] == id {
+				responderSCIM(w, http.StatusOK, v)
+				return nil
+			}
+		}
+		return errorSCIM{http.StatusNotFound, "", "no existe " + id}
+	}
+
+	l := listaSCIM{Schemas: []string{esquemaListaSCIM}, TotalResults: len(recursos), StartIndex: 1, ItemsPerPage: len(recursos)}
+	for _, v := range recursos {
+		l.Resources = append(l.Resources, v)
+	}
+	responderSCIM(w, http.StatusOK, l)
+	return nil
+}
@@ -0,0 +1,179 @@
+package sesiones
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRutaSCIM(t *testing.T) {
+	recurso, id, ok := rutaSCIM("/sesiones/scim/v2/Users/123")
+	assert.True(t, ok)
+	assert.Equal(t, "Users", recurso)
+	assert.Equal(t, "123", id)
+
+	recurso, id, ok = rutaSCIM("scim/v2/Groups")
+	assert.True(t, ok)
+	assert.Equal(t, "Groups", recurso)
+	assert.Equal(t, "", id)
+
+	_, _, ok = rutaSCIM("sesiones/usuarios")
+	assert.False(t, ok)
+}
+
+func TestFiltroSCIM(t *testing.T) {
+	atributo, valor, err := leerFiltroSCIM(`userName eq "Ornela@Sweet.com.ar"`)
+	assert.Nil(t, err)
+	assert.Equal(t, "userName", atributo)
+	assert.Equal(t, "Ornela@Sweet.com.ar", valor)
+
+	atributo, valor, err = leerFiltroSCIM(`urn:ietf:params:scim:schemas:core:2.0:User:active EQ true`)
+	assert.Nil(t, err)
+	assert.Equal(t, "active", atributo)
+	assert.Equal(t, "true", valor)
+
+	_, _, err = leerFiltroSCIM(`userName sw "orn"`)
+	assert.Equal(t, "invalidFilter", err.(errorSCIM).tipo)
+}
+
+func TestPatchSCIM(t *testing.T) {
+	activo := boolSCIM(true)
+	s := usuarioSCIM{
+		UserName: "ornela",
+		Name:     nombreSCIM{GivenName: "Ornela"},
+		Emails:   []valorSCIM{{Value: "ornela@sweet.com.ar", Type: "work", Primary: true}},
+		Active:   &activo,
+	}
+	m := map[string]interface{}{}
+	assert.Nil(t, convertirSCIM(s, &m))
+
+	// Azure manda los booleanos como texto
+	ops := []operacionSCIM{}
+	assert.Nil(t, json.Unmarshal([]byte(`[
+		{"op": "Replace", "path": "active", "value": "False"},
+		{"op": "replace", "path": "name.familyName", "value": "Sweet"},
+		{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "ornela@sweet.com"},
+		{"op": "add", "path": "phoneNumbers[type eq \"mobile\"].value", "value": "+5493415551234"},
+		{"op": "add", "value": {"locale": "es-AR"}}
+	]`), &ops))
+	assert.Nil(t, aplicarPatchSCIM(m, ops))
+
+	res := usuarioSCIM{}
+	assert.Nil(t, convertirSCIM(m, &res))
+	assert.False(t, bool(*res.Active))
+	assert.Equal(t, "Sweet", res.Name.FamilyName)
+	assert.Equal(t, "ornela@sweet.com", res.mail())
+	assert.Equal(t, "+5493415551234", res.PhoneNumbers[0].Value)
+	assert.Equal(t, "es-AR", res.Locale)
+
+	// Sacar un miembro de un grupo
+	g := map[string]interface{}{}
+	assert.Nil(t, convertirSCIM(grupoSCIM{DisplayName: "ventas", Members: []valorSCIM{{Value: "a"}, {Value: "b"}}}, &g))
+	assert.Nil(t, aplicarPatchSCIM(g, []operacionSCIM{
+		{Op: "remove", Path: `members[value eq "a"]`},
+		{Op: "add", Path: "members", Value: []interface{}{map[string]interface{}{"value": "c"}}},
+	}))
+	grupo := grupoSCIM{}
+	assert.Nil(t, convertirSCIM(g, &grupo))
+	assert.Equal(t, []valorSCIM{{Value: "b"}, {Value: "c"}}, grupo.Members)
+
+	err := aplicarPatchSCIM(m, []operacionSCIM{{Op: "move", Path: "active"}})
+	assert.Equal(t, "invalidSyntax", err.(errorSCIM).tipo)
+}
+
+func TestAutorizacionSCIM(t *testing.T) {
+	h := &Handler{}
+	r := httptest.NewRequest("GET", "/scim/v2/Users", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+
+	h.SCIM = &ConfigSCIM{Token: "secreto"}
+	r = httptest.NewRequest("GET", "/scim/v2/Users", nil)
+	r.Header.Set("Authorization", "Bearer otro")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "application/scim+json", w.Header().Get("Content-Type"))
+
+	r = httptest.NewRequest("GET", "/scim/v2/ServiceProviderConfig", nil)
+	r.Header.Set("Authorization", "Bearer secreto")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Cada organización tiene su token
+	h.SCIM.TokensOrganizacion = map[string]string{"org1": "secreto-org1"}
+	org, ok := h.SCIM.autorizado(r)
+	assert.True(t, ok)
+	assert.Equal(t, "", org)
+	r.Header.Set("Authorization", "Bearer secreto-org1")
+	org, ok = h.SCIM.autorizado(r)
+	assert.True(t, ok)
+	assert.Equal(t, "org1", org)
+	r.Header.Set("Authorization", "Bearer secreto-org2")
+	_, ok = h.SCIM.autorizado(r)
+	assert.False(t, ok)
+}
+
+func TestGruposSCIM(t *testing.T) {
+	assert.False(t, ConfigSCIM{}.rolPermitido(RolAdmin))
+	assert.True(t, ConfigSCIM{}.rolPermitido("ventas"))
+	assert.False(t, ConfigSCIM{Roles: []string{"ventas"}}.rolPermitido("soporte"))
+
+	// El grupo de administradores no existe para el proveedor de identidad
+	h := &Handler{}
+	h.SCIM = &ConfigSCIM{Token: "secreto"}
+	for _, metodo := range []string{"GET", "PUT", "PATCH", "DELETE"} {
+		r := httptest.NewRequest(metodo, "/scim/v2/Groups/admin", nil)
+		r.Header.Set("Authorization", "Bearer secreto")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code, metodo)
+	}
+}
+
+func TestUsernameSCIM(t *testing.T) {
+	s := usuarioSCIM{UserName: "Ornela", Name: nombreSCIM{GivenName: "Ornela"}, Emails: []valorSCIM{{Value: "ornela@sweet.com.ar"}}}
+	_, username, _, err := datosUsuarioSCIM(s)
+	assert.Nil(t, err)
+	assert.Equal(t, "ornela", username)
+
+	// Un userName con '@' no se guarda como nombre de usuario aunque sea
+	// distinto del mail
+	s.UserName = "ornela.sweet@empresa.com"
+	email, username, _, err := datosUsuarioSCIM(s)
+	assert.Nil(t, err)
+	assert.Equal(t, "ornela@sweet.com.ar", email)
+	assert.Equal(t, "", username)
+}
+
+func TestEstadoActivoSCIM(t *testing.T) {
+	casos := []struct {
+		estado  string
+		activo  bool
+		propio  bool
+		nuevo   string
+		rechazo bool
+	}{
+		{EstadoConfirmado, true, false, EstadoConfirmado, false},
+		{EstadoConfirmado, false, false, EstadoDeshabilitado, false},
+		{EstadoDeshabilitado, true, true, EstadoConfirmado, false},
+		{EstadoDeshabilitado, true, false, EstadoDeshabilitado, true},
+		{EstadoBloqueado, true, false, EstadoBloqueado, true},
+		{EstadoSuspendido, true, false, EstadoSuspendido, true},
+		{EstadoPendienteAprobacion, true, false, EstadoPendienteAprobacion, true},
+		{EstadoBloqueado, false, false, EstadoBloqueado, false},
+	}
+	for _, c := range casos {
+		nuevo, err := estadoActivoSCIM(c.estado, c.activo, c.propio)
+		assert.Equal(t, c.nuevo, nuevo, c.estado)
+		assert.Equal(t, c.rechazo, err != nil, c.estado)
+		if err != nil {
+			assert.Equal(t, http.StatusConflict, err.(errorSCIM).status)
+		}
+	}
+}
@@ -18,12 +18,30 @@ func (h *Handler) chequearToken(token string) (tokenOut *jwt.Token, err error) {
 	}
 
 	// Infiero tipo
-	claims := t1.Claims.(jwt.MapClaims)
+	return h.renovarToken(t1.Claims.(jwt.MapClaims))
+}
+
+// renovarToken crea un token nuevo para la sesión. Conserva la fecha del
+// login original y la organización activa. Los atributos no los copia: se
+// vuelven a leer del usuario con agregarMetadatosToken, para que un cambio
+// no quede viejo en el token hasta el próximo login.
+func (h *Handler) renovarToken(claims jwt.MapClaims) (tokenOut *jwt.Token, err error) {
 	t2, err := h.newToken(claims["userID"].(string))
 	if err != nil {
 		return tokenOut, errors.Wrap(err, "creando nuevo token")
 	}
 
+	for _, k := range []string{"iat", claimOrganizacion, claimActor} {
+		if v, ok := claims[k]; ok {
+			t2.Claims.(jwt.MapClaims)[k] = v
+		}
+	}
+
+	// Una suplantación no se extiende más allá de su vencimiento
+	if s, ok := suplantacionClaims(claims); ok && numeroClaim(t2.Claims.(jwt.MapClaims)["exp"]) > s.Vence.Unix() {
+		t2.Claims.(jwt.MapClaims)["exp"] = s.Vence.Unix()
+	}
+
 	return t2, nil
 }
 
@@ -92,11 +110,55 @@ func (h *Handler) newToken(userID string) (token *jwt.Token, err error) {
 
 	// Set token claims
 	claims["userID"] = userID
+	claims["iat"] = time.Now().Unix()
 	claims["exp"] = time.Now().Add(h.DuracionSesion).Unix()
 
 	return
 }
 
+// controlarSesion devuelve el usuario del token si la sesión sigue siendo
+// válida: que el usuario exista, que esté activo y que no se hayan cerrado
+// todas sus sesiones después de que se emitió el token.
+func (h *Handler) controlarSesion(claims jwt.MapClaims) (usuario Usuario, err error) {
+	userID, _ := claims["userID"].(string)
+	usuario, existe, err := h.existeUsuario(userID)
+	if err != nil {
+		return usuario, errors.Wrap(err, "buscando usuario")
+	}
+	if !existe {
+		return usuario, errors.New("el usuario de la sesión no existe")
+	}
+
+	if sesionRevocada(usuario, claims) {
+		return usuario, errors.New("la sesión fue revocada")
+	}
+
+	err = controlarEstado(usuario)
+	if err != nil {
+		return usuario, err
+	}
+
+	// Si es un administrador suplantando al usuario, que siga vigente
+	if s, ok := suplantacionClaims(claims); ok {
+		err = h.controlarSuplantacion(s)
+		if err != nil {
+			return usuario, err
+		}
+	}
+	return usuario, nil
+}
+
+// sesionRevocada devuelve true si el token se emitió antes de que se cerraran
+// todas las sesiones del usuario. El iat tiene precisión de segundos: un
+// token emitido en el mismo segundo en que se revocaron las sesiones también
+// queda revocado.
+func sesionRevocada(usuario Usuario, claims jwt.MapClaims) bool {
+	if usuario.SesionesValidasDesde.IsZero() {
+		return false
+	}
+	return numeroClaim(claims["iat"]) <= usuario.SesionesValidasDesde.Unix()
+}
+
 // usuarioID devuelve el campo Nombre para el usuario de la sesión
 func (h *Handler) usuarioID(r *http.Request) (id string, err error) {
 	tokenString, err := extraerToken(r)
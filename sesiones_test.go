@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -150,3 +151,15 @@ func handleControlaSesiones(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Ok"))
 
 }
+
+func TestSesionRevocada(t *testing.T) {
+	revocacion := time.Now()
+	u := Usuario{}
+	assert.False(t, sesionRevocada(u, jwt.MapClaims{"iat": float64(revocacion.Unix() - 10)}))
+
+	// Vale tanto para los tokens parseados como para los recién firmados
+	u.SesionesValidasDesde = revocacion
+	assert.True(t, sesionRevocada(u, jwt.MapClaims{"iat": float64(revocacion.Unix() - 10)}))
+	assert.True(t, sesionRevocada(u, jwt.MapClaims{"iat": revocacion.Unix()}))
+	assert.False(t, sesionRevocada(u, jwt.MapClaims{"iat": revocacion.Unix() + 1}))
+}
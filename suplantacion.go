@@ -0,0 +1,437 @@
+package sesiones
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofrs/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// claimActor es el claim del JWT con el administrador que suplanta al
+// usuario, como en RFC 8693: {"sub": admin, "sid": suplantación, "exp": vence}.
+const claimActor = "act"
+
+// cookieSuplantador guarda la sesión del administrador mientras suplanta a
+// un usuario, para volver a ella al terminar.
+const cookieSuplantador = "token_suplantador"
+
+// Suplantacion es el registro de cada vez que un administrador ingresó como
+// otro usuario. No se borra al anonimizar al usuario.
+type Suplantacion struct {
+	ID      uuid.UUID
+	AdminID string
+	UserID  string
+	Motivo  string
+	IP      string
+	Vence   time.Time
+	// Fin es cuando el administrador volvió a su sesión. Si está vacío y no
+	// venció, sigue activa.
+	Fin       time.Time
+	CreatedAt time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (s Suplantacion) TableName() string {
+	return "suplantaciones"
+}
+
+// SuplantacionActiva es lo que los middlewares dejan en el contexto cuando la
+// sesión es de un administrador que suplanta al usuario, para que la
+// aplicación muestre un aviso.
+type SuplantacionActiva struct {
+	ID      string
+	AdminID string
+	Vence   time.Time
+}
+
+const claveSuplantacion claveContexto = 1
+
+// SuplantacionDeContexto devuelve la suplantación que agregó
+// MiddlewareSesion o MiddlewareOrganizacion. ok es false si la sesión es del
+// propio usuario.
+func SuplantacionDeContexto(ctx context.Context) (s SuplantacionActiva, ok bool) {
+	s, ok = ctx.Value(claveSuplantacion).(SuplantacionActiva)
+	return s, ok
+}
+
+// suplantacionClaims lee el claim act del token.
+func suplantacionClaims(claims jwt.MapClaims) (s SuplantacionActiva, ok bool) {
+	act, ok := claims[claimActor].(map[string]interface{})
+	if !ok {
+		return s, false
+	}
+	s.ID, _ = act["sid"].(string)
+	s.AdminID, _ = act["sub"].(string)
+	s.Vence = time.Unix(numeroClaim(act["exp"]), 0)
+	return s, true
+}
+
+// numeroClaim devuelve el valor numérico de un claim, que es float64 si el
+// token se parseó.
+func numeroClaim(v interface{}) int64 {
+	switch x := v.(type) {
+	case float64:
+		return int64(x)
+	case int64:
+		return x
+	}
+	return 0
+}
+
+// contextoSesion agrega al contexto la suplantación de la sesión, si la hay.
+func contextoSesion(ctx context.Context, claims jwt.MapClaims) context.Context {
+	if s, ok := suplantacionClaims(claims); ok {
+		return context.WithValue(ctx, claveSuplantacion, s)
+	}
+	return ctx
+}
+
+// MiddlewareSesion exige una sesión válida y agrega al contexto la
+// suplantación, si la sesión es de un administrador que suplanta al usuario.
+// Acepta también claves de API con el scope ScopeSesion.
+func (h *Handler) MiddlewareSesion(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if _, ok := extraerClaveAPI(r); ok {
+			_, err := h.UsuarioIDScope(r, ScopeSesion)
+			if err != nil {
+				httpErr(w, err, codigoHTTP(err, http.StatusUnauthorized))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, claims, err := h.sesionOrganizacion(r)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(contextoSesion(r.Context(), claims)))
+	})
+}
+
+// controlarSuplantacion corrobora que la suplantación del token no haya
+// terminado ni vencido y que el administrador siga siéndolo.
+func (h *Handler) controlarSuplantacion(s SuplantacionActiva) error {
+	sup := Suplantacion{}
+	err := h.db.First(&sup, "id = ?", s.ID).Error
+	if err == gorm.ErrRecordNotFound {
+		return errors.New("la suplantación no existe")
+	}
+	if err != nil {
+		return errors.Wrap(err, "buscando suplantación")
+	}
+	if !sup.Fin.IsZero() || time.Now().After(sup.Vence) {
+		return errors.New("la suplantación terminó")
+	}
+
+	admin, existe, err := h.existeUsuario(sup.AdminID)
+	if err != nil {
+		return errors.Wrap(err, "buscando administrador")
+	}
+	if !existe {
+		return errors.New("el administrador de la suplantación no existe")
+	}
+	err = controlarEstado(admin)
+	if err != nil {
+		return err
+	}
+	esAdmin, err := h.TieneRol(admin.ID, RolAdmin)
+	if err != nil {
+		return err
+	}
+	if !esAdmin {
+		return errors.New("el usuario que suplanta ya no es administrador")
+	}
+	return nil
+}
+
+// errSuplantando es el error de las operaciones que un administrador no puede
+// hacer mientras suplanta al usuario: las que crean credenciales que duran
+// más que la suplantación y los cambios de contraseña, mail o borrado de la
+// cuenta.
+var errSuplantando = errors.New("no se puede hacer mientras se suplanta al usuario")
+
+// suplantacionRequest devuelve la suplantación del token del request. Sólo
+// lee el token, no controla que siga vigente.
+func (h *Handler) suplantacionRequest(r *http.Request) (s SuplantacionActiva, ok bool) {
+	tokenString, err := extraerToken(r)
+	if err != nil {
+		return s, false
+	}
+	token, err := h.parseToken(tokenString)
+	if err != nil {
+		return s, false
+	}
+	return suplantacionClaims(token.Claims.(jwt.MapClaims))
+}
+
+// usuarioSesionActor es como usuarioSesion pero devuelve también el ID del
+// administrador que suplanta al usuario, o vacío si la sesión es propia.
+func (h *Handler) usuarioSesionActor(r *http.Request) (usuario Usuario, actor string, err error) {
+	usuario, claims, err := h.sesionOrganizacion(r)
+	if err != nil {
+		return usuario, actor, err
+	}
+	if s, ok := suplantacionClaims(claims); ok {
+		actor = s.AdminID
+	}
+	return usuario, actor, nil
+}
+
+// usuarioSesionPropia es como usuarioSesion pero rechaza con errSuplantando
+// las sesiones de un administrador que suplanta al usuario.
+func (h *Handler) usuarioSesionPropia(r *http.Request) (usuario Usuario, err error) {
+	if _, ok := h.suplantacionRequest(r); ok {
+		return usuario, errSuplantando
+	}
+	return h.usuarioSesion(r)
+}
+
+// codigoSesion devuelve el código de respuesta para el error de
+// usuarioSesionPropia.
+func codigoSesion(err error) int {
+	if err == errSuplantando {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// Suplantar inicia una sesión como otro usuario, para que soporte vea la
+// aplicación como la ve él. Sólo lo puede hacer un administrador, indicando
+// el motivo, y no puede suplantar a otro administrador. La sesión dura como
+// máximo DuracionSuplantacion y queda registrada.
+func (h *Handler) Suplantar() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			UserID string
+			Motivo string
+		}{}
+
+		admin, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+		_, claims, err := h.sesionOrganizacion(r)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+		if _, ok := suplantacionClaims(claims); ok {
+			httpErr(w, errors.New("ya está suplantando a un usuario"), http.StatusBadRequest)
+			return
+		}
+
+		err = json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(request.Motivo) == "" {
+			httpErr(w, errors.New("debe ingresar el motivo"), http.StatusBadRequest)
+			return
+		}
+		if request.UserID == admin.ID {
+			httpErr(w, errors.New("no puede suplantarse a sí mismo"), http.StatusBadRequest)
+			return
+		}
+
+		usuario, existe, err := h.existeUsuario(request.UserID)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando usuario"), http.StatusInternalServerError)
+			return
+		}
+		if !existe {
+			httpErr(w, errors.Errorf("no existe el usuario %v", request.UserID), http.StatusNotFound)
+			return
+		}
+		err = controlarEstado(usuario)
+		if err != nil {
+			httpErr(w, err, http.StatusBadRequest)
+			return
+		}
+		esAdmin, err := h.TieneRol(usuario.ID, RolAdmin)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		if esAdmin {
+			httpErr(w, errors.New("no se puede suplantar a un administrador"), http.StatusForbidden)
+			return
+		}
+
+		sup := Suplantacion{AdminID: admin.ID, UserID: usuario.ID, Motivo: request.Motivo, IP: ipRequest(r)}
+		sup.ID, _ = uuid.NewV4()
+		sup.Vence = time.Now().Add(h.DuracionSuplantacion)
+
+		e := nuevoEvento(EventoSuplantacionIniciada, usuario, r)
+		e.Datos = map[string]interface{}{"Admin": admin.ID, "Motivo": sup.Motivo, "Vence": sup.Vence}
+		err = h.validarEvento(e)
+		if err != nil {
+			httpErr(w, err, http.StatusForbidden)
+			return
+		}
+
+		// Token del usuario, con el administrador como actor
+		token, err := h.newToken(usuario.ID)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "creando token"), http.StatusInternalServerError)
+			return
+		}
+		h.agregarMetadatosToken(token, usuario)
+		err = h.agregarOrganizacionToken(token, usuario)
+		if err != nil {
+			h.logf("buscando organización de %v: %v", usuario.ID, err)
+		}
+		c := token.Claims.(jwt.MapClaims)
+		c[claimActor] = map[string]interface{}{"sub": admin.ID, "sid": sup.ID.String(), "exp": sup.Vence.Unix()}
+		if numeroClaim(c["exp"]) > sup.Vence.Unix() {
+			c["exp"] = sup.Vence.Unix()
+		}
+
+		err = h.db.Create(&sup).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "registrando suplantación"), http.StatusInternalServerError)
+			return
+		}
+
+		// Guardo la sesión del administrador para volver
+		original, err := extraerToken(r)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: cookieSuplantador, Value: original, Path: "/", Expires: sup.Vence, HttpOnly: true})
+		err = h.setToken(w, token)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "pegando token"), http.StatusInternalServerError)
+			return
+		}
+		h.emitir(e)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sup)
+	}
+}
+
+// FinalizarSuplantacion termina la suplantación y devuelve al administrador
+// a su sesión. Si su sesión venció mientras tanto, tiene que volver a
+// ingresar.
+func (h *Handler) FinalizarSuplantacion() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		tokenString, err := extraerToken(r)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+		token, err := h.parseToken(tokenString)
+		if err != nil {
+			httpErr(w, err, http.StatusUnauthorized)
+			return
+		}
+		s, ok := suplantacionClaims(token.Claims.(jwt.MapClaims))
+		if !ok {
+			httpErr(w, errors.New("la sesión no es una suplantación"), http.StatusBadRequest)
+			return
+		}
+
+		sup := Suplantacion{}
+		err = h.db.First(&sup, "id = ?", s.ID).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando suplantación"), http.StatusInternalServerError)
+			return
+		}
+		if sup.Fin.IsZero() {
+			sup.Fin = time.Now()
+			err = h.db.Model(&sup).Update("fin", sup.Fin).Error
+			if err != nil {
+				httpErr(w, errors.Wrap(err, "registrando fin de la suplantación"), http.StatusInternalServerError)
+				return
+			}
+			usuario, _, err := h.existeUsuario(sup.UserID)
+			if err != nil {
+				h.logf("buscando usuario %v: %v", sup.UserID, err)
+			}
+			e := nuevoEvento(EventoSuplantacionFinalizada, usuario, r)
+			e.Datos = map[string]interface{}{"Admin": sup.AdminID, "Motivo": sup.Motivo}
+			h.emitir(e)
+		}
+
+		// Vuelvo a la sesión del administrador
+		http.SetCookie(w, &http.Cookie{Name: cookieSuplantador, Path: "/", MaxAge: -1, HttpOnly: true})
+		original, err := h.sesionSuplantador(r, sup.AdminID)
+		if err != nil {
+			h.setTokenVencido(w, token)
+			httpErr(w, errors.Wrap(err, "debe volver a ingresar"), http.StatusUnauthorized)
+			return
+		}
+		err = h.setToken(w, original)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "pegando token"), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// sesionSuplantador devuelve renovado el token que tenía el administrador
+// antes de suplantar, si sigue siendo válido.
+func (h *Handler) sesionSuplantador(r *http.Request, adminID string) (token *jwt.Token, err error) {
+	c, err := r.Cookie(cookieSuplantador)
+	if err != nil {
+		return nil, errors.Wrap(err, "buscando sesión del administrador")
+	}
+	token, err = h.chequearToken(c.Value)
+	if err != nil {
+		return nil, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["userID"] != adminID {
+		return nil, errors.New("la sesión guardada es de otro usuario")
+	}
+	usuario, err := h.controlarSesion(claims)
+	if err != nil {
+		return nil, err
+	}
+	h.agregarMetadatosToken(token, usuario)
+	return token, nil
+}
+
+// Suplantaciones devuelve el registro de suplantaciones, las más recientes
+// primero. Con el parámetro "id" sólo las de ese usuario. Sólo lo puede ver
+// un administrador.
+func (h *Handler) Suplantaciones() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		_, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		q := h.db.Order("created_at DESC")
+		if id := r.URL.Query().Get("id"); id != "" {
+			q = q.Where("user_id = ?", id)
+		}
+		ss := []Suplantacion{}
+		err := q.Limit(500).Find(&ss).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando suplantaciones"), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ss)
+	}
+}
@@ -0,0 +1,113 @@
+package sesiones
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenSuplantacion(t *testing.T) {
+	h := Handler{}
+	h.secretKey = []byte("secreto")
+	h.DuracionSesion = time.Hour
+
+	vence := time.Now().Add(10 * time.Minute)
+	token, err := h.newToken("cliente")
+	assert.Nil(t, err)
+	token.Claims.(jwt.MapClaims)[claimActor] = map[string]interface{}{"sub": "soporte", "sid": "s1", "exp": vence.Unix()}
+	tokenString, err := token.SignedString(h.secretKey)
+	assert.Nil(t, err)
+
+	// Al renovarlo conserva el actor y no dura más que la suplantación
+	t2, err := h.chequearToken(tokenString)
+	assert.Nil(t, err)
+	claims := t2.Claims.(jwt.MapClaims)
+	assert.Equal(t, vence.Unix(), numeroClaim(claims["exp"]))
+
+	tokenString, err = t2.SignedString(h.secretKey)
+	assert.Nil(t, err)
+	t3, err := h.parseToken(tokenString)
+	assert.Nil(t, err)
+	s, ok := suplantacionClaims(t3.Claims.(jwt.MapClaims))
+	assert.True(t, ok)
+	assert.Equal(t, SuplantacionActiva{"s1", "soporte", time.Unix(vence.Unix(), 0)}, s)
+
+	// Lo que ve la aplicación
+	ctx := contextoSesion(context.Background(), t3.Claims.(jwt.MapClaims))
+	s, ok = SuplantacionDeContexto(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "soporte", s.AdminID)
+
+	// Una sesión normal no tiene suplantación
+	t4, err := h.newToken("cliente")
+	assert.Nil(t, err)
+	_, ok = SuplantacionDeContexto(contextoSesion(context.Background(), t4.Claims.(jwt.MapClaims)))
+	assert.False(t, ok)
+}
+
+func TestSuplantarSinSesion(t *testing.T) {
+	h := &Handler{}
+	h.secretKey = []byte("secreto")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/suplantar_usuario", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/finalizar_suplantacion", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestOperacionesSuplantando(t *testing.T) {
+	h := &Handler{}
+	h.secretKey = []byte("secreto")
+	h.DuracionSesion = time.Hour
+	h.OIDC = &ConfigOIDC{}
+	h.MailCambioMail = &MailTemplate{}
+	h.ProveedoresExternos = []*ProveedorExterno{{Nombre: "externo"}}
+
+	token, err := h.newToken("cliente")
+	assert.Nil(t, err)
+	token.Claims.(jwt.MapClaims)[claimActor] = map[string]interface{}{"sub": "soporte", "sid": "s1", "exp": time.Now().Add(time.Minute).Unix()}
+	tokenString, err := token.SignedString(h.secretKey)
+	assert.Nil(t, err)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "token", Value: tokenString})
+	s, ok := h.suplantacionRequest(r)
+	assert.True(t, ok)
+	assert.Equal(t, "soporte", s.AdminID)
+
+	// Se rechazan antes de ir a la base
+	for nombre, f := range map[string]http.HandlerFunc{
+		"NuevaClaveAPI":        h.NuevaClaveAPI(),
+		"ConsentirOIDC":        h.ConsentirOIDC(),
+		"VerificarDispositivo": h.VerificarDispositivo(),
+		"IngresoExterno":       h.IngresoExterno(),
+		"DesvincularExterno":   h.DesvincularExterno(),
+		"CambiarContraseña":    h.CambiarContraseña(),
+		"CambiarMail":          h.CambiarMail(),
+		"BorrarCuenta":         h.BorrarCuenta(),
+	} {
+		r := httptest.NewRequest("POST", "/?proveedor=externo&vincular=true", nil)
+		r.AddCookie(&http.Cookie{Name: "token", Value: tokenString})
+		w := httptest.NewRecorder()
+		f(w, r)
+		assert.Equal(t, http.StatusForbidden, w.Code, nombre)
+	}
+
+	// Una sesión propia no es una suplantación
+	token, err = h.newToken("cliente")
+	assert.Nil(t, err)
+	tokenString, err = token.SignedString(h.secretKey)
+	assert.Nil(t, err)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "token", Value: tokenString})
+	_, ok = h.suplantacionRequest(r)
+	assert.False(t, ok)
+}
@@ -3,9 +3,13 @@ package sesiones
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"net/http"
+	"strings"
 	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gofrs/uuid"
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
@@ -13,25 +17,73 @@ import (
 
 const (
 	EstadoPendienteConfirmación = "Pendiente de confirmación"
-	EstadoConfirmado            = "Confirmado"
+	// EstadoPendienteAprobacion es el estado de los usuarios que ya
+	// confirmaron su mail, cuando un administrador tiene que aprobarlos
+	// (ver Handler.RequiereAprobacion).
+	EstadoPendienteAprobacion = "Pendiente de aprobación"
+	EstadoConfirmado          = "Confirmado"
+	EstadoRechazado           = "Rechazado"
+	// EstadoSuspendido es un usuario que un administrador suspendió
+	// temporalmente.
+	EstadoSuspendido = "Suspendido"
+	// EstadoDeshabilitado es un usuario dado de baja que puede volver a
+	// habilitarse.
+	EstadoDeshabilitado = "Deshabilitado"
+	// EstadoBloqueado es un usuario bloqueado por motivos de seguridad.
+	EstadoBloqueado = "Bloqueado"
+	// EstadoBorrado es un usuario eliminado. Es definitivo.
+	EstadoBorrado = "Borrado"
 )
 
 // Usuario es cada usuario que ingresará al sistema
 type Usuario struct {
-	ID                            string
-	Nombre                        string
-	Apellido                      string
-	Hash                          string
-	BlanquearProximoIngreso       bool
+	// ID es un UUID que no cambia nunca. Es el que va en el token y el que
+	// deben usar las otras aplicaciones para referenciar al usuario.
+	ID string
+	// Email es la dirección con la que se ingresa, normalizada con
+	// normalizarLogin. Es única.
+	Email string
+	// Username es un nombre de usuario opcional con el que también se puede
+	// ingresar. Si está, es único (hay un índice único parcial que ignora
+	// los vacíos).
+	Username string
+	Nombre   string
+	Apellido string
+	// Idioma es una etiqueta BCP 47, por ejemplo "es-AR"
+	Idioma string
+	// ZonaHoraria es un nombre de la base IANA, por ejemplo
+	// "America/Argentina/Buenos_Aires"
+	ZonaHoraria string
+	// Telefono está en formato E.164, por ejemplo "+5493415551234"
+	Telefono string
+	// Metadatos son los atributos definidos en Handler.Atributos
+	Metadatos               Metadatos `gorm:"type:text"`
+	Hash                    string    `json:"-"`
+	BlanquearProximoIngreso bool
+	// MotivoBlanqueo es por qué tiene que blanquear la contraseña:
+	// "password_temporal", "no_fui_yo" o "forzado".
+	MotivoBlanqueo                string
 	Estado                        string
 	UltimaActualizacionContraseña time.Time
-	CreatedAt                     time.Time
-	UpdatedAt                     time.Time
+	// SesionesValidasDesde invalida todos los tokens emitidos antes de esta
+	// fecha.
+	SesionesValidasDesde time.Time
+	// AvisoVencimientoEnviado es la fecha del último aviso de que la
+	// contraseña estaba por vencer.
+	AvisoVencimientoEnviado time.Time
+	// BajaSolicitada es la fecha en que el usuario pidió borrar su cuenta.
+	// Cero si no la pidió o si la restauró.
+	BajaSolicitada time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
 }
 
 const (
 	MotivoCreacion = "Creación"
 	MotivoBlanqueo = "Blanqueo"
+	// MotivoCambioMail es la confirmación que se le manda a la dirección
+	// nueva cuando el usuario cambia su mail.
+	MotivoCambioMail = "Cambio de mail"
 )
 
 type UsuarioConfirmacion struct {
@@ -41,6 +93,9 @@ type UsuarioConfirmacion struct {
 	Motivo            string
 	Confirmada        bool
 	FechaConfirmacion time.Time
+	// MailNuevo es la dirección a la que se cambia el usuario, sólo para
+	// MotivoCambioMail.
+	MailNuevo string
 }
 
 // TableName devuelve el nombre de la tabla en la base de datos
@@ -48,6 +103,25 @@ func (u UsuarioConfirmacion) TableName() string {
 	return "usuario_confirmaciones"
 }
 
+// vencida devuelve true si pasó más de duracion desde que se creó la
+// confirmación. Si la duración es cero no vence.
+func (c UsuarioConfirmacion) vencida(duracion time.Duration) bool {
+	return duracion > 0 && time.Since(c.CreatedAt) > duracion
+}
+
+// usarConfirmacion marca la confirmación como usada. Devuelve false si ya
+// estaba usada, aunque lleguen dos pedidos juntos.
+func usarConfirmacion(tx *gorm.DB, id uuid.UUID) (ok bool, err error) {
+	res := tx.
+		Model(&UsuarioConfirmacion{}).
+		Where("id = ? AND confirmada = ?", id, false).
+		Update(map[string]interface{}{"Confirmada": true, "FechaConfirmacion": time.Now()})
+	if res.Error != nil {
+		return false, errors.Wrap(res.Error, "marcando confirmación como usada")
+	}
+	return res.RowsAffected == 1, nil
+}
+
 var (
 
 	// ErrDirectivaPassword significa que la contraseña ingresada no cumplía con
@@ -55,9 +129,62 @@ var (
 	ErrDirectivaPassword = errors.New("error de validación")
 )
 
-// Borrar borra el usuario de la tabla de usuarios.
+// Borrar borra definitivamente el usuario y todos sus registros, y llama a
+// AlBorrarUsuario. Para dar de baja un usuario conservando el historial usar
+// AnonimizarUsuario.
 func (h *Handler) Borrar(u Usuario) error {
-	return h.db.Delete(&u).Error
+	e := nuevoEvento(EventoUsuarioBorrado, u, nil)
+	err := h.validarEvento(e)
+	if err != nil {
+		return err
+	}
+
+	tx := h.db.Begin()
+	for _, v := range []interface{}{
+		&UsuarioConfirmacion{},
+		&UsuarioDispositivo{},
+		&UsuarioRol{},
+		&UsuarioCambioEstado{},
+		&UsuarioCambioPerfil{},
+		&IdentidadExterna{},
+		&ClaveAPI{},
+		&MiembroOrganizacion{},
+		&Suplantacion{},
+		&ConsentimientoOIDC{},
+		&CodigoOIDC{},
+		&AutorizacionDispositivo{},
+	} {
+		err = tx.Where("user_id = ?", u.ID).Delete(v).Error
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "borrando registros del usuario")
+		}
+	}
+	err = borrarEntregasUsuario(tx, u.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if h.AlBorrarUsuario != nil {
+		err = h.AlBorrarUsuario(tx, u.ID)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "borrando datos de la aplicación")
+		}
+	}
+
+	err = tx.Delete(&u).Error
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "borrando usuario")
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return errors.Wrap(err, "confirmando transaccion")
+	}
+	h.emitir(e)
+	return nil
 }
 
 // blanquearPassword le pone la nueva contraseña al usuario. No realiza control
@@ -75,13 +202,38 @@ func (h *Handler) blanquearPassword(usuarioID, nuevaContraseña string, blanquea
 	usuario.Hash = calcularHash(nuevaContraseña)
 	usuario.UltimaActualizacionContraseña = time.Now()
 	usuario.BlanquearProximoIngreso = blanquearLuego
+	usuario.MotivoBlanqueo = ""
+	if blanquearLuego {
+		usuario.MotivoBlanqueo = motivoBlanqueoTemporal
+	}
+
+	e := nuevoEvento(EventoPasswordCambiada, usuario, nil)
+	e.Datos = map[string]interface{}{"BlanquearProximoIngreso": blanquearLuego}
+	err = h.validarEvento(e)
+	if err != nil {
+		return err
+	}
 
 	// Persisto
-	err = h.db.Save(&usuario).Error
+	tx := h.db.Begin()
+	err = tx.Save(&usuario).Error
 	if err != nil {
+		tx.Rollback()
 		return errors.Wrap(err, "al intentar blanquear password")
 	}
 
+	// Las claves de API se crearon con la contraseña anterior
+	err = revocarClavesAPI(tx, usuario.ID, revocadaCambioContraseña)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return errors.Wrap(err, "confirmando transaccion")
+	}
+	h.emitir(e)
+
 	return nil
 }
 
@@ -116,6 +268,28 @@ func calcularHash(password string) (hash string) {
 	return hex.EncodeToString(enBytes[:])
 }
 
+// normalizarLogin deja el mail o nombre de usuario en la forma en que se
+// guarda en la base de datos: sin espacios alrededor, en minúsculas y en
+// forma normal NFC.
+func normalizarLogin(s string) string {
+	return strings.ToLower(norm.NFC.String(strings.TrimSpace(s)))
+}
+
+// buscarUsuario busca el usuario por su mail o nombre de usuario.
+func (h *Handler) buscarUsuario(login string) (usuario Usuario, existe bool, err error) {
+	login = normalizarLogin(login)
+	if login == "" {
+		return usuario, false, nil
+	}
+
+	err = h.db.Where("email = ? OR username = ?", login, login).First(&usuario).Error
+	if err == gorm.ErrRecordNotFound {
+		return usuario, false, nil
+	}
+
+	return usuario, true, err
+}
+
 // ExisteUsuario corrobora si el id de usuario ingresado se encuentra en la base de datos.
 func (h *Handler) existeUsuario(userID string) (usuario Usuario, existe bool, err error) {
 
@@ -157,40 +331,115 @@ func (h *Handler) coincideUserYPass(userID, password string) error {
 	return nil
 }
 
+// reautenticacionReciente es cuánto vale un ingreso como confirmación de
+// identidad de los usuarios que no tienen contraseña propia.
+const reautenticacionReciente = 5 * time.Minute
+
+// reautenticar vuelve a corroborar la identidad del usuario de la sesión
+// antes de una operación delicada. Si tiene contraseña propia se controla con
+// el hash. Si no, por ejemplo porque ingresa por LDAP o con un proveedor
+// externo, vale la contraseña si la reconoce alguno de los Autenticadores, o
+// un ingreso de hace menos de reautenticacionReciente.
+func (h *Handler) reautenticar(r *http.Request, usuario Usuario, password string) error {
+	if usuario.Hash != "" {
+		return compararPaswords(password, usuario.Hash)
+	}
+
+	if password != "" {
+		for _, login := range []string{usuario.Email, usuario.Username} {
+			if login == "" {
+				continue
+			}
+			u, err := h.checkPass(login, password)
+			if err == nil && u.ID == usuario.ID {
+				return nil
+			}
+		}
+	}
+
+	tokenString, err := extraerToken(r)
+	if err != nil {
+		return errors.Wrap(err, "extrayendo token de request")
+	}
+	token, err := h.parseToken(tokenString)
+	if err != nil {
+		return errors.Wrap(err, "parseando token")
+	}
+	ingreso := time.Unix(numeroClaim(token.Claims.(jwt.MapClaims)["iat"]), 0)
+	if time.Since(ingreso) > reautenticacionReciente {
+		return ErrAutenticacion{"tiene que volver a ingresar para confirmar que es usted"}
+	}
+	return nil
+}
+
 // checkPass prueba si está en condiciones de hacer el login. No hace ninguna acción.
-func (h *Handler) checkPass(userID, password string) error {
+// login puede ser el mail o el nombre de usuario.
+func (h *Handler) checkPass(login, password string) (usuario Usuario, err error) {
+	autenticadores := h.Autenticadores
+	if len(autenticadores) == 0 {
+		autenticadores = []Autenticador{h.AutenticadorBase()}
+	}
+
+	// Pruebo en orden hasta que alguno reconozca las credenciales
+	for _, a := range autenticadores {
+		usuario, err = a.Autenticar(login, password)
+		switch errors.Cause(err).(type) {
+		case ErrAutenticacion:
+			continue
+		case ErrAutenticadorNoDisponible:
+			h.logf("autenticando %v: %v", login, err)
+			continue
+		}
+		return usuario, err
+	}
+	return usuario, err
+}
+
+// autenticarBase corrobora usuario y contraseña con el hash de la base de
+// datos.
+func (h *Handler) autenticarBase(login, password string) (usuario Usuario, err error) {
 	// Corroboro que exista el usuario
-	usuario, existe, err := h.existeUsuario(userID)
+	usuario, existe, err := h.buscarUsuario(login)
 	if err != nil {
-		return err
+		return usuario, err
 	}
 
 	if existe == false {
-		return ErrAutenticacion{"el usuario no existe"}
+		return usuario, ErrAutenticacion{"el usuario no existe"}
 	}
 
 	// Corroboro que coincida la password.
 	// "4cf6829aa93728e8f3c97df913fb1bfa95fe5810e2933a05943f8312a98d9cf2",
 	err = compararPaswords(password, usuario.Hash)
 	if err != nil {
-		return ErrAutenticacion{"usuario o contraseña incorrectos"}
+		return usuario, ErrAutenticacion{"usuario o contraseña incorrectos"}
+	}
+
+	err = h.controlarBlanqueo(usuario)
+	if err != nil {
+		return usuario, err
 	}
 
+	return usuario, controlarEstado(usuario)
+}
+
+// controlarBlanqueo devuelve ErrCorrespondeBlanquear si el usuario tiene que
+// cambiar la contraseña antes de ingresar.
+func (h *Handler) controlarBlanqueo(usuario Usuario) (err error) {
 	if usuario.BlanquearProximoIngreso {
+		if !blanqueoConContraseña(usuario) {
+			return ErrCorrespondeBlanquear{"hay que pedir el link de blanqueo por mail"}
+		}
 		return ErrCorrespondeBlanquear{}
 	}
 
 	// ¿Está vencida la clave? =>
-	vigente, err := h.estaVigentePassword(userID)
+	vigente, err := h.estaVigentePassword(usuario.ID)
 	if err != nil {
 		return errors.Wrap(err, "no se pudo corroborar si la contraseña estaba vigente")
 	}
 	if !vigente {
 		return ErrCorrespondeBlanquear{"la contraseña ha caducado"}
 	}
-
-	if usuario.Estado == EstadoPendienteConfirmación {
-		return ErrCorrespondeConfirmarMail{}
-	}
 	return nil
 }
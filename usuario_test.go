@@ -0,0 +1,14 @@
+package sesiones
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizarLogin(t *testing.T) {
+	assert.Equal(t, "ornela@sweet.com.ar", normalizarLogin("  Ornela@Sweet.com.AR "))
+
+	// "é" compuesta y descompuesta tienen que quedar iguales
+	assert.Equal(t, "jos\u00e9", normalizarLogin("JOSE\u0301"))
+}
@@ -0,0 +1,123 @@
+package sesiones
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HeaderVencimientoPassword es el header que agrega Login cuando la contraseña
+// del usuario vence dentro del plazo de AvisoVencimiento. El valor es la
+// fecha de vencimiento en formato RFC 3339.
+const HeaderVencimientoPassword = "X-Vencimiento-Password"
+
+// vencimientoPassword devuelve la fecha en que caduca la contraseña del
+// usuario. Si la contraseña no caduca devuelve false.
+func (h *Handler) vencimientoPassword(usuario Usuario) (vencimiento time.Time, caduca bool) {
+	if h.PassValidez == 0 {
+		return vencimiento, false
+	}
+	return usuario.UltimaActualizacionContraseña.Add(h.PassValidez), true
+}
+
+// porVencer devuelve true si la contraseña del usuario vence dentro del plazo
+// de AvisoVencimiento.
+func (h *Handler) porVencer(usuario Usuario) (vencimiento time.Time, ok bool) {
+	if h.AvisoVencimiento == 0 {
+		return vencimiento, false
+	}
+	vencimiento, caduca := h.vencimientoPassword(usuario)
+	if !caduca {
+		return vencimiento, false
+	}
+	ahora := time.Now()
+	return vencimiento, vencimiento.After(ahora) && !vencimiento.After(ahora.Add(h.AvisoVencimiento))
+}
+
+// informarVencimiento agrega a la respuesta del login el header con la fecha de
+// vencimiento si la contraseña está por vencer.
+func (h *Handler) informarVencimiento(w http.ResponseWriter, usuario Usuario) {
+	vencimiento, ok := h.porVencer(usuario)
+	if !ok {
+		return
+	}
+	w.Header().Set(HeaderVencimientoPassword, vencimiento.Format(time.RFC3339))
+}
+
+// AvisarVencimientos le manda un mail a los usuarios cuya contraseña vence
+// dentro del plazo de AvisoVencimiento. Cada usuario recibe un solo aviso
+// por contraseña.
+//
+// Está pensada para ser llamada periódicamente, ver IniciarAvisosVencimiento.
+func (h *Handler) AvisarVencimientos() (err error) {
+	if h.AvisoVencimiento == 0 || h.PassValidez == 0 || h.MailAvisoVencimiento == nil {
+		return nil
+	}
+
+	// Las contraseñas que vencen entre ahora y ahora + AvisoVencimiento
+	ahora := time.Now()
+	desde := ahora.Add(-h.PassValidez)
+	hasta := desde.Add(h.AvisoVencimiento)
+
+	usuarios := []Usuario{}
+	err = h.db.
+		Where("estado = ? AND blanquear_proximo_ingreso = ?", EstadoConfirmado, false).
+		Where("ultima_actualizacion_contraseña > ? AND ultima_actualizacion_contraseña <= ?", desde, hasta).
+		Find(&usuarios).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "buscando usuarios con contraseña por vencer")
+	}
+
+	for _, u := range usuarios {
+
+		// ¿Ya le avisé por esta contraseña?
+		if u.AvisoVencimientoEnviado.After(u.UltimaActualizacionContraseña) {
+			continue
+		}
+
+		vencimiento, _ := h.vencimientoPassword(u)
+		body, err := h.MailAvisoVencimiento.bodyAviso(u.Nombre, "", datosAviso{Fecha: ahora, Vencimiento: vencimiento})
+		if err != nil {
+			return errors.Wrap(err, "generando el body del mail")
+		}
+
+		err = h.MailSender.Send(u.Email, h.MailSender.SenderAlias(), "Tu contraseña está por vencer", body)
+		if err != nil {
+			h.logf("avisando vencimiento de contraseña a %v: %v", u.ID, err)
+			continue
+		}
+
+		err = h.db.Model(&u).Update("aviso_vencimiento_enviado", ahora).Error
+		if err != nil {
+			return errors.Wrap(err, "registrando aviso de vencimiento")
+		}
+	}
+
+	return nil
+}
+
+// IniciarAvisosVencimiento llama a AvisarVencimientos cada intervalo hasta que
+// se llame a la función devuelta.
+func (h *Handler) IniciarAvisosVencimiento(intervalo time.Duration) (detener func()) {
+	fin := make(chan struct{})
+	ticker := time.NewTicker(intervalo)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				err := h.AvisarVencimientos()
+				if err != nil {
+					h.logf("avisando vencimientos de contraseña: %v", err)
+				}
+			case <-fin:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(fin) }
+}
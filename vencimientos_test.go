@@ -0,0 +1,41 @@
+package sesiones
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPorVencer(t *testing.T) {
+	h := Handler{}
+	h.PassValidez = 30 * 24 * time.Hour
+	h.AvisoVencimiento = 5 * 24 * time.Hour
+
+	u := Usuario{}
+
+	// Vence en 10 días
+	u.UltimaActualizacionContraseña = time.Now().Add(-20 * 24 * time.Hour)
+	_, ok := h.porVencer(u)
+	assert.False(t, ok)
+
+	// Vence en 2 días
+	u.UltimaActualizacionContraseña = time.Now().Add(-28 * 24 * time.Hour)
+	venc, ok := h.porVencer(u)
+	assert.True(t, ok)
+	rec := httptest.NewRecorder()
+	h.informarVencimiento(rec, u)
+	assert.Equal(t, venc.Format(time.RFC3339), rec.Header().Get(HeaderVencimientoPassword))
+
+	// Ya venció
+	u.UltimaActualizacionContraseña = time.Now().Add(-31 * 24 * time.Hour)
+	_, ok = h.porVencer(u)
+	assert.False(t, ok)
+
+	// Sin aviso
+	h.AvisoVencimiento = 0
+	u.UltimaActualizacionContraseña = time.Now().Add(-28 * 24 * time.Hour)
+	_, ok = h.porVencer(u)
+	assert.False(t, ok)
+}
@@ -0,0 +1,647 @@
+package sesiones
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Headers de los webhooks
+const (
+	// HeaderFirmaWebhook lleva "t=<unix>,v1=<hex>", donde v1 es el
+	// HMAC-SHA256 con el secreto del webhook de "<t>.<body>".
+	HeaderFirmaWebhook   = "X-Sesiones-Firma"
+	HeaderEventoWebhook  = "X-Sesiones-Evento"
+	HeaderEntregaWebhook = "X-Sesiones-Entrega"
+)
+
+// Estados de las entregas
+const (
+	EntregaPendiente = "Pendiente"
+	EntregaEntregada = "Entregada"
+	EntregaFallida   = "Fallida"
+)
+
+const (
+	webhookMaxIntentosDefault = 8
+	webhookEsperaInicial      = 30 * time.Second
+	webhookTimeout            = 10 * time.Second
+	// webhookReserva es el tiempo que una entrega queda tomada por el
+	// proceso que la está mandando. Si el proceso se cae, pasado este tiempo
+	// la toma otro.
+	webhookReserva = time.Minute
+)
+
+// eventosWebhook son los eventos que se mandan a los webhooks.
+var eventosWebhook = []TipoEvento{
+	EventoUsuarioCreado,
+	EventoUsuarioConfirmado,
+	EventoSesionIniciada,
+	EventoLoginFallido,
+	EventoPasswordCambiada,
+	EventoUsuarioBorrado,
+	EventoSuplantacionIniciada,
+	EventoSuplantacionFinalizada,
+}
+
+// Webhook es una URL a la que se le mandan los eventos de las cuentas.
+type Webhook struct {
+	ID  uuid.UUID
+	URL string
+	// Secreto es la clave de la firma. Sólo se muestra al crearlo.
+	Secreto string `json:"-"`
+	// Eventos son los tipos de evento que recibe, separados por coma. Vacío
+	// recibe todos.
+	Eventos   string
+	Activo    bool
+	CreadoPor string
+	CreatedAt time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (w Webhook) TableName() string {
+	return "webhooks"
+}
+
+// recibe devuelve true si el webhook está suscripto al evento.
+func (w Webhook) recibe(tipo TipoEvento) bool {
+	if w.Eventos == "" {
+		return true
+	}
+	for _, v := range strings.Split(w.Eventos, ",") {
+		if TipoEvento(strings.TrimSpace(v)) == tipo {
+			return true
+		}
+	}
+	return false
+}
+
+// EntregaWebhook es cada evento que hay que mandarle a un webhook. Queda en
+// la base hasta que se entrega o se agotan los intentos.
+type EntregaWebhook struct {
+	ID        uuid.UUID
+	WebhookID uuid.UUID
+	Evento    TipoEvento
+	// UserID es el usuario del evento, para borrar sus entregas cuando se
+	// borra el usuario
+	UserID         string `gorm:"index"`
+	Payload        string `gorm:"type:text"`
+	Estado         string
+	Intentos       int
+	ProximoIntento time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (e EntregaWebhook) TableName() string {
+	return "webhook_entregas"
+}
+
+// IntentoWebhook es el registro de cada intento de entrega.
+type IntentoWebhook struct {
+	ID        uuid.UUID
+	EntregaID uuid.UUID
+	Fecha     time.Time
+	// Codigo es el status HTTP de la respuesta, cero si no hubo
+	Codigo   int
+	Error    string
+	Duracion time.Duration
+}
+
+// TableName devuelve el nombre de la tabla en la base de datos
+func (i IntentoWebhook) TableName() string {
+	return "webhook_intentos"
+}
+
+// firmarWebhook devuelve el valor de HeaderFirmaWebhook.
+func firmarWebhook(secreto string, t time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secreto))
+	fmt.Fprintf(mac, "%d.", t.Unix())
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%x", t.Unix(), mac.Sum(nil))
+}
+
+// VerificarFirmaWebhook corrobora la firma de un webhook recibido. tolerancia
+// es la antigüedad máxima aceptada, para evitar que se repita un request
+// interceptado.
+func VerificarFirmaWebhook(secreto, firma string, body []byte, tolerancia time.Duration) error {
+	var t int64
+	var v1 []byte
+	for _, parte := range strings.Split(firma, ",") {
+		kv := strings.SplitN(parte, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			t, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "v1":
+			v1, _ = hex.DecodeString(kv[1])
+		}
+	}
+	if t == 0 || v1 == nil {
+		return errors.New("firma mal formada")
+	}
+
+	fecha := time.Unix(t, 0)
+	if tolerancia > 0 && time.Since(fecha) > tolerancia {
+		return errors.New("la firma está vencida")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secreto))
+	fmt.Fprintf(mac, "%d.", t)
+	mac.Write(body)
+	if !hmac.Equal(v1, mac.Sum(nil)) {
+		return errors.New("la firma no coincide")
+	}
+	return nil
+}
+
+// esperaWebhook es el tiempo hasta el próximo intento después de fallar
+// intentos veces.
+func esperaWebhook(intentos int) time.Duration {
+	if intentos < 1 {
+		intentos = 1
+	}
+	if intentos > 16 {
+		intentos = 16
+	}
+	return webhookEsperaInicial << uint(intentos-1)
+}
+
+// IniciarWebhooks empieza a mandar los eventos a los webhooks registrados.
+// Cada intervalo se reintentan las entregas pendientes. Desde que se llama,
+// las entregas de cada evento se guardan en el mismo request, antes de
+// responder, para no perderlas si el proceso termina; las entregas se dejan
+// de procesar al llamar a la función devuelta.
+func (h *Handler) IniciarWebhooks(intervalo time.Duration) (detener func()) {
+	h.eventos.mu.Lock()
+	h.eventos.webhooks = true
+	h.eventos.mu.Unlock()
+
+	fin := make(chan struct{})
+	ticker := time.NewTicker(intervalo)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				err := h.EntregarWebhooks()
+				if err != nil {
+					h.logf("entregando webhooks: %v", err)
+				}
+			case <-fin:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(fin) }
+}
+
+// encolarWebhooks crea una entrega para cada webhook suscripto al evento.
+func (h *Handler) encolarWebhooks(e Evento) (err error) {
+	enviado := false
+	for _, v := range eventosWebhook {
+		enviado = enviado || v == e.Tipo
+	}
+	if !enviado {
+		return nil
+	}
+
+	webhooks := []Webhook{}
+	err = h.db.Where("activo = ?", true).Find(&webhooks).Error
+	if err != nil {
+		return errors.Wrap(err, "buscando webhooks")
+	}
+
+	for _, w := range webhooks {
+		if !w.recibe(e.Tipo) {
+			continue
+		}
+
+		ent := EntregaWebhook{}
+		ent.ID, _ = uuid.NewV4()
+		ent.WebhookID = w.ID
+		ent.Evento = e.Tipo
+		ent.UserID = e.Usuario.ID
+		ent.Estado = EntregaPendiente
+		ent.ProximoIntento = time.Now()
+
+		b, err := json.Marshal(nuevoPayloadWebhook(ent.ID, e))
+		if err != nil {
+			return errors.Wrap(err, "serializando evento")
+		}
+		ent.Payload = string(b)
+
+		err = h.db.Create(&ent).Error
+		if err != nil {
+			return errors.Wrap(err, "creando entrega")
+		}
+	}
+	return nil
+}
+
+// payloadWebhook es lo que se le manda al webhook. Del usuario va sólo el
+// ID, para no dejar sus datos personales en las entregas; el receptor los
+// puede consultar si los necesita.
+type payloadWebhook struct {
+	ID     uuid.UUID
+	Tipo   TipoEvento
+	Fecha  time.Time
+	UserID string
+	IP     string                 `json:",omitempty"`
+	Datos  map[string]interface{} `json:",omitempty"`
+}
+
+func nuevoPayloadWebhook(id uuid.UUID, e Evento) payloadWebhook {
+	return payloadWebhook{
+		ID:     id,
+		Tipo:   e.Tipo,
+		Fecha:  e.Fecha,
+		UserID: e.Usuario.ID,
+		IP:     e.IP,
+		Datos:  e.Datos,
+	}
+}
+
+// EntregarWebhooks manda las entregas pendientes cuyo próximo intento ya
+// llegó. Un error en una entrega se loguea y se sigue con las demás.
+func (h *Handler) EntregarWebhooks() (err error) {
+	ahora := time.Now()
+	entregas := []EntregaWebhook{}
+	err = h.db.
+		Where("estado = ? AND proximo_intento <= ?", EntregaPendiente, ahora).
+		Order("created_at").
+		Find(&entregas).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "buscando entregas pendientes")
+	}
+
+	for _, ent := range entregas {
+		ok, err := h.reservarEntrega(ent, ahora)
+		if err != nil {
+			h.logf("reservando entrega %v: %v", ent.ID, err)
+			continue
+		}
+		if !ok {
+			// La tomó otro proceso
+			continue
+		}
+		err = h.entregarWebhook(ent)
+		if err != nil {
+			h.logf("entregando %v: %v", ent.ID, err)
+		}
+	}
+	return nil
+}
+
+// reservarEntrega toma la entrega corriendo el próximo intento, para que si
+// hay varios procesos entregando no la mande más de uno. Devuelve false si
+// ya la había tomado otro.
+func (h *Handler) reservarEntrega(ent EntregaWebhook, ahora time.Time) (ok bool, err error) {
+	res := h.db.
+		Model(&EntregaWebhook{}).
+		Where("id = ? AND estado = ? AND proximo_intento <= ?", ent.ID, EntregaPendiente, ahora).
+		Update("proximo_intento", ahora.Add(webhookReserva))
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// borrarEntregasUsuario borra las entregas de los eventos del usuario y sus
+// intentos.
+func borrarEntregasUsuario(tx *gorm.DB, userID string) (err error) {
+	entregas := tx.Model(&EntregaWebhook{}).Select("id").Where("user_id = ?", userID).QueryExpr()
+	err = tx.Where("entrega_id IN (?)", entregas).Delete(&IntentoWebhook{}).Error
+	if err != nil {
+		return errors.Wrap(err, "borrando intentos de webhooks")
+	}
+	err = tx.Where("user_id = ?", userID).Delete(&EntregaWebhook{}).Error
+	if err != nil {
+		return errors.Wrap(err, "borrando entregas de webhooks")
+	}
+	return nil
+}
+
+// entregarWebhook hace un intento de entrega y lo registra.
+func (h *Handler) entregarWebhook(ent EntregaWebhook) (err error) {
+	w := Webhook{}
+	err = h.db.First(&w, "id = ?", ent.WebhookID).Error
+	if err != nil {
+		return errors.Wrap(err, "buscando webhook")
+	}
+	if !w.Activo {
+		ent.Estado = EntregaFallida
+		return errors.Wrap(h.db.Save(&ent).Error, "actualizando entrega")
+	}
+
+	intento := h.enviarWebhook(w, ent)
+	intento.ID, _ = uuid.NewV4()
+	err = h.db.Create(&intento).Error
+	if err != nil {
+		return errors.Wrap(err, "registrando intento")
+	}
+
+	ent.Intentos++
+	switch {
+	case intento.Error == "":
+		ent.Estado = EntregaEntregada
+	case ent.Intentos >= h.webhookMaxIntentos():
+		ent.Estado = EntregaFallida
+	default:
+		ent.ProximoIntento = time.Now().Add(esperaWebhook(ent.Intentos))
+	}
+	err = h.db.Save(&ent).Error
+	if err != nil {
+		return errors.Wrap(err, "actualizando entrega")
+	}
+	return nil
+}
+
+func (h *Handler) webhookMaxIntentos() int {
+	if h.WebhookMaxIntentos > 0 {
+		return h.WebhookMaxIntentos
+	}
+	return webhookMaxIntentosDefault
+}
+
+// enviarWebhook hace el POST firmado. Cualquier respuesta que no sea 2xx se
+// considera un error.
+func (h *Handler) enviarWebhook(w Webhook, ent EntregaWebhook) (intento IntentoWebhook) {
+	intento.EntregaID = ent.ID
+	intento.Fecha = time.Now()
+	defer func() { intento.Duracion = time.Since(intento.Fecha) }()
+
+	body := []byte(ent.Payload)
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		intento.Error = err.Error()
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEventoWebhook, string(ent.Evento))
+	req.Header.Set(HeaderEntregaWebhook, ent.ID.String())
+	req.Header.Set(HeaderFirmaWebhook, firmarWebhook(w.Secreto, time.Now(), body))
+
+	cliente := h.ClienteWebhooks
+	if cliente == nil {
+		cliente = &http.Client{Timeout: webhookTimeout}
+	}
+	res, err := cliente.Do(req)
+	if err != nil {
+		intento.Error = err.Error()
+		return
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+
+	intento.Codigo = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		intento.Error = res.Status
+	}
+	return
+}
+
+// Webhooks lista los webhooks registrados. Sólo para administradores.
+func (h *Handler) Webhooks() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		_, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		webhooks := []Webhook{}
+		err := h.db.Order("created_at").Find(&webhooks).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando webhooks"), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(webhooks)
+	}
+}
+
+// NuevoWebhook registra un webhook. La respuesta incluye el secreto de la
+// firma, que no se vuelve a mostrar. Sólo para administradores.
+func (h *Handler) NuevoWebhook() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			URL     string
+			Eventos []TipoEvento
+		}{}
+
+		admin, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		if !strings.HasPrefix(request.URL, "https://") && !strings.HasPrefix(request.URL, "http://") {
+			httpErr(w, errors.New("la URL tiene que ser http o https"), http.StatusBadRequest)
+			return
+		}
+		eventos := []string{}
+		for _, v := range request.Eventos {
+			valido := false
+			for _, tipo := range eventosWebhook {
+				valido = valido || v == tipo
+			}
+			if !valido {
+				httpErr(w, errors.Errorf("no existe el evento %v", v), http.StatusBadRequest)
+				return
+			}
+			eventos = append(eventos, string(v))
+		}
+
+		secreto := make([]byte, 32)
+		_, err = rand.Read(secreto)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "generando secreto"), http.StatusInternalServerError)
+			return
+		}
+
+		wh := Webhook{}
+		wh.ID, _ = uuid.NewV4()
+		wh.URL = request.URL
+		wh.Secreto = hex.EncodeToString(secreto)
+		wh.Eventos = strings.Join(eventos, ",")
+		wh.Activo = true
+		wh.CreadoPor = admin.ID
+		err = h.db.Create(&wh).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "creando webhook"), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			Webhook
+			Secreto string
+		}{wh, wh.Secreto})
+	}
+}
+
+// BorrarWebhook desactiva un webhook. Las entregas pendientes no se
+// mandan. Sólo para administradores.
+func (h *Handler) BorrarWebhook() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			ID uuid.UUID
+		}{}
+
+		_, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		err = h.db.Model(&Webhook{}).Where("id = ?", request.ID).Update("activo", false).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "desactivando webhook"), http.StatusInternalServerError)
+			return
+		}
+		err = h.db.Model(&EntregaWebhook{}).
+			Where("webhook_id = ? AND estado = ?", request.ID, EntregaPendiente).
+			Update("estado", EntregaFallida).
+			Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "cancelando entregas"), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// EntregasWebhook devuelve las últimas entregas de un webhook con sus
+// intentos. El ID del webhook va en el parámetro "id" del query string. Sólo
+// para administradores.
+func (h *Handler) EntregasWebhook() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		_, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		entregas := []EntregaWebhook{}
+		err := h.db.
+			Where("webhook_id = ?", r.URL.Query().Get("id")).
+			Order("created_at DESC").
+			Limit(limiteUsuariosDefault).
+			Find(&entregas).
+			Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando entregas"), http.StatusInternalServerError)
+			return
+		}
+
+		type detalle struct {
+			EntregaWebhook
+			Detalle []IntentoWebhook
+		}
+		out := []detalle{}
+		for _, v := range entregas {
+			d := detalle{EntregaWebhook: v}
+			err = h.db.Where("entrega_id = ?", v.ID).Order("fecha").Find(&d.Detalle).Error
+			if err != nil {
+				httpErr(w, errors.Wrap(err, "buscando intentos"), http.StatusInternalServerError)
+				return
+			}
+			out = append(out, d)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// ReenviarWebhook vuelve a mandar una entrega, aunque ya se haya entregado o
+// haya fallado. Sólo para administradores.
+func (h *Handler) ReenviarWebhook() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			EntregaID uuid.UUID
+		}{}
+
+		_, ok := h.exigirRol(w, r, RolAdmin)
+		if !ok {
+			return
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "al leer JSON"), http.StatusBadRequest)
+			return
+		}
+
+		ent := EntregaWebhook{}
+		err = h.db.First(&ent, "id = ?", request.EntregaID).Error
+		if err != nil {
+			httpErr(w, errors.Wrap(err, "buscando entrega"), http.StatusNotFound)
+			return
+		}
+
+		// Arranca de nuevo con los reintentos. La tomo como en
+		// EntregarWebhooks, para que no la mande también otro proceso.
+		ahora := time.Now()
+		ent.Estado = EntregaPendiente
+		ent.Intentos = 0
+		ent.ProximoIntento = ahora.Add(webhookReserva)
+		res := h.db.
+			Model(&EntregaWebhook{}).
+			Where("id = ? AND (estado <> ? OR proximo_intento <= ?)", ent.ID, EntregaPendiente, ahora).
+			Update(map[string]interface{}{"Estado": ent.Estado, "Intentos": 0, "ProximoIntento": ent.ProximoIntento})
+		if res.Error != nil {
+			httpErr(w, errors.Wrap(res.Error, "reservando entrega"), http.StatusInternalServerError)
+			return
+		}
+		if res.RowsAffected != 1 {
+			httpErr(w, errors.New("la entrega ya está pendiente o se está mandando"), http.StatusConflict)
+			return
+		}
+		err = h.entregarWebhook(ent)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+}
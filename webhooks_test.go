@@ -0,0 +1,76 @@
+package sesiones
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirmaWebhook(t *testing.T) {
+	body := []byte(`{"Tipo":"UsuarioCreado"}`)
+	firma := firmarWebhook("secreto", time.Now(), body)
+
+	assert.Nil(t, VerificarFirmaWebhook("secreto", firma, body, time.Minute))
+	assert.NotNil(t, VerificarFirmaWebhook("otro", firma, body, time.Minute))
+	assert.NotNil(t, VerificarFirmaWebhook("secreto", firma, []byte(`{}`), time.Minute))
+	assert.NotNil(t, VerificarFirmaWebhook("secreto", "basura", body, time.Minute))
+
+	vieja := firmarWebhook("secreto", time.Now().Add(-time.Hour), body)
+	assert.NotNil(t, VerificarFirmaWebhook("secreto", vieja, body, time.Minute))
+}
+
+func TestEnviarWebhook(t *testing.T) {
+	recibido := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		err := VerificarFirmaWebhook("secreto", r.Header.Get(HeaderFirmaWebhook), body, time.Minute)
+		recibido <- err
+		if r.Header.Get(HeaderEventoWebhook) != string(EventoUsuarioCreado) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	h := Handler{}
+	wh := Webhook{URL: srv.URL, Secreto: "secreto"}
+	ent := EntregaWebhook{Evento: EventoUsuarioCreado, Payload: `{"Tipo":"UsuarioCreado"}`}
+	ent.ID, _ = uuid.NewV4()
+
+	intento := h.enviarWebhook(wh, ent)
+	assert.Nil(t, <-recibido)
+	assert.Equal(t, http.StatusOK, intento.Codigo)
+	assert.Equal(t, "", intento.Error)
+
+	// Una respuesta que no es 2xx es un error
+	ent.Evento = EventoLoginFallido
+	intento = h.enviarWebhook(wh, ent)
+	<-recibido
+	assert.Equal(t, http.StatusBadRequest, intento.Codigo)
+	assert.NotEqual(t, "", intento.Error)
+}
+
+func TestEsperaWebhook(t *testing.T) {
+	assert.Equal(t, 30*time.Second, esperaWebhook(1))
+	assert.Equal(t, 60*time.Second, esperaWebhook(2))
+	assert.Equal(t, 4*time.Minute, esperaWebhook(4))
+	assert.True(t, Webhook{}.recibe(EventoLoginFallido))
+	assert.False(t, Webhook{Eventos: "UsuarioCreado,UsuarioBorrado"}.recibe(EventoLoginFallido))
+	assert.True(t, Webhook{Eventos: "UsuarioCreado,UsuarioBorrado"}.recibe(EventoUsuarioBorrado))
+}
+
+func TestPayloadWebhook(t *testing.T) {
+	// Del usuario sólo va el ID
+	e := nuevoEvento(EventoUsuarioCreado, Usuario{ID: "u1", Email: "marcos@sweet.com", Nombre: "Marcos"}, nil)
+	id, _ := uuid.NewV4()
+	b, err := json.Marshal(nuevoPayloadWebhook(id, e))
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"UserID":"u1"`)
+	assert.NotContains(t, string(b), "marcos@sweet.com")
+	assert.NotContains(t, string(b), "Marcos")
+}